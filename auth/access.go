@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The metadata key for the token that the web and auth services share, which proves that a
+	// call was made by the web service
+	SERVICE_TOKEN_METADATA = "x-service-token"
+
+	// The metadata key for the principal that the web service authenticated a call for
+	PRINCIPAL_METADATA = "x-principal"
+)
+
+type requirement struct {
+	action   string
+	resource string
+}
+
+// The RPCs that only the web service may call, keyed by full method name, along with the
+// permission that the principal it calls them for needs. A nil requirement means that the web
+// service's word is enough. The web service checks the same permissions before calling, but
+// anything else that can reach the auth service's port would otherwise go unchecked.
+var restrictedMethods = map[string]*requirement{
+	"/auth.AuthService/UnlockAccount":  {"write", "accounts"},
+	"/auth.AuthService/RevokedTokens":  nil,
+	"/auth.ApiKeyService/CreateApiKey": {"write", "apikeys"},
+	"/auth.ApiKeyService/ListApiKeys":  {"read", "apikeys"},
+	"/auth.ApiKeyService/ScopeApiKey":  {"write", "apikeys"},
+	"/auth.ApiKeyService/RotateApiKey": {"write", "apikeys"},
+	"/auth.ApiKeyService/RevokeApiKey": {"write", "apikeys"},
+}
+
+// Checks the callers of restricted RPCs
+type accessControl struct {
+	serviceToken []byte
+	handler      *authHandler
+}
+
+func newAccessControl(serviceToken string, handler *authHandler) *accessControl {
+	return &accessControl{
+		serviceToken: []byte(serviceToken),
+		handler:      handler,
+	}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md[key]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// The principal that the web service made a call for, if any
+func principalFrom(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	return firstValue(md, PRINCIPAL_METADATA)
+}
+
+// Refuses calls to restricted RPCs unless they carry the service token and, where a permission
+// is required, the principal they were made for has it
+func (a *accessControl) interceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	required, restricted := restrictedMethods[info.FullMethod]
+
+	if !restricted {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if token := firstValue(md, SERVICE_TOKEN_METADATA); subtle.ConstantTimeCompare([]byte(token), a.serviceToken) != 1 {
+		logf(ctx, "Refused a call to %s without the service token", info.FullMethod)
+		return nil, status.Errorf(codes.Unauthenticated, "%s may only be called by the web service", info.FullMethod)
+	}
+
+	if required == nil {
+		return handler(ctx, req)
+	}
+
+	principal := firstValue(md, PRINCIPAL_METADATA)
+
+	allowed, err := a.handler.authorize(ctx, principal, required.action, required.resource)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not look up roles for %s: %v", principal, err)
+	}
+
+	if !allowed {
+		logf(ctx, "User %s denied %s", principal, info.FullMethod)
+		return nil, status.Errorf(codes.PermissionDenied, "%s requires %s", info.FullMethod, permission(required.action, required.resource))
+	}
+
+	return handler(ctx, req)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccessControl(t *testing.T) {
+	const token = "s3cret"
+
+	store := newMemoryStore()
+
+	store.addRole("admin", []string{"*:*"})
+	store.addRole("keys", []string{"read:apikeys"})
+
+	store.addUser("root", "", []string{"admin"})
+	store.addUser("auditor", "", []string{"keys"})
+	store.addUser("tony", "", nil)
+
+	access := newAccessControl(token, &authHandler{store: store})
+
+	tests := []struct {
+		name      string
+		method    string
+		token     string
+		principal string
+		want      codes.Code
+	}{
+		{"unrestricted without a token", "/auth.AuthService/Authenticate", "", "", codes.OK},
+		{"restricted without a token", "/auth.AuthService/UnlockAccount", "", "root", codes.Unauthenticated},
+		{"restricted with the wrong token", "/auth.AuthService/UnlockAccount", "guess", "root", codes.Unauthenticated},
+		{"without a principal", "/auth.AuthService/UnlockAccount", token, "", codes.PermissionDenied},
+		{"without the permission", "/auth.AuthService/UnlockAccount", token, "tony", codes.PermissionDenied},
+		{"with a wildcard permission", "/auth.AuthService/UnlockAccount", token, "root", codes.OK},
+		{"the web service's word is enough", "/auth.AuthService/RevokedTokens", token, "", codes.OK},
+		{"revocations without a token", "/auth.AuthService/RevokedTokens", "", "", codes.Unauthenticated},
+		{"read but not write", "/auth.ApiKeyService/CreateApiKey", token, "auditor", codes.PermissionDenied},
+		{"read", "/auth.ApiKeyService/ListApiKeys", token, "auditor", codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+
+			if tt.token != "" {
+				md[SERVICE_TOKEN_METADATA] = []string{tt.token}
+			}
+
+			if tt.principal != "" {
+				md[PRINCIPAL_METADATA] = []string{tt.principal}
+			}
+
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+
+			called := false
+
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				return nil, nil
+			}
+
+			_, err := access.interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("code = %s, want %s (%v)", got, tt.want, err)
+			}
+
+			if called != (tt.want == codes.OK) {
+				t.Errorf("handler called = %t, want %t", called, tt.want == codes.OK)
+			}
+		})
+	}
+}
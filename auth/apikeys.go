@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+const (
+	// API keys have the form "colossus_<prefix>_<secret>". Only a SHA-256 hash of the secret
+	// is ever stored.
+	API_KEY_PREFIX = "colossus_"
+
+	// How many random prefixes to try before giving up on creating a key. Prefixes are random,
+	// so a clash with an existing key is rare, but it mustn't replace that key.
+	API_KEY_CREATE_ATTEMPTS = 3
+
+	// Keys may only be created for the caller, unless the caller has this permission on
+	// apikeys
+	API_KEY_ADMIN_ACTION = "admin"
+)
+
+// Implements the ApiKeyService admin service
+type apiKeyHandler struct {
+	store CredentialStore
+
+	// Reports whether a principal has a permission
+	authorize func(ctx context.Context, principal, action, resource string) (bool, error)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// Splits a full API key into its prefix and secret
+func parseApiKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, API_KEY_PREFIX), "_", 2)
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// Generates a new secret for the key, returning the full key along with the hash to store
+func newApiKeySecret(apiKey *auth.ApiKey) (*auth.ApiKeySecret, string, error) {
+	secret, err := randomHex(24)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &auth.ApiKeySecret{
+		ApiKey: apiKey,
+		Key:    API_KEY_PREFIX + apiKey.Prefix + "_" + secret,
+	}, hashSecret(secret), nil
+}
+
+// Creates a key owned by the caller. Callers with admin:apikeys may create keys for others.
+func (h *apiKeyHandler) CreateApiKey(ctx context.Context, req *auth.CreateApiKeyRequest) (*auth.ApiKeySecret, error) {
+	caller := principalFrom(ctx)
+
+	owner := req.Owner
+
+	if owner == "" {
+		owner = caller
+	}
+
+	if req.Name == "" || owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "a name and owner are required")
+	}
+
+	if owner != caller {
+		allowed, err := h.authorize(ctx, caller, API_KEY_ADMIN_ACTION, "apikeys")
+
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not look up roles for %s: %v", caller, err)
+		}
+
+		if !allowed {
+			logf(ctx, "User %s denied creating an API key for %s", caller, owner)
+			return nil, status.Errorf(codes.PermissionDenied, "creating API keys for other users requires %s", permission(API_KEY_ADMIN_ACTION, "apikeys"))
+		}
+	}
+
+	for attempt := 0; attempt < API_KEY_CREATE_ATTEMPTS; attempt++ {
+		prefix, err := randomHex(4)
+
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not create API key: %v", err)
+		}
+
+		apiKey := &auth.ApiKey{
+			Prefix:    prefix,
+			Name:      req.Name,
+			Owner:     owner,
+			Routes:    req.Routes,
+			CreatedAt: time.Now().Unix(),
+			ExpiresAt: req.ExpiresAt,
+		}
+
+		secret, secretHash, err := newApiKeySecret(apiKey)
+
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not create API key: %v", err)
+		}
+
+		err = storeFor(ctx, h.store).CreateApiKey(apiKey, secretHash)
+
+		if err == errExists {
+			continue
+		}
+
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not create API key: %v", err)
+		}
+
+		logf(ctx, "Created API key %s (%s) for %s", prefix, req.Name, owner)
+
+		return secret, nil
+	}
+
+	return nil, status.Error(codes.Internal, "could not create API key: no free prefix found")
+}
+
+func (h *apiKeyHandler) ListApiKeys(ctx context.Context, req *auth.ListApiKeysRequest) (*auth.ListApiKeysResponse, error) {
+	all, err := storeFor(ctx, h.store).ApiKeys()
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list API keys: %v", err)
+	}
+
+	apiKeys := []*auth.ApiKey{}
+
+	for _, apiKey := range all {
+		if req.Owner == "" || apiKey.Owner == req.Owner {
+			apiKeys = append(apiKeys, apiKey)
+		}
+	}
+
+	return &auth.ListApiKeysResponse{ApiKeys: apiKeys}, nil
+}
+
+// Replaces the set of routes that the key may be used for. An empty set allows every route.
+func (h *apiKeyHandler) ScopeApiKey(ctx context.Context, req *auth.ScopeApiKeyRequest) (*auth.ApiKey, error) {
+	apiKey, _, err := storeFor(ctx, h.store).ApiKey(req.Prefix)
+
+	if err == errNotFound {
+		return nil, status.Errorf(codes.NotFound, "no API key with prefix %s", req.Prefix)
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not load API key %s: %v", req.Prefix, err)
+	}
+
+	err = storeFor(ctx, h.store).SetApiKeyRoutes(req.Prefix, req.Routes)
+
+	if err == errNotFound {
+		return nil, status.Errorf(codes.NotFound, "no API key with prefix %s", req.Prefix)
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not scope API key %s: %v", req.Prefix, err)
+	}
+
+	apiKey.Routes = req.Routes
+
+	logf(ctx, "Scoped API key %s to %v", req.Prefix, req.Routes)
+
+	return apiKey, nil
+}
+
+// Replaces the key's secret, keeping its prefix and metadata. The old secret stops working
+// immediately.
+func (h *apiKeyHandler) RotateApiKey(ctx context.Context, req *auth.RotateApiKeyRequest) (*auth.ApiKeySecret, error) {
+	apiKey, _, err := storeFor(ctx, h.store).ApiKey(req.Prefix)
+
+	if err == errNotFound {
+		return nil, status.Errorf(codes.NotFound, "no API key with prefix %s", req.Prefix)
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not load API key %s: %v", req.Prefix, err)
+	}
+
+	secret, secretHash, err := newApiKeySecret(apiKey)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not rotate API key %s: %v", req.Prefix, err)
+	}
+
+	err = storeFor(ctx, h.store).SetApiKeySecret(req.Prefix, secretHash)
+
+	if err == errNotFound {
+		return nil, status.Errorf(codes.NotFound, "no API key with prefix %s", req.Prefix)
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not rotate API key %s: %v", req.Prefix, err)
+	}
+
+	logf(ctx, "Rotated API key %s", req.Prefix)
+
+	return secret, nil
+}
+
+func (h *apiKeyHandler) RevokeApiKey(ctx context.Context, req *auth.RevokeApiKeyRequest) (*auth.RevokeApiKeyResponse, error) {
+	if err := storeFor(ctx, h.store).DeleteApiKey(req.Prefix); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not revoke API key %s: %v", req.Prefix, err)
+	}
+
+	logf(ctx, "Revoked API key %s", req.Prefix)
+
+	return &auth.RevokeApiKeyResponse{}, nil
+}
+
+// Checks an API key and whether it may be used for the given route. Allowed routes are either
+// a path, which allows any method, or a method and a path, such as "PUT /stream".
+func (h *apiKeyHandler) authenticate(ctx context.Context, key, method, path string) (*auth.ApiKeyAuthResponse, error) {
+	prefix, secret, ok := parseApiKey(key)
+
+	if !ok {
+		return &auth.ApiKeyAuthResponse{}, nil
+	}
+
+	apiKey, secretHash, err := storeFor(ctx, h.store).ApiKey(prefix)
+
+	if err == errNotFound {
+		return &auth.ApiKeyAuthResponse{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(secretHash)) != 1 {
+		return &auth.ApiKeyAuthResponse{}, nil
+	}
+
+	now := time.Now()
+
+	if apiKey.ExpiresAt != 0 && now.Unix() >= apiKey.ExpiresAt {
+		return &auth.ApiKeyAuthResponse{}, nil
+	}
+
+	err = storeFor(ctx, h.store).TouchApiKey(prefix, now)
+
+	// Revoked since it was looked up
+	if err == errNotFound {
+		return &auth.ApiKeyAuthResponse{}, nil
+	}
+
+	if err != nil {
+		logf(ctx, "Could not record use of API key %s: %v", prefix, err)
+	}
+
+	return &auth.ApiKeyAuthResponse{
+		Authenticated: true,
+		Allowed:       routeAllowed(apiKey.Routes, method, path),
+		Principal:     apiKey.Owner,
+	}, nil
+}
+
+func routeAllowed(routes []string, method, path string) bool {
+	if len(routes) == 0 {
+		return true
+	}
+
+	for _, route := range routes {
+		if route == path || route == method+" "+path {
+			return true
+		}
+	}
+
+	return false
+}
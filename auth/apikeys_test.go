@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+func newTestApiKeyHandler() *apiKeyHandler {
+	store := newMemoryStore()
+
+	store.addRole("admin", []string{"*:*"})
+	store.addRole("keys", []string{"write:apikeys", "admin:apikeys"})
+	store.addRole("writer", []string{"write:apikeys"})
+
+	store.addUser("root", "", []string{"admin"})
+	store.addUser("keymaster", "", []string{"keys"})
+	store.addUser("tony", "", []string{"writer"})
+
+	roles := &authHandler{store: store}
+
+	return &apiKeyHandler{store: store, authorize: roles.authorize}
+}
+
+// A context for a call that the web service made on the principal's behalf
+func callerContext(principal string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(PRINCIPAL_METADATA, principal))
+}
+
+func TestParseApiKey(t *testing.T) {
+	tests := []struct {
+		key        string
+		wantPrefix string
+		wantSecret string
+		wantOK     bool
+	}{
+		{"colossus_abcd1234_s3cret", "abcd1234", "s3cret", true},
+		{"colossus_abcd1234_s3cret_with_underscores", "abcd1234", "s3cret_with_underscores", true},
+		{"colossus_abcd1234", "", "", false},
+		{"colossus_abcd1234_", "", "", false},
+		{"colossus__s3cret", "", "", false},
+		{"colossus_", "", "", false},
+		{"other_abcd1234_s3cret", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			prefix, secret, ok := parseApiKey(tt.key)
+
+			if prefix != tt.wantPrefix || secret != tt.wantSecret || ok != tt.wantOK {
+				t.Errorf("parseApiKey() = %q, %q, %t, want %q, %q, %t", prefix, secret, ok, tt.wantPrefix, tt.wantSecret, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRouteAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{"no routes allow everything", nil, "PUT", "/stream", true},
+		{"path allows any method", []string{"/stream"}, "PUT", "/stream", true},
+		{"method and path", []string{"GET /stream"}, "GET", "/stream", true},
+		{"other method", []string{"GET /stream"}, "PUT", "/stream", false},
+		{"other path", []string{"/stream"}, "GET", "/user", false},
+		{"one of several", []string{"/user", "PUT /stream"}, "PUT", "/stream", true},
+		{"no prefix matching", []string{"/str"}, "GET", "/stream", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeAllowed(tt.routes, tt.method, tt.path); got != tt.want {
+				t.Errorf("routeAllowed(%v, %s, %s) = %t, want %t", tt.routes, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateApiKeyOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		caller    string
+		owner     string
+		wantOwner string
+		want      codes.Code
+	}{
+		{"defaults to the caller", "tony", "", "tony", codes.OK},
+		{"for the caller", "tony", "tony", "tony", codes.OK},
+		{"for someone else", "tony", "root", "", codes.PermissionDenied},
+		{"for someone else with admin:apikeys", "keymaster", "tony", "tony", codes.OK},
+		{"for someone else with a wildcard", "root", "tony", "tony", codes.OK},
+		{"without a caller", "", "", "", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestApiKeyHandler()
+
+			secret, err := h.CreateApiKey(callerContext(tt.caller), &auth.CreateApiKeyRequest{Name: "ci", Owner: tt.owner})
+
+			if status.Code(err) != tt.want {
+				t.Fatalf("CreateApiKey() = %v, want %s", err, tt.want)
+			}
+
+			if err != nil {
+				if keys, _ := h.store.ApiKeys(); len(keys) != 0 {
+					t.Errorf("a refused CreateApiKey() stored %d keys", len(keys))
+				}
+
+				return
+			}
+
+			if secret.ApiKey.Owner != tt.wantOwner {
+				t.Errorf("owner = %q, want %q", secret.ApiKey.Owner, tt.wantOwner)
+			}
+
+			res, err := h.authenticate(context.Background(), secret.Key, "GET", "/stream")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Principal != tt.wantOwner {
+				t.Errorf("the key authenticates as %q, want %q", res.Principal, tt.wantOwner)
+			}
+		})
+	}
+}
+
+func TestCreateApiKeyKeepsExistingPrefix(t *testing.T) {
+	store := newMemoryStore()
+
+	existing := &auth.ApiKey{Prefix: "abcd1234", Name: "first", Owner: "tony"}
+
+	if err := store.CreateApiKey(existing, hashSecret("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateApiKey(&auth.ApiKey{Prefix: "abcd1234", Name: "second", Owner: "root"}, hashSecret("second")); err != errExists {
+		t.Fatalf("CreateApiKey() with a prefix in use = %v, want errExists", err)
+	}
+
+	apiKey, secretHash, err := store.ApiKey("abcd1234")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if apiKey.Owner != "tony" || secretHash != hashSecret("first") {
+		t.Errorf("the existing key was replaced: %+v", apiKey)
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		expiresAt int64
+		want      bool
+	}{
+		{"never expires", 0, true},
+		{"expires later", now + 3600, true},
+		{"expired", now - 1, false},
+		{"expires now", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestApiKeyHandler()
+
+			secret, err := h.CreateApiKey(callerContext("tony"), &auth.CreateApiKeyRequest{Name: "ci", ExpiresAt: tt.expiresAt})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := h.authenticate(context.Background(), secret.Key, "GET", "/stream")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Authenticated != tt.want {
+				t.Errorf("authenticated = %t, want %t", res.Authenticated, tt.want)
+			}
+		})
+	}
+}
+
+func TestApiKeyRotationAndRevocation(t *testing.T) {
+	h := newTestApiKeyHandler()
+
+	ctx := callerContext("tony")
+
+	original, err := h.CreateApiKey(ctx, &auth.CreateApiKeyRequest{Name: "ci", Routes: []string{"GET /stream"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := original.ApiKey.Prefix
+
+	rotated, err := h.RotateApiKey(ctx, &auth.RotateApiKeyRequest{Prefix: prefix})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.ApiKey.Prefix != prefix || rotated.Key == original.Key {
+		t.Fatalf("rotation gave %s, want a new secret for prefix %s", rotated.Key, prefix)
+	}
+
+	if _, err := h.ScopeApiKey(ctx, &auth.ScopeApiKeyRequest{Prefix: prefix, Routes: []string{"/user"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		key               string
+		method            string
+		path              string
+		wantAuthenticated bool
+		wantAllowed       bool
+	}{
+		{"old secret", original.Key, "GET", "/user", false, false},
+		{"new secret", rotated.Key, "GET", "/user", true, true},
+		{"route outside the new scope", rotated.Key, "GET", "/stream", true, false},
+		{"wrong secret", API_KEY_PREFIX + prefix + "_guess", "GET", "/user", false, false},
+		{"unknown prefix", API_KEY_PREFIX + "00000000_guess", "GET", "/user", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := h.authenticate(context.Background(), tt.key, tt.method, tt.path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Authenticated != tt.wantAuthenticated || res.Allowed != tt.wantAllowed {
+				t.Errorf("authenticate() = %+v, want authenticated %t, allowed %t", res, tt.wantAuthenticated, tt.wantAllowed)
+			}
+		})
+	}
+
+	if _, err := h.RevokeApiKey(ctx, &auth.RevokeApiKeyRequest{Prefix: prefix}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.authenticate(context.Background(), rotated.Key, "GET", "/user")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Authenticated {
+		t.Errorf("a revoked key still authenticates")
+	}
+
+	if _, err := h.ScopeApiKey(ctx, &auth.ScopeApiKeyRequest{Prefix: prefix, Routes: []string{"/user"}}); status.Code(err) != codes.NotFound {
+		t.Errorf("ScopeApiKey() after revocation = %v, want NotFound", err)
+	}
+
+	if _, err := h.RotateApiKey(ctx, &auth.RotateApiKeyRequest{Prefix: prefix}); status.Code(err) != codes.NotFound {
+		t.Errorf("RotateApiKey() after revocation = %v, want NotFound", err)
+	}
+
+	// Updates that race with a revocation mustn't bring the key back
+	store := h.store
+
+	if err := store.SetApiKeyRoutes(prefix, []string{"/user"}); err != errNotFound {
+		t.Errorf("SetApiKeyRoutes() after revocation = %v, want errNotFound", err)
+	}
+
+	if err := store.SetApiKeySecret(prefix, hashSecret("guess")); err != errNotFound {
+		t.Errorf("SetApiKeySecret() after revocation = %v, want errNotFound", err)
+	}
+
+	if err := store.TouchApiKey(prefix, time.Now()); err != errNotFound {
+		t.Errorf("TouchApiKey() after revocation = %v, want errNotFound", err)
+	}
+
+	if _, _, err := store.ApiKey(prefix); err != errNotFound {
+		t.Errorf("ApiKey() after revocation = %v, want errNotFound", err)
+	}
+}
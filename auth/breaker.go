@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Stops connecting to Redis once it has failed failureThreshold times in a row, so that callers
+// get an immediate error instead of waiting on timeouts. After openTimeout a single connection
+// attempt is let through as a probe; once it or a command succeeds the breaker closes again.
+type circuitBreaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(failureThreshold int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+	}
+}
+
+// Reports whether a connection attempt may go ahead. Once the open timeout has passed, exactly one
+// attempt is let through as a probe; everyone else is refused until its outcome is recorded.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return errBreakerOpen
+		}
+
+		log.Print("Redis circuit breaker is half-open; probing Redis")
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		return errBreakerOpen
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(err error) {
+	// Refusals are the breaker's own doing and say nothing about Redis
+	if err == errBreakerOpen {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Only failing to reach Redis counts. A missing key or an error reply such as WRONGTYPE is an
+	// answer, which shows that Redis is up.
+	if !isConnectionError(err) {
+		if b.state != breakerClosed {
+			log.Print("Redis circuit breaker closed")
+		}
+
+		b.state = breakerClosed
+		b.failures = 0
+		redisBreakerOpen.Set(0)
+		return
+	}
+
+	b.failures++
+
+	switch b.state {
+	case breakerClosed:
+		if b.failures < b.failureThreshold {
+			return
+		}
+
+		log.Printf("Redis circuit breaker opened after %d consecutive failures: %v", b.failures, err)
+	case breakerHalfOpen:
+		log.Printf("Redis circuit breaker probe failed; opening again: %v", err)
+	default:
+		// Commands still in flight when the breaker opened mustn't push the end of the open
+		// timeout back
+		return
+	}
+
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	redisBreakerOpen.Set(1)
+}
+
+// Whether err means that Redis couldn't be reached or didn't answer in time, rather than that it
+// answered with an error. go-redis reports both dial and read failures as net.Errors, and a
+// connection that Redis drops as an EOF.
+func isConnectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+
+	return ok
+}
+
+// Returns a dialer for redis.Options that refuses to open connections while the breaker is
+// open. Connections to an unreachable Redis are dropped from the pool as they fail, so once
+// the breaker opens, commands fail fast instead of waiting on dial timeouts.
+func (b *circuitBreaker) dialer(network, addr string, timeout time.Duration) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if err := b.allow(); err != nil {
+			return nil, err
+		}
+
+		conn, err := net.DialTimeout(network, addr, timeout)
+
+		// Successful dials are recorded too, since go-redis's own background dials, which may
+		// be the probe, never send a command
+		b.record(err)
+
+		return conn, err
+	}
+}
+
+// Records the outcome of every command and pipeline sent by the client
+func (b *circuitBreaker) observe(client *redis.Client) {
+	client.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			err := process(cmd)
+			b.record(err)
+			return err
+		}
+	})
+
+	client.WrapProcessPipeline(func(process func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := process(cmds)
+			b.record(err)
+			return err
+		}
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var errRedisDown = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// What go-redis returns when Redis doesn't answer in time
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func TestCircuitBreakerRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		outcome []error
+		want    breakerState
+	}{
+		{"no failures", nil, breakerClosed},
+		{"below the threshold", []error{errRedisDown, errRedisDown}, breakerClosed},
+		{"at the threshold", []error{errRedisDown, errRedisDown, errRedisDown}, breakerOpen},
+		{"success resets the count", []error{errRedisDown, errRedisDown, nil, errRedisDown}, breakerClosed},
+		{"missing keys are successes", []error{errRedisDown, errRedisDown, redis.Nil, errRedisDown}, breakerClosed},
+		{"refusals aren't failures", []error{errRedisDown, errRedisDown, errBreakerOpen, errBreakerOpen}, breakerClosed},
+		{"timeouts are failures", []error{errRedisDown, errRedisDown, timeoutError{}}, breakerOpen},
+		{"dropped connections are failures", []error{errRedisDown, io.EOF, io.ErrUnexpectedEOF}, breakerOpen},
+		{"error replies are successes", []error{errRedisDown, errRedisDown, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), errRedisDown}, breakerClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, time.Minute)
+
+			for _, err := range tt.outcome {
+				b.record(err)
+			}
+
+			if got := b.currentState(); got != tt.want {
+				t.Errorf("state = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerOpenTimeoutIsNotExtended(t *testing.T) {
+	b := newCircuitBreaker(1, 50*time.Millisecond)
+
+	b.record(errRedisDown)
+
+	openedAt := b.openedAt
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Neither refused commands nor ones that were already in flight push the timeout back
+	b.record(errBreakerOpen)
+	b.record(errRedisDown)
+
+	if !b.openedAt.Equal(openedAt) {
+		t.Errorf("openedAt moved from %v to %v", openedAt, b.openedAt)
+	}
+}
+
+// Takes the breaker from closed to open to half-open and back to closed, with many callers
+// hammering it at every step
+func TestCircuitBreakerLifecycle(t *testing.T) {
+	const callers = 50
+
+	b := newCircuitBreaker(5, 20*time.Millisecond)
+
+	concurrently := func(f func()) {
+		var wg sync.WaitGroup
+
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				f()
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	concurrently(func() {
+		b.record(errRedisDown)
+	})
+
+	if got := b.currentState(); got != breakerOpen {
+		t.Fatalf("state after %d failures = %d, want open", callers, got)
+	}
+
+	concurrently(func() {
+		err := b.allow()
+
+		if err != errBreakerOpen {
+			t.Errorf("open breaker let a caller through: %v", err)
+		}
+
+		b.record(err)
+	})
+
+	time.Sleep(30 * time.Millisecond)
+
+	var probes int32
+
+	concurrently(func() {
+		err := b.allow()
+
+		if err == nil {
+			atomic.AddInt32(&probes, 1)
+			return
+		}
+
+		b.record(err)
+	})
+
+	if probes != 1 {
+		t.Fatalf("%d probes were let through, want exactly 1", probes)
+	}
+
+	if got := b.currentState(); got != breakerHalfOpen {
+		t.Fatalf("state after refusing everyone but the probe = %d, want half-open", got)
+	}
+
+	b.record(nil)
+
+	concurrently(func() {
+		if err := b.allow(); err != nil {
+			t.Errorf("closed breaker refused a caller: %v", err)
+		}
+	})
+}
+
+func TestCircuitBreakerDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name string
+		addr string
+		want breakerState
+	}{
+		{"successful probe closes the breaker", listener.Addr().String(), breakerClosed},
+		{"failed probe opens it again", unreachable, breakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(1, 10*time.Millisecond)
+
+			b.record(errRedisDown)
+
+			time.Sleep(20 * time.Millisecond)
+
+			conn, err := b.dialer("tcp", tt.addr, time.Second)()
+
+			if err == nil {
+				conn.Close()
+			}
+
+			if got := b.currentState(); got != tt.want {
+				t.Errorf("state = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// Redis answering every command with an error reply is still Redis answering, so the breaker
+// stays closed however many commands fail
+func TestCircuitBreakerIgnoresErrorReplies(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+
+				// Each command is an array of bulk strings: a header line, then a length line and
+				// a value line per argument
+				for {
+					var args int
+
+					line, err := r.ReadString('\n')
+
+					if err != nil {
+						return
+					}
+
+					fmt.Sscanf(line, "*%d", &args)
+
+					for i := 0; i < 2*args; i++ {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+
+					conn.Write([]byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"))
+				}
+			}()
+		}
+	}()
+
+	b := newCircuitBreaker(3, time.Minute)
+
+	client := redis.NewClient(&redis.Options{
+		Addr:   listener.Addr().String(),
+		Dialer: b.dialer("tcp", listener.Addr().String(), time.Second),
+	})
+
+	defer client.Close()
+
+	b.observe(client)
+
+	for i := 0; i < 10; i++ {
+		if err := client.Get("key").Err(); err == nil || isConnectionError(err) {
+			t.Fatalf("Get() = %v, want an error reply", err)
+		}
+	}
+
+	if got := b.currentState(); got != breakerClosed {
+		t.Errorf("state after 10 error replies = %d, want closed", got)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lucperkins/colossus/config"
+	"github.com/lucperkins/colossus/tracing"
+)
+
+type Config struct {
+	Port int `mapstructure:"port"`
+
+	PrometheusPort int `mapstructure:"prometheus_port"`
+
+	// Where users, roles, and the rest of the service's state are kept: redis, memory,
+	// htpasswd, or json
+	CredentialStore string `mapstructure:"credential_store"`
+
+	// The file that the htpasswd and json stores load from, and that the memory store is seeded
+	// from if it's set
+	CredentialFile string `mapstructure:"credential_file"`
+
+	// The permissions of every user in an htpasswd file, which has no roles of its own
+	HtpasswdPermissions []string `mapstructure:"htpasswd_permissions"`
+
+	SigningKeyFile string `mapstructure:"signing_key_file"`
+
+	// Whether to sign with a throwaway key when there's no key file, which is only good for
+	// local development with a single replica
+	EphemeralSigningKey bool `mapstructure:"ephemeral_signing_key"`
+
+	// Shared with the web service, which sends it with every call to prove where the call came
+	// from. Account and API key RPCs are refused without it.
+	ServiceToken string `mapstructure:"service_token"`
+
+	// How long to keep serving after failing the readiness probe on shutdown, before draining.
+	// Kubernetes only stops routing requests here once the probe has failed failureThreshold
+	// times in a row, so this needs to be at least the probe's period times its failureThreshold.
+	ReadinessGracePeriod time.Duration `mapstructure:"readiness_grace_period"`
+
+	// How long in-flight requests get to finish on shutdown. Added to the readiness grace period,
+	// this needs to be shorter than the pod's termination grace period, after which Kubernetes
+	// kills the process outright.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	Redis RedisConfig `mapstructure:"redis"`
+
+	Tracing tracing.Config `mapstructure:"tracing"`
+}
+
+type RedisConfig struct {
+	Address string `mapstructure:"address"`
+
+	Password string `mapstructure:"password"`
+
+	// Consecutive Redis failures after which the circuit breaker opens
+	BreakerFailureThreshold int `mapstructure:"breaker_failure_threshold"`
+
+	// How long the circuit breaker stays open before probing Redis again
+	BreakerOpenTimeout time.Duration `mapstructure:"breaker_open_timeout"`
+}
+
+var settings = append([]config.Setting{
+	{Key: "port", Default: PORT, Usage: "The port the gRPC server listens on"},
+	{Key: "prometheus_port", Default: PROMETHEUS_PORT, Usage: "The port for metrics, health checks, and the effective config"},
+	{Key: "credential_store", Default: STORE_REDIS, Usage: "The credential store: redis, memory, htpasswd, or json"},
+	{Key: "credential_file", Default: "", Usage: "The file that the htpasswd and json credential stores load from, and that the memory store is seeded from"},
+	{Key: "htpasswd_permissions", Default: []string{"read:data", "write:data", "read:userinfo"}, Usage: "The permissions of every user in an htpasswd credential file"},
+	{Key: "signing_key_file", Default: SIGNING_KEY_FILE, Usage: "The PEM-encoded ECDSA P-256 key used to sign tokens"},
+	{Key: "ephemeral_signing_key", Default: false, Usage: "Sign with a throwaway key when there's no key file; for local development with a single replica only"},
+	{Key: "service_token", Default: "", Usage: "The token shared with the web service, which account and API key RPCs require", Secret: true},
+	{Key: "readiness_grace_period", Default: 15 * time.Second, Usage: "How long to keep serving after failing the readiness probe on shutdown, before draining"},
+	{Key: "shutdown_timeout", Default: 25 * time.Second, Usage: "How long in-flight requests get to finish on shutdown"},
+	{Key: "redis.address", Default: "colossus-redis-cluster:6379", Usage: "The address of the Redis credential store"},
+	{Key: "redis.password", Default: "", Usage: "The Redis password, if any", Secret: true},
+	{Key: "redis.breaker_failure_threshold", Default: 5, Usage: "Consecutive Redis failures after which the circuit breaker opens"},
+	{Key: "redis.breaker_open_timeout", Default: 10 * time.Second, Usage: "How long the circuit breaker stays open before probing Redis again"},
+}, tracing.Settings...)
+
+func (c *Config) Validate() error {
+	var problems config.Problems
+
+	problems.Port("port", c.Port)
+	problems.Port("prometheus_port", c.PrometheusPort)
+	problems.OneOf("credential_store", c.CredentialStore, STORE_REDIS, STORE_MEMORY, STORE_HTPASSWD, STORE_JSON)
+
+	if c.CredentialStore == STORE_HTPASSWD || c.CredentialStore == STORE_JSON {
+		problems.NonEmpty("credential_file", c.CredentialFile)
+	}
+
+	if c.CredentialStore == STORE_HTPASSWD {
+		for _, p := range c.HtpasswdPermissions {
+			if parts := strings.Split(p, ":"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				problems.Add("htpasswd_permissions", "%q is not of the form <action>:<resource>", p)
+			}
+		}
+	}
+
+	problems.NonEmpty("signing_key_file", c.SigningKeyFile)
+	problems.NonEmpty("service_token", c.ServiceToken)
+	problems.NonNegativeDuration("readiness_grace_period", c.ReadinessGracePeriod)
+	problems.PositiveDuration("shutdown_timeout", c.ShutdownTimeout)
+
+	if c.CredentialStore == STORE_REDIS {
+		problems.NonEmpty("redis.address", c.Redis.Address)
+		problems.Positive("redis.breaker_failure_threshold", c.Redis.BreakerFailureThreshold)
+		problems.PositiveDuration("redis.breaker_open_timeout", c.Redis.BreakerOpenTimeout)
+	}
+
+	c.Tracing.Validate(&problems)
+
+	if c.Port == c.PrometheusPort {
+		problems.Add("prometheus_port", "must differ from port")
+	}
+
+	return problems.Err()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const HEALTH_CHECK_INTERVAL = 5 * time.Second
+
+// The services whose status is reported over grpc.health.v1.Health. The empty name stands for
+// the server as a whole.
+var healthCheckedServices = []string{"", "auth.AuthService", "auth.ApiKeyService"}
+
+// Tracks whether the auth service can do its job, which means that its credential store is
+// reachable, that it has loaded the token revocation list and that it isn't shutting down. The state is reported both over gRPC health
+// checking and over HTTP for Kubernetes probes.
+type healthChecker struct {
+	store             CredentialStore
+	revocationsLoaded func() bool
+	server            *health.Server
+
+	mu           sync.RWMutex
+	serving      bool
+	shuttingDown bool
+}
+
+func newHealthChecker(store CredentialStore, revocationsLoaded func() bool) *healthChecker {
+	h := &healthChecker{
+		store:             store,
+		revocationsLoaded: revocationsLoaded,
+		server:            health.NewServer(),
+	}
+
+	h.setServing(false)
+
+	return h
+}
+
+func (h *healthChecker) setServing(serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+
+	for _, service := range healthCheckedServices {
+		h.server.SetServingStatus(service, status)
+	}
+}
+
+// Pings the credential store, looks at whether the revocation list has been loaded, and updates
+// the serving status to match
+func (h *healthChecker) check() {
+	err := h.store.Ping()
+
+	if err != nil {
+		err = fmt.Errorf("credential store is unreachable: %v", err)
+	} else if !h.revocationsLoaded() {
+		err = errRevocationsNotLoaded
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		return
+	}
+
+	serving := err == nil
+
+	if serving != h.serving {
+		if serving {
+			log.Print("Credential store is reachable and revocation list is loaded; now serving")
+		} else {
+			log.Printf("No longer serving: %v", err)
+		}
+	}
+
+	h.serving = serving
+	h.setServing(serving)
+}
+
+func (h *healthChecker) run() {
+	h.check()
+
+	for range time.Tick(HEALTH_CHECK_INTERVAL) {
+		h.check()
+	}
+}
+
+// Reports NOT_SERVING from now on, so that clients and load balancers stop sending new requests.
+// The liveness probe keeps passing, since failing it would get the pod killed before it has
+// drained.
+func (h *healthChecker) shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.shuttingDown = true
+	h.serving = false
+	h.setServing(false)
+}
+
+// The liveness probe passes as long as the server answers. Neither an unreachable credential
+// store nor shutting down are something that restarting the auth service would fix.
+func (h *healthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// The readiness probe fails whenever the gRPC health status is NOT_SERVING
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	serving := h.serving
+	h.mu.RUnlock()
+
+	if !serving {
+		http.Error(w, "not serving", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
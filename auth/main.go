@@ -6,22 +6,34 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
+	"github.com/lucperkins/colossus/config"
 	"github.com/lucperkins/colossus/proto/auth"
+	"github.com/lucperkins/colossus/tracing"
 )
 
+// Defaults for the port and prometheus_port settings
 const (
 	PORT = 8888
 
 	PROMETHEUS_PORT = 9092
 )
 
+// The name that the auth service's own spans, such as the ones for Redis commands, are recorded
+// under
+const TRACER_NAME = "github.com/lucperkins/colossus/auth"
+
 var (
 	metricsRegistry = prometheus.NewRegistry()
 
@@ -32,60 +44,387 @@ var (
 		Help: "Auth success counter",
 	})
 
-	failCounter = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "auth_svc_fail",
-		Help: "Auth fail counter",
+	redisBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_svc_redis_breaker_open",
+		Help: "Whether the Redis circuit breaker is open (1) or closed (0)",
 	})
+
+	failCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_svc_fail",
+		Help: "Auth fail counter by failure reason",
+	}, []string{"reason"})
+)
+
+// Values for the reason label of the auth_svc_fail counter
+const (
+	FAIL_REASON_INVALID_CREDENTIALS = "invalid_credentials"
+
+	FAIL_REASON_THROTTLED = "throttled"
+
+	FAIL_REASON_LOCKED_OUT = "locked_out"
+
+	FAIL_REASON_INVALID_REFRESH_TOKEN = "invalid_refresh_token"
 )
 
 type authHandler struct {
-	redisClient *redis.Client
+	store       CredentialStore
+	tokens      *tokenIssuer
+	revocations *revocationList
+	apiKeys     *apiKeyHandler
 }
 
-func (h *authHandler) Authenticate(ctx context.Context, req *auth.AuthRequest) (*auth.AuthResponse, error) {
-	var authenticated bool
+// An attempt that has been counted against a subject while its password is checked
+type begunAttempt struct {
+	throttledSubject
+	failures int64
+}
 
-	password := req.Password
+// Checks a username and password, subject to the brute-force limits on both the user and the
+// client IP. Attempts that are refused outright are reported as a throttling status error.
+func (h *authHandler) login(ctx context.Context, username, password, clientIP string) (bool, error) {
+	var begun []begunAttempt
+
+	// Takes back the failures counted for an attempt that didn't get as far as failing
+	forgive := func(attempts []begunAttempt) {
+		for _, a := range attempts {
+			if err := h.forgiveAttempt(ctx, a.rule, a.subject); err != nil {
+				logf(ctx, "Could not forgive attempt for %s %s: %v", a.rule.kind, a.subject, err)
+			}
+		}
+	}
+
+	for _, check := range loginThrottles(username, clientIP) {
+		reason, retryAfter, failures, err := h.beginAttempt(ctx, check.rule, check.subject)
 
-	log.Printf("Request received for the password %s", password)
+		if err != nil {
+			logf(ctx, "Could not check failed attempts for %s %s: %v", check.rule.kind, check.subject, err)
+			forgive(begun)
+			return false, status.Error(codes.Unavailable, "credential store unavailable")
+		}
 
-	value, err := h.redisClient.Get("password").Result()
+		switch reason {
+		case auth.AuthFailureReason_LOCKED_OUT:
+			logf(ctx, "Refused attempt for user %s: %s %s is locked out", username, check.rule.kind, check.subject)
+			failCounter.WithLabelValues(FAIL_REASON_LOCKED_OUT).Inc()
+			forgive(begun)
+			return false, throttleError(reason, retryAfter)
+		case auth.AuthFailureReason_THROTTLED:
+			logf(ctx, "Refused attempt for user %s: %s %s is backing off", username, check.rule.kind, check.subject)
+			failCounter.WithLabelValues(FAIL_REASON_THROTTLED).Inc()
+			forgive(begun)
+			return false, throttleError(reason, retryAfter)
+		}
 
-	if err != nil {
-		log.Fatalf("Could not fetch value from Redis: %v", err)
+		begun = append(begun, begunAttempt{check, failures})
 	}
 
-	authenticated = password == value
+	authenticated, err := h.verifyPassword(ctx, username, password)
+
+	if err != nil {
+		logf(ctx, "Could not verify credentials for user %s: %v", username, err)
+		forgive(begun)
+		return false, status.Error(codes.Unavailable, "credential store unavailable")
+	}
 
 	if authenticated {
-		log.Printf("Password %s succeeded", password)
+		logf(ctx, "User %s succeeded", username)
 		authCounter.Inc()
+
+		// A successful login clears the user's slate, but only takes back its own attempt from
+		// the client IP, which may be guessing at other users' passwords too
+		if err := h.resetThrottle(ctx, userThrottle, username); err != nil {
+			logf(ctx, "Could not reset failed attempts for user %s: %v", username, err)
+		}
+
+		for _, a := range begun {
+			if a.rule.kind != userThrottle.kind {
+				forgive([]begunAttempt{a})
+			}
+		}
+
+		return true, nil
+	}
+
+	logf(ctx, "User %s failed", username)
+	failCounter.WithLabelValues(FAIL_REASON_INVALID_CREDENTIALS).Inc()
+
+	for _, a := range begun {
+		lockedOut, err := h.lockOutIfExceeded(ctx, a.rule, a.subject, a.failures)
+
+		if err != nil {
+			logf(ctx, "Could not lock out %s %s: %v", a.rule.kind, a.subject, err)
+		}
+
+		if lockedOut {
+			failCounter.WithLabelValues(FAIL_REASON_LOCKED_OUT).Inc()
+		}
+	}
+
+	return false, nil
+}
+
+func (h *authHandler) Authenticate(ctx context.Context, req *auth.AuthRequest) (*auth.AuthResponse, error) {
+	logf(ctx, "Request received for the user %s", req.Username)
+
+	authenticated, err := h.login(ctx, req.Username, req.Password, req.ClientIp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !authenticated {
+		return &auth.AuthResponse{Authenticated: false, Reason: auth.AuthFailureReason_INVALID_CREDENTIALS}, nil
+	}
+
+	return &auth.AuthResponse{Authenticated: true}, nil
+}
+
+func (h *authHandler) Authorize(ctx context.Context, req *auth.AuthorizeRequest) (*auth.AuthorizeResponse, error) {
+	allowed, err := h.authorize(ctx, req.Principal, req.Action, req.Resource)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not look up roles for %s: %v", req.Principal, err)
+	}
+
+	if !allowed {
+		logf(ctx, "User %s denied %s on %s", req.Principal, req.Action, req.Resource)
+	}
+
+	return &auth.AuthorizeResponse{Allowed: allowed}, nil
+}
+
+func (h *authHandler) IssueToken(ctx context.Context, req *auth.AuthRequest) (*auth.TokenResponse, error) {
+	logf(ctx, "Token requested for the user %s", req.Username)
+
+	authenticated, err := h.login(ctx, req.Username, req.Password, req.ClientIp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !authenticated {
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+
+	family, err := newTokenID()
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not issue token: %v", err)
+	}
+
+	return h.issueTokens(ctx, req.Username, family)
+}
+
+// Issues an access token along with a refresh token that can be exchanged for the next pair
+func (h *authHandler) issueTokens(ctx context.Context, username, family string) (*auth.TokenResponse, error) {
+	token, expiresAt, err := h.tokens.issue(username, family)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not issue token: %v", err)
+	}
+
+	refreshToken, refreshExpiresAt, err := h.newRefreshToken(ctx, username, family)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not issue refresh token: %v", err)
+	}
+
+	return &auth.TokenResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.Unix(),
+	}, nil
+}
+
+func (h *authHandler) RefreshToken(ctx context.Context, req *auth.RefreshTokenRequest) (*auth.TokenResponse, error) {
+	rt, err := h.useRefreshToken(ctx, req.RefreshToken)
+
+	switch {
+	case err == errRefreshTokenReused:
+		logf(ctx, "Refresh token reuse detected; revoked its token family")
+		failCounter.WithLabelValues(FAIL_REASON_INVALID_REFRESH_TOKEN).Inc()
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err == errRefreshTokenInvalid:
+		failCounter.WithLabelValues(FAIL_REASON_INVALID_REFRESH_TOKEN).Inc()
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Unavailable, "could not use refresh token: %v", err)
+	}
+
+	logf(ctx, "Refreshing tokens for the user %s", rt.username)
+
+	return h.issueTokens(ctx, rt.username, rt.family)
+}
+
+// Revokes an access token, or the whole family of a refresh token. Tokens that are already
+// invalid have nothing left to revoke, so they aren't treated as an error.
+func (h *authHandler) RevokeToken(ctx context.Context, req *auth.RevokeTokenRequest) (*auth.RevokeTokenResponse, error) {
+	if claims, err := h.tokens.validate(req.Token); err == nil {
+		if err := h.revocations.revoke(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not revoke token: %v", err)
+		}
+
+		logf(ctx, "Revoked access token %s for the user %s", claims.Id, claims.Subject)
+
+		return &auth.RevokeTokenResponse{}, nil
+	}
+
+	family, err := h.refreshTokenFamily(ctx, req.Token)
+
+	if err == errRefreshTokenInvalid {
+		return &auth.RevokeTokenResponse{}, nil
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not look up refresh token: %v", err)
+	}
+
+	if err := h.revokeFamily(ctx, family); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not revoke token: %v", err)
+	}
+
+	logf(ctx, "Revoked token family %s", family)
+
+	return &auth.RevokeTokenResponse{}, nil
+}
+
+// Clears the failed attempts and any lockout for a user and/or client IP
+func (h *authHandler) UnlockAccount(ctx context.Context, req *auth.UnlockAccountRequest) (*auth.UnlockAccountResponse, error) {
+	if req.Username == "" && req.ClientIp == "" {
+		return nil, status.Error(codes.InvalidArgument, "a username or client IP is required")
+	}
+
+	if err := h.resetThrottle(ctx, userThrottle, req.Username); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not unlock user: %v", err)
+	}
+
+	if err := h.resetThrottle(ctx, ipThrottle, req.ClientIp); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not unlock client IP: %v", err)
+	}
+
+	logf(ctx, "Unlocked user %q and client IP %q", req.Username, req.ClientIp)
+
+	return &auth.UnlockAccountResponse{}, nil
+}
+
+func (h *authHandler) AuthenticateApiKey(ctx context.Context, req *auth.ApiKeyAuthRequest) (*auth.ApiKeyAuthResponse, error) {
+	res, err := h.apiKeys.authenticate(ctx, req.Key, req.Method, req.Path)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not look up API key: %v", err)
+	}
+
+	if !res.Authenticated {
+		logf(ctx, "API key rejected")
+		failCounter.WithLabelValues(FAIL_REASON_INVALID_CREDENTIALS).Inc()
 	} else {
-		log.Printf("Password %s failed", password)
-		failCounter.Inc()
+		authCounter.Inc()
+	}
+
+	return res, nil
+}
+
+func (h *authHandler) RevokedTokens(ctx context.Context, req *auth.RevokedTokensRequest) (*auth.RevokedTokensResponse, error) {
+	ids, err := h.revocations.ids()
+
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &auth.RevokedTokensResponse{Ids: ids}, nil
+}
+
+func (h *authHandler) ValidateToken(ctx context.Context, req *auth.ValidateTokenRequest) (*auth.ValidateTokenResponse, error) {
+	claims, err := h.tokens.validate(req.Token)
+
+	if err != nil {
+		logf(ctx, "Token validation failed: %v", err)
+		return &auth.ValidateTokenResponse{Valid: false}, nil
+	}
+
+	revoked, err := h.revocations.isRevoked(claims.Id, claims.Family)
+
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 
-	return &auth.AuthResponse{Authenticated: authenticated}, nil
+	if revoked {
+		logf(ctx, "Token %s has been revoked", claims.Id)
+		return &auth.ValidateTokenResponse{Valid: false}, nil
+	}
+
+	return &auth.ValidateTokenResponse{
+		Valid:     true,
+		Username:  claims.Subject,
+		ExpiresAt: claims.ExpiresAt,
+	}, nil
+}
+
+func (h *authHandler) PublicKey(ctx context.Context, req *auth.PublicKeyRequest) (*auth.PublicKeyResponse, error) {
+	return &auth.PublicKeyResponse{
+		KeyId:     h.tokens.keyID,
+		PublicKey: h.tokens.publicKeyPEM,
+	}, nil
 }
 
 func main() {
-	log.Printf("Starting up the gRPC auth server on localhost:%d", PORT)
+	loaded, err := config.Load("auth", settings, os.Args[1:])
+
+	if err != nil {
+		log.Fatalf("Could not load configuration: %v", err)
+	}
 
-	log.Print("Attempting to connect to Redis")
+	cfg := Config{}
 
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: "colossus-redis-cluster:6379",
-	})
+	if err := loaded.Decode(&cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Loaded configuration: %s", loaded.Describe())
+
+	log.Printf("Starting up the gRPC auth server on localhost:%d", cfg.Port)
+
+	shutdownTracing, err := tracing.Setup("colossus-auth", cfg.Tracing)
+
+	if err != nil {
+		log.Fatalf("Could not set up tracing: %v", err)
+	}
 
-	_, err := redisClient.Ping().Result()
+	log.Printf("Exporting traces to %s", cfg.Tracing.Exporter)
+
+	log.Printf("Using the %s credential store", cfg.CredentialStore)
+
+	store, err := newCredentialStore(cfg)
+
+	if err != nil {
+		log.Fatalf("Could not create credential store: %v", err)
+	}
+
+	// The store being unavailable at startup isn't fatal; requests fail with Unavailable until it's back
+	if err := store.Ping(); err != nil {
+		log.Printf("Could not connect to the credential store: %v", err)
+	} else {
+		log.Print("Successfully connected to the credential store")
+	}
+
+	tokens, err := newTokenIssuer(cfg.SigningKeyFile, cfg.EphemeralSigningKey)
 
 	if err != nil {
-		log.Fatalf("Could not connect to Redis cluster: %v", err)
+		log.Fatalf("Could not load token signing key: %v", err)
+	}
+
+	log.Printf("Signing tokens with key %s", tokens.keyID)
+
+	revocations := newRevocationList(store)
+
+	if err := revocations.refresh(); err != nil {
+		log.Printf("Could not load the token revocation list: %v", err)
 	}
 
-	log.Print("Successfully connected to Redis")
+	go revocations.run()
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", PORT))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
@@ -93,34 +432,101 @@ func main() {
 
 	log.Print("Successfully created TCP listener")
 
-	server := grpc.NewServer(
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
+	apiKeyServer := apiKeyHandler{
+		store: store,
+	}
 
 	authServer := authHandler{
-		redisClient: redisClient,
+		store:       store,
+		tokens:      tokens,
+		revocations: revocations,
+		apiKeys:     &apiKeyServer,
 	}
 
+	apiKeyServer.authorize = authServer.authorize
+
+	access := newAccessControl(cfg.ServiceToken, &authServer)
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(requestIDInterceptor, otelgrpc.UnaryServerInterceptor(), grpc_prometheus.UnaryServerInterceptor, access.interceptor),
+	)
+
+	healthChecker := newHealthChecker(store, revocations.loaded)
+
+	go healthChecker.run()
+
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	mux.HandleFunc("/healthz", healthChecker.handleHealthz)
+
+	mux.HandleFunc("/readyz", healthChecker.handleReadyz)
+
+	mux.Handle("/config", loaded.Handler())
+
 	httpServer := &http.Server{
-		Handler: promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}),
-		Addr:    fmt.Sprintf("0.0.0.0:%d", PROMETHEUS_PORT),
+		Handler: mux,
+		Addr:    fmt.Sprintf("0.0.0.0:%d", cfg.PrometheusPort),
 	}
 
 	auth.RegisterAuthServiceServer(server, &authServer)
 
+	auth.RegisterApiKeyServiceServer(server, &apiKeyServer)
+
+	healthpb.RegisterHealthServer(server, healthChecker.server)
+
 	grpcMetrics.InitializeMetrics(server)
 
-	metricsRegistry.MustRegister(grpcMetrics, authCounter, failCounter)
+	metricsRegistry.MustRegister(grpcMetrics, authCounter, failCounter, redisBreakerOpen)
 
 	log.Print("Successfully registered with Prometheus")
 
 	go func() {
-		log.Print("Starting up HTTP server for Prometheus metrics collection")
+		log.Print("Starting up HTTP server for Prometheus metrics collection and health checks")
 
-		if err := httpServer.ListenAndServe(); err != nil {
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("Unable to start HTTP server for Prometheus metrics: %v", err)
 		}
 	}()
 
-	log.Fatal(server.Serve(listener))
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+	}()
+
+	sig := waitForSignal()
+
+	log.Printf("Received %s; shutting down", sig)
+
+	// Readiness probes and gRPC health checks start failing right away so that no new traffic
+	// is sent here while in-flight requests drain
+	healthChecker.shutdown()
+
+	// Requests keep coming until Kubernetes has seen the readiness probe fail, and are served as
+	// usual until then
+	log.Printf("Waiting %s for Kubernetes to stop routing requests here", cfg.ReadinessGracePeriod)
+
+	time.Sleep(cfg.ReadinessGracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+
+	defer cancel()
+
+	stopGRPCServer(ctx, server)
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Could not shut down the HTTP server cleanly: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		log.Printf("Could not close the credential store: %v", err)
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Could not export the remaining trace spans: %v", err)
+	}
+
+	log.Print("Shutdown complete")
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A handler whose memory store is seeded from a JSON credential file, the way the auth service
+// runs on a laptop
+func newTestHandler(t *testing.T) *authHandler {
+	path := writeCredentialFile(t, fmt.Sprintf(`{
+		"users": {
+			"tony": {"password_hash": %q, "roles": ["writer"]},
+			"root": {"password_hash": %q, "roles": ["admin"]},
+			"nobody": {"password_hash": %q}
+		},
+		"roles": {
+			"writer": ["read:data", "write:data"],
+			"admin": ["*:*"]
+		}
+	}`, testHash(t, "tonydanza"), testHash(t, "hunter2"), testHash(t, "nothing")))
+
+	defer os.Remove(path)
+
+	store, err := newCredentialStore(Config{CredentialStore: STORE_MEMORY, CredentialFile: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &authHandler{store: store}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     *auth.AuthResponse
+	}{
+		{"right password", "tony", "tonydanza", &auth.AuthResponse{Authenticated: true}},
+		{"wrong password", "tony", "tonydanz", &auth.AuthResponse{Reason: auth.AuthFailureReason_INVALID_CREDENTIALS}},
+		{"unknown user", "ghost", "tonydanza", &auth.AuthResponse{Reason: auth.AuthFailureReason_INVALID_CREDENTIALS}},
+		{"empty password", "tony", "", &auth.AuthResponse{Reason: auth.AuthFailureReason_INVALID_CREDENTIALS}},
+	}
+
+	h := newTestHandler(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := h.Authenticate(context.Background(), &auth.AuthRequest{Username: tt.username, Password: tt.password})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Authenticated != tt.want.Authenticated || res.Reason != tt.want.Reason {
+				t.Errorf("Authenticate() = %+v, want %+v", res, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		principal string
+		action    string
+		resource  string
+		want      bool
+	}{
+		{"tony", "read", "data", true},
+		{"tony", "write", "data", true},
+		{"tony", "read", "userinfo", false},
+		{"tony", "write", "accounts", false},
+		{"root", "write", "accounts", true},
+		{"nobody", "read", "data", false},
+		{"ghost", "read", "data", false},
+		{"", "read", "data", false},
+	}
+
+	h := newTestHandler(t)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s:%s", tt.principal, tt.action, tt.resource), func(t *testing.T) {
+			res, err := h.Authorize(context.Background(), &auth.AuthorizeRequest{Principal: tt.principal, Action: tt.action, Resource: tt.resource})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Allowed != tt.want {
+				t.Errorf("Authorize() = %t, want %t", res.Allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnlockAccount(t *testing.T) {
+	h := newTestHandler(t)
+
+	store := h.store.(*memoryStore)
+
+	if err := store.LockOut(userThrottle.key("tony"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.login(context.Background(), "tony", "tonydanza", ""); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("login() while locked out = %v, want PermissionDenied", err)
+	}
+
+	if _, err := h.UnlockAccount(context.Background(), &auth.UnlockAccountRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UnlockAccount() without a subject = %v, want InvalidArgument", err)
+	}
+
+	if _, err := h.UnlockAccount(context.Background(), &auth.UnlockAccountRequest{Username: "tony"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := h.login(context.Background(), "tony", "tonydanza", ""); !ok || err != nil {
+		t.Errorf("login() after unlocking = %t, %v, want success", ok, err)
+	}
+}
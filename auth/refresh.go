@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+
+	errRefreshTokenReused = errors.New("refresh token has already been used")
+)
+
+type refreshToken struct {
+	username string
+	family   string
+}
+
+// Refresh tokens are stored by their SHA-256 hash so that the tokens themselves are never
+// persisted
+func refreshTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// Creates and stores a new refresh token for the given user within the given token family
+func (h *authHandler) newRefreshToken(ctx context.Context, username, family string) (string, time.Time, error) {
+	raw := make([]byte, 32)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token := hex.EncodeToString(raw)
+	expiresAt := time.Now().Add(REFRESH_TOKEN_TTL)
+
+	err := storeFor(ctx, h.store).CreateRefreshToken(refreshTokenHash(token), &refreshToken{
+		username: username,
+		family:   family,
+	}, REFRESH_TOKEN_TTL)
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// Consumes a refresh token so that it can be exchanged for a new one. Refresh tokens can only
+// be used once; presenting one a second time means that it has leaked, so its whole family is
+// revoked.
+func (h *authHandler) useRefreshToken(ctx context.Context, token string) (*refreshToken, error) {
+	hash := refreshTokenHash(token)
+
+	rt, err := storeFor(ctx, h.store).RefreshToken(hash)
+
+	if err == errNotFound {
+		return nil, errRefreshTokenInvalid
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := h.revocations.isRevoked(rt.family)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, errRefreshTokenInvalid
+	}
+
+	uses, err := storeFor(ctx, h.store).UseRefreshToken(hash)
+
+	if err == errNotFound {
+		return nil, errRefreshTokenInvalid
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uses > 1 {
+		if err := h.revokeFamily(ctx, rt.family); err != nil {
+			return nil, err
+		}
+
+		return nil, errRefreshTokenReused
+	}
+
+	return rt, nil
+}
+
+// Revokes every refresh and access token issued within the given family. Nothing in the family
+// can outlive a refresh token issued right now, so that's how long the revocation is kept.
+func (h *authHandler) revokeFamily(ctx context.Context, family string) error {
+	return h.revocations.revoke(ctx, family, time.Now().Add(REFRESH_TOKEN_TTL))
+}
+
+// Looks up the family of a refresh token without consuming it
+func (h *authHandler) refreshTokenFamily(ctx context.Context, token string) (string, error) {
+	rt, err := storeFor(ctx, h.store).RefreshToken(refreshTokenHash(token))
+
+	if err == errNotFound {
+		return "", errRefreshTokenInvalid
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return rt.family, nil
+}
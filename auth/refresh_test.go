@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A handler that can issue tokens, signing them with a throwaway key
+func newTokenHandler(t *testing.T) (*authHandler, *memoryStore) {
+	tokens, err := newTokenIssuer("/nonexistent/signing-key.pem", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemoryStore()
+
+	revocations := newRevocationList(store)
+
+	if err := revocations.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &authHandler{
+		store:       store,
+		revocations: revocations,
+		tokens:      tokens,
+	}, store
+}
+
+// Starts a new token family, as logging in does
+func loginTokens(t *testing.T, h *authHandler) *auth.TokenResponse {
+	family, err := newTokenID()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.issueTokens(context.Background(), "tony", family)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func isValid(t *testing.T, h *authHandler, token string) bool {
+	res, err := h.ValidateToken(context.Background(), &auth.ValidateTokenRequest{Token: token})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Valid
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// The refresh tokens to present, in order. 0 is the one issued at login, and every
+		// successful refresh adds the next one.
+		present []int
+
+		want []codes.Code
+
+		// Whether the family ends up revoked, taking every access token issued in it along
+		wantRevoked bool
+	}{
+		{"rotation", []int{0, 1, 2}, []codes.Code{codes.OK, codes.OK, codes.OK}, false},
+		{"reusing the latest token", []int{0, 0}, []codes.Code{codes.OK, codes.Unauthenticated}, true},
+		{"reuse revokes the successor", []int{0, 0, 1}, []codes.Code{codes.OK, codes.Unauthenticated, codes.Unauthenticated}, true},
+		{"reusing an older token", []int{0, 1, 0, 2}, []codes.Code{codes.OK, codes.OK, codes.Unauthenticated, codes.Unauthenticated}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTokenHandler(t)
+
+			login := loginTokens(t, h)
+
+			refreshTokens := []string{login.RefreshToken}
+			accessTokens := []string{login.Token}
+
+			for i, n := range tt.present {
+				res, err := h.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshToken: refreshTokens[n]})
+
+				if status.Code(err) != tt.want[i] {
+					t.Fatalf("refresh %d with token %d: %v, want %s", i, n, err, tt.want[i])
+				}
+
+				if err == nil {
+					refreshTokens = append(refreshTokens, res.RefreshToken)
+					accessTokens = append(accessTokens, res.Token)
+				}
+			}
+
+			for i, token := range accessTokens {
+				if got := isValid(t, h, token); got == tt.wantRevoked {
+					t.Errorf("access token %d valid = %t, want %t", i, got, !tt.wantRevoked)
+				}
+			}
+		})
+	}
+}
+
+// A store whose refresh tokens expire right after they're looked up, before they can be used
+type expiresOnLookup struct {
+	*memoryStore
+}
+
+func (s *expiresOnLookup) RefreshToken(hash string) (*refreshToken, error) {
+	rt, err := s.memoryStore.RefreshToken(hash)
+
+	if err == nil {
+		s.refreshTokens[hash].expiresAt = time.Now().Add(-time.Second)
+	}
+
+	return rt, err
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token func(t *testing.T, h *authHandler, store *memoryStore) string
+
+		// Whether the token is no longer stored at all
+		gone bool
+	}{
+		{"unknown", func(t *testing.T, h *authHandler, store *memoryStore) string {
+			return "0123456789abcdef"
+		}, true},
+		{"expired", func(t *testing.T, h *authHandler, store *memoryStore) string {
+			token := loginTokens(t, h).RefreshToken
+
+			store.refreshTokens[refreshTokenHash(token)].expiresAt = time.Now().Add(-time.Second)
+
+			return token
+		}, true},
+		{"expires while being used", func(t *testing.T, h *authHandler, store *memoryStore) string {
+			token := loginTokens(t, h).RefreshToken
+
+			h.store = &expiresOnLookup{store}
+
+			return token
+		}, true},
+		{"revoked", func(t *testing.T, h *authHandler, store *memoryStore) string {
+			token := loginTokens(t, h).RefreshToken
+
+			if _, err := h.RevokeToken(context.Background(), &auth.RevokeTokenRequest{Token: token}); err != nil {
+				t.Fatal(err)
+			}
+
+			return token
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTokenHandler(t)
+
+			token := tt.token(t, h, store)
+
+			_, err := h.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshToken: token})
+
+			if status.Code(err) != codes.Unauthenticated {
+				t.Errorf("RefreshToken() = %v, want Unauthenticated", err)
+			}
+
+			// Using a token that's gone mustn't bring it back
+			if _, err := store.UseRefreshToken(refreshTokenHash(token)); tt.gone && err != errNotFound {
+				t.Errorf("UseRefreshToken() afterwards = %v, want errNotFound", err)
+			}
+		})
+	}
+}
+
+// Of several refreshes racing with the same token, only one may win, and the rest give the
+// reuse away
+func TestRefreshTokenConcurrentReuse(t *testing.T) {
+	const attempts = 10
+
+	h, _ := newTokenHandler(t)
+
+	token := loginTokens(t, h).RefreshToken
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded []string
+	)
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			res, err := h.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshToken: token})
+
+			if err != nil {
+				if status.Code(err) != codes.Unauthenticated {
+					t.Errorf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			mu.Lock()
+			succeeded = append(succeeded, res.Token)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if len(succeeded) != 1 {
+		t.Fatalf("%d refreshes succeeded, want exactly 1", len(succeeded))
+	}
+
+	if isValid(t, h, succeeded[0]) {
+		t.Error("the winning refresh's access token is still valid after the reuse")
+	}
+}
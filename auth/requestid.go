@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// The metadata key that the web service forwards request IDs in
+const REQUEST_ID_METADATA = "x-request-id"
+
+// The same request IDs that the web service accepts, since anyone who can reach the auth service
+// could otherwise forge log lines with one
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// Puts the ID of the web request that a call was made for, if there is one, in the call's
+// context, so that the auth service's log lines can be matched up with the web service's. IDs
+// that aren't valid are dropped.
+func requestIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md[REQUEST_ID_METADATA]; len(ids) > 0 && validRequestID.MatchString(ids[0]) {
+			ctx = context.WithValue(ctx, requestIDKey{}, ids[0])
+		}
+	}
+
+	return handler(ctx, req)
+}
+
+// Logs like log.Printf, prefixed with the ID of the request that the context belongs to
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		log.Printf("[%s] %s", id, fmt.Sprintf(format, args...))
+		return
+	}
+
+	log.Printf(format, args...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestIDInterceptor(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{"no ID", nil, ""},
+		{"empty", []string{""}, ""},
+		{"valid", []string{"4f3c2a1b-9d8e"}, "4f3c2a1b-9d8e"},
+		{"longest allowed", []string{strings.Repeat("a", 128)}, strings.Repeat("a", 128)},
+		{"too long", []string{strings.Repeat("a", 129)}, ""},
+		{"forged log line", []string{"abc\n2018/05/01 00:00:00 Unlocked user \"root\""}, ""},
+		{"spaces", []string{"abc def"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+
+			if tt.ids != nil {
+				md[REQUEST_ID_METADATA] = tt.ids
+			}
+
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+
+			var got string
+
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				got, _ = ctx.Value(requestIDKey{}).(string)
+				return nil, nil
+			}
+
+			requestIDInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+
+			if got != tt.want {
+				t.Errorf("request ID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
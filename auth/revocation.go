@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const REVOCATION_REFRESH_INTERVAL = 10 * time.Second
+
+// Returned until the revocation list has been loaded from the store, since until then there's no
+// telling whether a token has been revoked
+var errRevocationsNotLoaded = errors.New("the token revocation list hasn't been loaded yet")
+
+// The revocation list lives in the credential store and is cached locally, so validating a
+// token never requires a round trip to the store. Revocations made by other replicas are
+// picked up within REVOCATION_REFRESH_INTERVAL. Until the list has been loaded for the first
+// time, no token counts as valid.
+type revocationList struct {
+	store CredentialStore
+
+	// Nil until the list has been loaded
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+}
+
+func newRevocationList(store CredentialStore) *revocationList {
+	return &revocationList{
+		store: store,
+	}
+}
+
+// Revokes the token or token family with the given ID until the given time
+func (l *revocationList) revoke(ctx context.Context, id string, until time.Time) error {
+	if err := storeFor(ctx, l.store).Revoke(id, until); err != nil {
+		return err
+	}
+
+	// Before the list has been loaded, the revocation is picked up along with the rest of it
+	l.mu.Lock()
+
+	if l.revoked != nil {
+		l.revoked[id] = struct{}{}
+	}
+
+	l.mu.Unlock()
+
+	return nil
+}
+
+func (l *revocationList) loaded() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.revoked != nil
+}
+
+func (l *revocationList) isRevoked(ids ...string) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.revoked == nil {
+		return true, errRevocationsNotLoaded
+	}
+
+	for _, id := range ids {
+		if _, ok := l.revoked[id]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (l *revocationList) ids() ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.revoked == nil {
+		return nil, errRevocationsNotLoaded
+	}
+
+	ids := make([]string, 0, len(l.revoked))
+
+	for id := range l.revoked {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Drops expired entries from the store and replaces the local cache with what remains
+func (l *revocationList) refresh() error {
+	ids, err := l.store.RevokedIDs()
+
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]struct{}, len(ids))
+
+	for _, id := range ids {
+		revoked[id] = struct{}{}
+	}
+
+	l.mu.Lock()
+	l.revoked = revoked
+	l.mu.Unlock()
+
+	return nil
+}
+
+func (l *revocationList) run() {
+	for range time.Tick(REVOCATION_REFRESH_INTERVAL) {
+		if err := l.refresh(); err != nil {
+			log.Printf("Could not refresh the token revocation list: %v", err)
+		}
+	}
+}
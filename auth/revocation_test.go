@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A store whose revocation list can't be read until err is cleared
+type revocationsUnreadable struct {
+	*memoryStore
+
+	err error
+}
+
+func (s *revocationsUnreadable) RevokedIDs() ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.memoryStore.RevokedIDs()
+}
+
+// Until the revocation list has been loaded there's no telling whether a token has been revoked,
+// so none are accepted and the service doesn't report itself as serving
+func TestRevocationListFailsClosedUntilLoaded(t *testing.T) {
+	h, memory := newTokenHandler(t)
+
+	tokens := loginTokens(t, h)
+
+	store := &revocationsUnreadable{memoryStore: memory, err: errors.New("redis is down")}
+
+	h.store = store
+	h.revocations = newRevocationList(store)
+
+	health := newHealthChecker(store, h.revocations.loaded)
+
+	ctx := context.Background()
+
+	if err := h.revocations.refresh(); err == nil {
+		t.Fatal("refresh() succeeded while the store is down")
+	}
+
+	if _, err := h.ValidateToken(ctx, &auth.ValidateTokenRequest{Token: tokens.Token}); status.Code(err) != codes.Unavailable {
+		t.Errorf("ValidateToken() before the list is loaded = %v, want Unavailable", err)
+	}
+
+	if _, err := h.RefreshToken(ctx, &auth.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}); status.Code(err) != codes.Unavailable {
+		t.Errorf("RefreshToken() before the list is loaded = %v, want Unavailable", err)
+	}
+
+	// An empty list would look like nothing has been revoked to the web service
+	if _, err := h.RevokedTokens(ctx, &auth.RevokedTokensRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("RevokedTokens() before the list is loaded = %v, want Unavailable", err)
+	}
+
+	health.check()
+
+	if health.serving {
+		t.Error("serving before the list is loaded")
+	}
+
+	// Revoking still works, and takes effect once the list is loaded
+	if _, err := h.RevokeToken(ctx, &auth.RevokeTokenRequest{Token: tokens.Token}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.err = nil
+
+	if err := h.revocations.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	health.check()
+
+	if !health.serving {
+		t.Error("not serving once the list is loaded")
+	}
+
+	if isValid(t, h, tokens.Token) {
+		t.Error("a token revoked before the list was loaded is still valid")
+	}
+
+	res, err := h.RevokedTokens(ctx, &auth.RevokedTokensRequest{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Ids) != 1 {
+		t.Errorf("RevokedTokens() = %v, want the one revoked token", res.Ids)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+// Each permission has the form "<action>:<resource>", where either half can be "*"
+const WILDCARD = "*"
+
+func permission(action, resource string) string {
+	return action + ":" + resource
+}
+
+// Reports whether any of the principal's roles grants the action on the resource
+func (h *authHandler) authorize(ctx context.Context, principal, action, resource string) (bool, error) {
+	if principal == "" {
+		return false, nil
+	}
+
+	permissions, err := storeFor(ctx, h.store).Permissions(principal)
+
+	if err != nil {
+		return false, err
+	}
+
+	granting := map[string]bool{
+		permission(action, resource):   true,
+		permission(WILDCARD, resource): true,
+		permission(action, WILDCARD):   true,
+		permission(WILDCARD, WILDCARD): true,
+	}
+
+	for _, p := range permissions {
+		if granting[p] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
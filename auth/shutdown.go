@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+)
+
+// Blocks until the process is asked to stop, which Kubernetes does with SIGTERM
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	return <-signals
+}
+
+// Stops accepting new RPCs and waits for in-flight ones to finish. RPCs still running once ctx
+// is done are cut off.
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		log.Print("All in-flight RPCs have finished")
+	case <-ctx.Done():
+		log.Print("Drain deadline exceeded; closing the remaining gRPC connections")
+		server.Stop()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+// Values for the CREDENTIAL_STORE setting
+const (
+	STORE_REDIS = "redis"
+
+	STORE_MEMORY = "memory"
+
+	STORE_HTPASSWD = "htpasswd"
+
+	STORE_JSON = "json"
+)
+
+var (
+	errNotFound = errors.New("not found")
+
+	errExists = errors.New("already exists")
+)
+
+// Everything that the auth service persists: user credentials and roles, API keys, and the
+// short-lived state behind throttling, refresh tokens, and revocation. Lookups of records
+// that don't exist return errNotFound; any other error means the store itself has failed.
+type CredentialStore interface {
+	Ping() error
+	Close() error
+
+	// Users and roles
+	PasswordHash(username string) (string, error)
+	SetPasswordHash(username, hash string) error
+	Permissions(username string) ([]string, error)
+
+	// Failed login tracking. Subjects have the form "<kind>:<subject>", e.g. "user:tony".
+	// BeginAttempt checks the subject against the rule and, if it may make another attempt,
+	// counts a failure that's forgotten after window, all in one atomic step.
+	BeginAttempt(subject string, rule throttleRule, window time.Duration) (throttleDecision, error)
+	ForgiveFailure(subject string) error
+	LockOut(subject string, duration time.Duration) error
+	ResetThrottle(subject string) error
+
+	// Refresh tokens, keyed by a hash of the token. UseRefreshToken counts a use and returns how
+	// many there have been, in one atomic step that fails with errNotFound once the token has
+	// expired.
+	CreateRefreshToken(hash string, rt *refreshToken, ttl time.Duration) error
+	RefreshToken(hash string) (*refreshToken, error)
+	UseRefreshToken(hash string) (int64, error)
+
+	// Revoked token and token family IDs
+	Revoke(id string, until time.Time) error
+	RevokedIDs() ([]string, error)
+
+	// API keys, keyed by prefix. CreateApiKey returns errExists rather than replace a key with
+	// the same prefix, and changes to a key that's been deleted return errNotFound rather than
+	// bring it back.
+	CreateApiKey(apiKey *auth.ApiKey, secretHash string) error
+	ApiKey(prefix string) (*auth.ApiKey, string, error)
+	ApiKeys() ([]*auth.ApiKey, error)
+	SetApiKeySecret(prefix, secretHash string) error
+	SetApiKeyRoutes(prefix string, routes []string) error
+	TouchApiKey(prefix string, at time.Time) error
+	DeleteApiKey(prefix string) error
+}
+
+// Stores that can trace their calls as children of the request that they're made for
+type tracedStore interface {
+	withContext(ctx context.Context) CredentialStore
+}
+
+// The store to use while handling a request. Stores that support it trace their calls under
+// the request's span.
+func storeFor(ctx context.Context, store CredentialStore) CredentialStore {
+	if traced, ok := store.(tracedStore); ok {
+		return traced.withContext(ctx)
+	}
+
+	return store
+}
+
+// Creates the credential store selected by the configuration
+func newCredentialStore(cfg Config) (CredentialStore, error) {
+	switch cfg.CredentialStore {
+	case STORE_REDIS:
+		return newRedisStore(cfg), nil
+	case STORE_MEMORY:
+		if cfg.CredentialFile == "" {
+			return newMemoryStore(), nil
+		}
+
+		return loadJSONStore(cfg.CredentialFile)
+	case STORE_HTPASSWD:
+		return loadHtpasswdStore(cfg.CredentialFile, cfg.HtpasswdPermissions)
+	case STORE_JSON:
+		return loadJSONStore(cfg.CredentialFile)
+	default:
+		return nil, fmt.Errorf("unknown credential store %q", cfg.CredentialStore)
+	}
+}
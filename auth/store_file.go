@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd files carry no roles, so every user they list is granted this role, whose
+// permissions are configured instead
+const HTPASSWD_ROLE = "htpasswd"
+
+// The layout of a JSON credential file:
+//
+//	{
+//	  "users": {"tony": {"password_hash": "$2y$12$...", "roles": ["writer"]}},
+//	  "roles": {"writer": ["read:*", "write:data"]}
+//	}
+type credentialFile struct {
+	Users map[string]struct {
+		PasswordHash string   `json:"password_hash"`
+		Roles        []string `json:"roles"`
+	} `json:"users"`
+	Roles map[string][]string `json:"roles"`
+}
+
+// Loads users from an htpasswd file with bcrypt hashes, as written by `htpasswd -B`. Files with
+// any other kind of hash are refused rather than failing every login. The file is only read at
+// startup; everything else, including rehashed passwords, is kept in memory. Every user gets
+// the given permissions.
+func loadHtpasswdStore(path string, permissions []string) (*memoryStore, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	store := newMemoryStore()
+
+	store.addRole(HTPASSWD_ROLE, permissions)
+
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected <username>:<bcrypt hash>", path, line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: the password hash for %s isn't a bcrypt hash: %v", path, line, parts[0], err)
+		}
+
+		store.addUser(parts[0], parts[1], []string{HTPASSWD_ROLE})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Loads users and roles from a JSON credential file, for the json store and for seeding the
+// memory store. Every user needs a bcrypt password hash. As with htpasswd files, the file is only read at startup and changes are kept in
+// memory.
+func loadJSONStore(path string) (*memoryStore, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var file credentialFile
+
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	store := newMemoryStore()
+
+	for role, permissions := range file.Roles {
+		store.addRole(role, permissions)
+	}
+
+	for username, user := range file.Users {
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("%s: the password hash for %s isn't a bcrypt hash: %v", path, username, err)
+		}
+
+		store.addUser(username, user.PasswordHash, user.Roles)
+	}
+
+	return store, nil
+}
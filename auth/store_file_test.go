@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes a credential file for a test, which should remove it once it's done
+func writeCredentialFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "colossus-credentials")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func testHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+func TestLoadHtpasswdStore(t *testing.T) {
+	hash := testHash(t, "tonydanza")
+
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+		wantHash string
+
+		// A user that the error has to name
+		errUser string
+	}{
+		{"one user", "tony:" + hash + "\n", false, hash, ""},
+		{"comments and blank lines", "# users\n\ntony:" + hash + "\n", false, hash, ""},
+		{"no hash", "tony:\n", true, "", ""},
+		{"no separator", "tony\n", true, "", ""},
+		{"MD5 hash", "tony:" + hash + "\nalice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n", true, "", "alice"},
+		{"SHA-1 hash", "alice:{SHA}9vkqXzu8F0iZS4uyMK3P4U0rUwk=\n", true, "", "alice"},
+	}
+
+	permissions := []string{"read:data", "read:userinfo"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeCredentialFile(t, tt.contents)
+
+			defer os.Remove(path)
+
+			store, err := loadHtpasswdStore(path, permissions)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loaded a malformed file")
+				}
+
+				if !strings.Contains(err.Error(), tt.errUser) {
+					t.Errorf("error %q doesn't name %s", err, tt.errUser)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := store.PasswordHash("tony"); got != tt.wantHash {
+				t.Errorf("hash = %q, want %q", got, tt.wantHash)
+			}
+
+			// Users get the configured permissions rather than every permission
+			if got, _ := store.Permissions("tony"); !reflect.DeepEqual(got, permissions) {
+				t.Errorf("permissions = %v, want %v", got, permissions)
+			}
+		})
+	}
+}
+
+func TestLoadJSONStore(t *testing.T) {
+	hash := testHash(t, "tonydanza")
+
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+		errUser  string
+		want     map[string][]string
+	}{
+		{
+			name: "users and roles",
+			contents: `{
+				"users": {
+					"tony": {"password_hash": "` + hash + `", "roles": ["writer", "auditor"]},
+					"alice": {"password_hash": "` + hash + `", "roles": ["reader"]}
+				},
+				"roles": {
+					"reader": ["read:data"],
+					"writer": ["read:data", "write:data"],
+					"auditor": ["read:apikeys"]
+				}
+			}`,
+			want: map[string][]string{
+				"tony":  {"read:apikeys", "read:data", "write:data"},
+				"alice": {"read:data"},
+			},
+		},
+		{
+			name:     "undefined role",
+			contents: `{"users": {"tony": {"password_hash": "` + hash + `", "roles": ["ghost"]}}}`,
+			want:     map[string][]string{"tony": nil},
+		},
+		{
+			name:     "not a bcrypt hash",
+			contents: `{"users": {"tony": {"password_hash": "` + hash + `"}, "alice": {"password_hash": "tonydanza"}}}`,
+			wantErr:  true,
+			errUser:  "alice",
+		},
+		{
+			name:     "no hash",
+			contents: `{"users": {"tony": {"roles": ["writer"]}}}`,
+			wantErr:  true,
+			errUser:  "tony",
+		},
+		{
+			name:     "not JSON",
+			contents: "tony:x",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeCredentialFile(t, tt.contents)
+
+			defer os.Remove(path)
+
+			store, err := loadJSONStore(path)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loaded a malformed file")
+				}
+
+				if !strings.Contains(err.Error(), tt.errUser) {
+					t.Errorf("error %q doesn't name %s", err, tt.errUser)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for username, want := range tt.want {
+				got, err := store.Permissions(username)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				sort.Strings(got)
+
+				if len(got) == 0 && len(want) == 0 {
+					continue
+				}
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("permissions of %s = %v, want %v", username, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSeeding(t *testing.T) {
+	hash := testHash(t, "tonydanza")
+
+	path := writeCredentialFile(t, `{"users": {"tony": {"password_hash": "`+hash+`"}}}`)
+
+	defer os.Remove(path)
+
+	tests := []struct {
+		name     string
+		file     string
+		wantHash string
+	}{
+		{"empty without a file", "", ""},
+		{"seeded from the file", path, hash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newCredentialStore(Config{CredentialStore: STORE_MEMORY, CredentialFile: tt.file})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := store.PasswordHash("tony"); got != tt.wantHash {
+				t.Errorf("hash = %q, want %q", got, tt.wantHash)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+// How often BeginAttempt drops the failures and lockouts that have expired. Subjects include
+// client IPs and whatever usernames are tried, so without this they'd pile up forever.
+const MEMORY_STORE_SWEEP_INTERVAL = time.Minute
+
+type memoryFailures struct {
+	count     int64
+	last      time.Time
+	expiresAt time.Time
+}
+
+type memoryRefreshToken struct {
+	token     refreshToken
+	uses      int64
+	expiresAt time.Time
+}
+
+type memoryApiKey struct {
+	apiKey     *auth.ApiKey
+	secretHash string
+}
+
+// Keeps everything in process memory, which is handy on a laptop and in tests. Nothing is
+// shared between replicas and nothing survives a restart.
+type memoryStore struct {
+	mu             sync.Mutex
+	passwordHashes map[string]string
+	userRoles      map[string][]string
+	roles          map[string][]string
+	failures       map[string]*memoryFailures
+	lockouts       map[string]time.Time
+	refreshTokens  map[string]*memoryRefreshToken
+	revoked        map[string]time.Time
+	apiKeys        map[string]*memoryApiKey
+
+	// When expired failures and lockouts were last dropped
+	sweptAt time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		passwordHashes: map[string]string{},
+		userRoles:      map[string][]string{},
+		roles:          map[string][]string{},
+		failures:       map[string]*memoryFailures{},
+		lockouts:       map[string]time.Time{},
+		refreshTokens:  map[string]*memoryRefreshToken{},
+		revoked:        map[string]time.Time{},
+		apiKeys:        map[string]*memoryApiKey{},
+	}
+}
+
+// Adds a user along with the roles granted to them
+func (s *memoryStore) addUser(username, passwordHash string, roles []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.passwordHashes[username] = passwordHash
+	s.userRoles[username] = roles
+}
+
+// Defines a role as a set of "<action>:<resource>" permissions
+func (s *memoryStore) addRole(role string, permissions []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roles[role] = permissions
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) PasswordHash(username string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash, ok := s.passwordHashes[username]
+
+	if !ok {
+		return "", errNotFound
+	}
+
+	return hash, nil
+}
+
+func (s *memoryStore) SetPasswordHash(username, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.passwordHashes[username] = hash
+
+	return nil
+}
+
+func (s *memoryStore) Permissions(username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var permissions []string
+
+	for _, role := range s.userRoles[username] {
+		permissions = append(permissions, s.roles[role]...)
+	}
+
+	return permissions, nil
+}
+
+func (s *memoryStore) BeginAttempt(subject string, rule throttleRule, window time.Duration) (throttleDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.sweepThrottles(now)
+
+	if until, ok := s.lockouts[subject]; ok {
+		if now.Before(until) {
+			return throttleDecision{lockedFor: until.Sub(now)}, nil
+		}
+
+		delete(s.lockouts, subject)
+	}
+
+	f, ok := s.failures[subject]
+
+	if !ok || !now.Before(f.expiresAt) {
+		f = &memoryFailures{}
+	}
+
+	decision := rule.decide(f.count, f.last, now)
+
+	if decision.backoffFor > 0 {
+		return decision, nil
+	}
+
+	f.count = decision.failures
+	f.last = now
+	f.expiresAt = now.Add(window)
+	s.failures[subject] = f
+
+	return decision, nil
+}
+
+// Drops the failures and lockouts that have expired, at most once per sweep interval. Must be
+// called with s.mu held.
+func (s *memoryStore) sweepThrottles(now time.Time) {
+	if now.Sub(s.sweptAt) < MEMORY_STORE_SWEEP_INTERVAL {
+		return
+	}
+
+	for subject, f := range s.failures {
+		if !now.Before(f.expiresAt) {
+			delete(s.failures, subject)
+		}
+	}
+
+	for subject, until := range s.lockouts {
+		if !now.Before(until) {
+			delete(s.lockouts, subject)
+		}
+	}
+
+	s.sweptAt = now
+}
+
+func (s *memoryStore) ForgiveFailure(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.failures[subject]; ok && f.count > 0 {
+		f.count--
+	}
+
+	return nil
+}
+
+func (s *memoryStore) LockOut(subject string, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lockouts[subject] = time.Now().Add(duration)
+	delete(s.failures, subject)
+
+	return nil
+}
+
+func (s *memoryStore) ResetThrottle(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, subject)
+	delete(s.lockouts, subject)
+
+	return nil
+}
+
+func (s *memoryStore) CreateRefreshToken(hash string, rt *refreshToken, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refreshTokens[hash] = &memoryRefreshToken{
+		token:     *rt,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+// Looks up a refresh token, dropping it if it has expired. Must be called with s.mu held.
+func (s *memoryStore) liveRefreshToken(hash string) (*memoryRefreshToken, bool) {
+	rt, ok := s.refreshTokens[hash]
+
+	if !ok {
+		return nil, false
+	}
+
+	if !time.Now().Before(rt.expiresAt) {
+		delete(s.refreshTokens, hash)
+		return nil, false
+	}
+
+	return rt, true
+}
+
+func (s *memoryStore) RefreshToken(hash string) (*refreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.liveRefreshToken(hash)
+
+	if !ok {
+		return nil, errNotFound
+	}
+
+	token := rt.token
+
+	return &token, nil
+}
+
+func (s *memoryStore) UseRefreshToken(hash string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.liveRefreshToken(hash)
+
+	if !ok {
+		return 0, errNotFound
+	}
+
+	rt.uses++
+
+	return rt.uses, nil
+}
+
+func (s *memoryStore) Revoke(id string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.revoked[id]; !ok || until.After(current) {
+		s.revoked[id] = until
+	}
+
+	return nil
+}
+
+func (s *memoryStore) RevokedIDs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	ids := make([]string, 0, len(s.revoked))
+
+	for id, until := range s.revoked {
+		if until.Before(now) {
+			delete(s.revoked, id)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Stored keys are copied on the way in and out so that callers can't modify them in place
+func copyApiKey(apiKey *auth.ApiKey) *auth.ApiKey {
+	return &auth.ApiKey{
+		Prefix:     apiKey.Prefix,
+		Name:       apiKey.Name,
+		Owner:      apiKey.Owner,
+		Routes:     append([]string(nil), apiKey.Routes...),
+		CreatedAt:  apiKey.CreatedAt,
+		ExpiresAt:  apiKey.ExpiresAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+}
+
+func (s *memoryStore) CreateApiKey(apiKey *auth.ApiKey, secretHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apiKeys[apiKey.Prefix]; ok {
+		return errExists
+	}
+
+	s.apiKeys[apiKey.Prefix] = &memoryApiKey{
+		apiKey:     copyApiKey(apiKey),
+		secretHash: secretHash,
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ApiKey(prefix string) (*auth.ApiKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[prefix]
+
+	if !ok {
+		return nil, "", errNotFound
+	}
+
+	return copyApiKey(k.apiKey), k.secretHash, nil
+}
+
+func (s *memoryStore) ApiKeys() ([]*auth.ApiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apiKeys := make([]*auth.ApiKey, 0, len(s.apiKeys))
+
+	for _, k := range s.apiKeys {
+		apiKeys = append(apiKeys, copyApiKey(k.apiKey))
+	}
+
+	return apiKeys, nil
+}
+
+func (s *memoryStore) SetApiKeySecret(prefix, secretHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[prefix]
+
+	if !ok {
+		return errNotFound
+	}
+
+	k.secretHash = secretHash
+
+	return nil
+}
+
+func (s *memoryStore) SetApiKeyRoutes(prefix string, routes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[prefix]
+
+	if !ok {
+		return errNotFound
+	}
+
+	k.apiKey.Routes = append([]string(nil), routes...)
+
+	return nil
+}
+
+func (s *memoryStore) TouchApiKey(prefix string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[prefix]
+
+	if !ok {
+		return errNotFound
+	}
+
+	k.apiKey.LastUsedAt = at.Unix()
+
+	return nil
+}
+
+func (s *memoryStore) DeleteApiKey(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.apiKeys, prefix)
+
+	return nil
+}
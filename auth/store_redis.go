@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+const (
+	REDIS_DIAL_TIMEOUT = 5 * time.Second
+
+	// Each user is stored as a hash under the key "user:<username>"
+	USER_KEY_PREFIX = "user:"
+
+	PASSWORD_HASH_FIELD = "password_hash"
+
+	// The roles granted to each user are stored as a set under "user_roles:<username>"
+	USER_ROLES_KEY_PREFIX = "user_roles:"
+
+	// The permissions that make up each role are stored as a set under "role:<role>"
+	ROLE_KEY_PREFIX = "role:"
+
+	// Failed attempts are counted in hashes under "auth_failures:<kind>:<subject>" and lockouts
+	// are stored as expiring keys under "auth_lockout:<kind>:<subject>"
+	FAILURES_KEY_PREFIX = "auth_failures:"
+
+	LOCKOUT_KEY_PREFIX = "auth_lockout:"
+
+	// Each refresh token is stored under "refresh_token:<sha256 of token>" so that the tokens
+	// themselves never touch Redis
+	REFRESH_TOKEN_KEY_PREFIX = "refresh_token:"
+
+	// A sorted set of revoked token and token family IDs, each scored by the Unix time after
+	// which it no longer needs to be remembered
+	REVOKED_TOKENS_KEY = "revoked_tokens"
+
+	// Each API key is stored as a hash under "api_key:<prefix>" and every prefix is listed in
+	// the "api_keys" set
+	API_KEY_KEY_PREFIX = "api_key:"
+
+	API_KEYS_INDEX_KEY = "api_keys"
+)
+
+// The production credential store. Every call goes through a circuit breaker so that an
+// unreachable Redis fails fast.
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(cfg Config) *redisStore {
+	breaker := newCircuitBreaker(cfg.Redis.BreakerFailureThreshold, cfg.Redis.BreakerOpenTimeout)
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Address,
+		Password: cfg.Redis.Password,
+		Dialer:   breaker.dialer("tcp", cfg.Redis.Address, REDIS_DIAL_TIMEOUT),
+	})
+
+	breaker.observe(client)
+
+	return &redisStore{client: client}
+}
+
+// A copy of the store whose Redis commands are each recorded as a child span of the context's
+// span. Only the commands' names are recorded, since their arguments include password hashes.
+func (s *redisStore) withContext(ctx context.Context) CredentialStore {
+	client := s.client.WithContext(ctx)
+
+	client.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			span := startRedisSpan(ctx, cmd.Name())
+
+			err := process(cmd)
+
+			endRedisSpan(span, err)
+
+			return err
+		}
+	})
+
+	client.WrapProcessPipeline(func(process func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			names := make([]string, len(cmds))
+
+			for i, cmd := range cmds {
+				names[i] = cmd.Name()
+			}
+
+			span := startRedisSpan(ctx, strings.Join(names, " "))
+
+			span.SetAttributes(attribute.Int("db.redis.pipeline_length", len(cmds)))
+
+			err := process(cmds)
+
+			endRedisSpan(span, err)
+
+			return err
+		}
+	})
+
+	return &redisStore{client: client}
+}
+
+func startRedisSpan(ctx context.Context, operation string) trace.Span {
+	_, span := otel.Tracer(TRACER_NAME).Start(ctx, "redis "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", operation),
+		),
+	)
+
+	return span
+}
+
+// Ends the span for a command. Missing keys aren't failures, just empty results.
+func endRedisSpan(span trace.Span, err error) {
+	if err != nil && err != redis.Nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func userKey(username string) string {
+	return USER_KEY_PREFIX + username
+}
+
+func userRolesKey(username string) string {
+	return USER_ROLES_KEY_PREFIX + username
+}
+
+func roleKey(role string) string {
+	return ROLE_KEY_PREFIX + role
+}
+
+func failuresKey(subject string) string {
+	return FAILURES_KEY_PREFIX + subject
+}
+
+func lockoutKey(subject string) string {
+	return LOCKOUT_KEY_PREFIX + subject
+}
+
+func refreshTokenKey(hash string) string {
+	return REFRESH_TOKEN_KEY_PREFIX + hash
+}
+
+func apiKeyKey(prefix string) string {
+	return API_KEY_KEY_PREFIX + prefix
+}
+
+func (s *redisStore) Ping() error {
+	return s.client.Ping().Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) PasswordHash(username string) (string, error) {
+	hash, err := s.client.HGet(userKey(username), PASSWORD_HASH_FIELD).Result()
+
+	if err == redis.Nil {
+		return "", errNotFound
+	}
+
+	return hash, err
+}
+
+func (s *redisStore) SetPasswordHash(username, hash string) error {
+	return s.client.HSet(userKey(username), PASSWORD_HASH_FIELD, hash).Err()
+}
+
+func (s *redisStore) Permissions(username string) ([]string, error) {
+	roles, err := s.client.SMembers(userRolesKey(username)).Result()
+
+	if err != nil || len(roles) == 0 {
+		return nil, err
+	}
+
+	cmds := make([]*redis.StringSliceCmd, len(roles))
+
+	_, err = s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, role := range roles {
+			cmds[i] = pipe.SMembers(roleKey(role))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+
+	for _, cmd := range cmds {
+		permissions = append(permissions, cmd.Val()...)
+	}
+
+	return permissions, nil
+}
+
+// Checks for a lockout and for backoff and counts a new failure in a single step. Times are in
+// milliseconds, and the backoff is worked out the same way as throttleRule.backoff.
+var beginAttemptScript = redis.NewScript(`
+local locked_for = redis.call("PTTL", KEYS[2])
+
+if locked_for > 0 then
+	return {0, locked_for, 0}
+end
+
+local failures = tonumber(redis.call("HGET", KEYS[1], "count") or 0)
+local last = tonumber(redis.call("HGET", KEYS[1], "last_attempt") or 0)
+local now, backoff_after, max_backoff, window = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4]
+
+if failures >= backoff_after then
+	local backoff = max_backoff
+
+	if failures - backoff_after <= 16 then
+		backoff = math.min(1000 * 2 ^ (failures - backoff_after), max_backoff)
+	end
+
+	local wait = last + backoff - now
+
+	if wait > 0 then
+		return {failures, 0, wait}
+	end
+end
+
+failures = redis.call("HINCRBY", KEYS[1], "count", 1)
+redis.call("HSET", KEYS[1], "last_attempt", now)
+redis.call("PEXPIRE", KEYS[1], window)
+
+return {failures, 0, 0}
+`)
+
+func (s *redisStore) BeginAttempt(subject string, rule throttleRule, window time.Duration) (throttleDecision, error) {
+	keys := []string{failuresKey(subject), lockoutKey(subject)}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	res, err := beginAttemptScript.Run(s.client, keys, now, rule.backoffAfter, int64(MAX_BACKOFF/time.Millisecond), int64(window/time.Millisecond)).Result()
+
+	if err != nil {
+		return throttleDecision{}, err
+	}
+
+	values, ok := res.([]interface{})
+
+	if !ok || len(values) != 3 {
+		return throttleDecision{}, fmt.Errorf("unexpected reply from the throttling script: %v", res)
+	}
+
+	failures, _ := values[0].(int64)
+	lockedFor, _ := values[1].(int64)
+	backoffFor, _ := values[2].(int64)
+
+	return throttleDecision{
+		failures:   failures,
+		lockedFor:  time.Duration(lockedFor) * time.Millisecond,
+		backoffFor: time.Duration(backoffFor) * time.Millisecond,
+	}, nil
+}
+
+// Decrements the count without touching the expiry, so a failure hash that's gone stays gone
+// rather than coming back with a negative count
+var forgiveFailureScript = redis.NewScript(`
+if tonumber(redis.call("HGET", KEYS[1], "count") or 0) > 0 then
+	redis.call("HINCRBY", KEYS[1], "count", -1)
+end
+
+return 0
+`)
+
+func (s *redisStore) ForgiveFailure(subject string) error {
+	return forgiveFailureScript.Run(s.client, []string{failuresKey(subject)}).Err()
+}
+
+func (s *redisStore) LockOut(subject string, duration time.Duration) error {
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(lockoutKey(subject), 1, duration)
+		pipe.Del(failuresKey(subject))
+		return nil
+	})
+
+	return err
+}
+
+func (s *redisStore) ResetThrottle(subject string) error {
+	return s.client.Del(failuresKey(subject), lockoutKey(subject)).Err()
+}
+
+func (s *redisStore) CreateRefreshToken(hash string, rt *refreshToken, ttl time.Duration) error {
+	key := refreshTokenKey(hash)
+
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, map[string]interface{}{
+			"username": rt.username,
+			"family":   rt.family,
+			"uses":     0,
+		})
+		pipe.Expire(key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+func (s *redisStore) RefreshToken(hash string) (*refreshToken, error) {
+	fields, err := s.client.HGetAll(refreshTokenKey(hash)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return nil, errNotFound
+	}
+
+	return &refreshToken{
+		username: fields["username"],
+		family:   fields["family"],
+	}, nil
+}
+
+// Counts a use of a refresh token, unless it has expired in the meantime, in which case counting
+// it would bring back a hash without an expiry
+var useRefreshTokenScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+
+return redis.call("HINCRBY", KEYS[1], "uses", 1)
+`)
+
+func (s *redisStore) UseRefreshToken(hash string) (int64, error) {
+	res, err := useRefreshTokenScript.Run(s.client, []string{refreshTokenKey(hash)}).Result()
+
+	if err == redis.Nil {
+		return 0, errNotFound
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	uses, ok := res.(int64)
+
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply from the refresh token script: %v", res)
+	}
+
+	return uses, nil
+}
+
+func (s *redisStore) Revoke(id string, until time.Time) error {
+	return s.client.ZAdd(REVOKED_TOKENS_KEY, redis.Z{
+		Score:  float64(until.Unix()),
+		Member: id,
+	}).Err()
+}
+
+func (s *redisStore) RevokedIDs() ([]string, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if err := s.client.ZRemRangeByScore(REVOKED_TOKENS_KEY, "-inf", "("+now).Err(); err != nil {
+		return nil, err
+	}
+
+	return s.client.ZRangeByScore(REVOKED_TOKENS_KEY, redis.ZRangeBy{
+		Min: now,
+		Max: "+inf",
+	}).Result()
+}
+
+// Stores a new key and lists its prefix, unless a key with the same prefix already exists
+var createApiKeyScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+
+redis.call("HMSET", KEYS[1], unpack(ARGV, 2))
+redis.call("SADD", KEYS[2], ARGV[1])
+
+return 1
+`)
+
+// Sets fields of a key's hash only if the key still exists, so that an update racing with a
+// revocation can't bring back part of the key
+var updateApiKeyScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+
+redis.call("HMSET", KEYS[1], unpack(ARGV))
+
+return 1
+`)
+
+func (s *redisStore) CreateApiKey(apiKey *auth.ApiKey, secretHash string) error {
+	routes, err := json.Marshal(apiKey.Routes)
+
+	if err != nil {
+		return err
+	}
+
+	keys := []string{apiKeyKey(apiKey.Prefix), API_KEYS_INDEX_KEY}
+
+	created, err := createApiKeyScript.Run(s.client, keys, apiKey.Prefix,
+		"name", apiKey.Name,
+		"owner", apiKey.Owner,
+		"routes", string(routes),
+		"created_at", apiKey.CreatedAt,
+		"expires_at", apiKey.ExpiresAt,
+		"last_used_at", apiKey.LastUsedAt,
+		"secret_hash", secretHash,
+	).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if created == int64(0) {
+		return errExists
+	}
+
+	return nil
+}
+
+func (s *redisStore) updateApiKey(prefix string, fields ...interface{}) error {
+	updated, err := updateApiKeyScript.Run(s.client, []string{apiKeyKey(prefix)}, fields...).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if updated == int64(0) {
+		return errNotFound
+	}
+
+	return nil
+}
+
+func (s *redisStore) ApiKey(prefix string) (*auth.ApiKey, string, error) {
+	fields, err := s.client.HGetAll(apiKeyKey(prefix)).Result()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(fields) == 0 {
+		return nil, "", errNotFound
+	}
+
+	var routes []string
+
+	if err := json.Unmarshal([]byte(fields["routes"]), &routes); err != nil {
+		return nil, "", err
+	}
+
+	createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(fields["expires_at"], 10, 64)
+	lastUsedAt, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+
+	return &auth.ApiKey{
+		Prefix:     prefix,
+		Name:       fields["name"],
+		Owner:      fields["owner"],
+		Routes:     routes,
+		CreatedAt:  createdAt,
+		ExpiresAt:  expiresAt,
+		LastUsedAt: lastUsedAt,
+	}, fields["secret_hash"], nil
+}
+
+func (s *redisStore) ApiKeys() ([]*auth.ApiKey, error) {
+	prefixes, err := s.client.SMembers(API_KEYS_INDEX_KEY).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := []*auth.ApiKey{}
+
+	for _, prefix := range prefixes {
+		apiKey, _, err := s.ApiKey(prefix)
+
+		if err == errNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+func (s *redisStore) SetApiKeySecret(prefix, secretHash string) error {
+	return s.updateApiKey(prefix, "secret_hash", secretHash)
+}
+
+func (s *redisStore) SetApiKeyRoutes(prefix string, routes []string) error {
+	encoded, err := json.Marshal(routes)
+
+	if err != nil {
+		return err
+	}
+
+	return s.updateApiKey(prefix, "routes", string(encoded))
+}
+
+func (s *redisStore) TouchApiKey(prefix string, at time.Time) error {
+	return s.updateApiKey(prefix, "last_used_at", at.Unix())
+}
+
+func (s *redisStore) DeleteApiKey(prefix string) error {
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(apiKeyKey(prefix))
+		pipe.SRem(API_KEYS_INDEX_KEY, prefix)
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+const (
+	// Failures are forgotten once nothing has failed for this long
+	FAILURE_WINDOW = 15 * time.Minute
+
+	LOCKOUT_DURATION = 30 * time.Minute
+
+	MAX_BACKOFF = 5 * time.Minute
+)
+
+// How failed attempts against a single principal or client IP are throttled. Once a subject
+// reaches backoffAfter failures it has to wait 1s, 2s, 4s, and so on between attempts, and
+// once it reaches lockoutAfter failures it's locked out entirely.
+type throttleRule struct {
+	kind         string
+	backoffAfter int64
+	lockoutAfter int64
+}
+
+var (
+	userThrottle = throttleRule{kind: "user", backoffAfter: 3, lockoutAfter: 10}
+
+	// Client IPs can be shared by many users behind a NAT, so they get more leeway
+	ipThrottle = throttleRule{kind: "ip", backoffAfter: 10, lockoutAfter: 50}
+)
+
+type throttledSubject struct {
+	rule    throttleRule
+	subject string
+}
+
+// Every login attempt is throttled both by the user it targets and the IP it comes from
+func loginThrottles(username, clientIP string) []throttledSubject {
+	return []throttledSubject{
+		{userThrottle, username},
+		{ipThrottle, clientIP},
+	}
+}
+
+// The subject as the credential store knows it, e.g. "user:tony" or "ip:10.0.0.1"
+func (t throttleRule) key(subject string) string {
+	return t.kind + ":" + subject
+}
+
+func (t throttleRule) backoff(failures int64) time.Duration {
+	if failures < t.backoffAfter {
+		return 0
+	}
+
+	exponent := uint(failures - t.backoffAfter)
+
+	if exponent > 16 {
+		return MAX_BACKOFF
+	}
+
+	backoff := time.Second << exponent
+
+	if backoff > MAX_BACKOFF {
+		return MAX_BACKOFF
+	}
+
+	return backoff
+}
+
+// The outcome of trying to begin an attempt against a subject
+type throttleDecision struct {
+	// The subject's failures, counting the attempt that was begun, if any
+	failures int64
+
+	// How long the subject is locked out, or has to back off, for. The attempt wasn't begun if
+	// either is positive.
+	lockedFor  time.Duration
+	backoffFor time.Duration
+}
+
+// Decides whether a subject with the given failures may make another attempt, the last failure
+// having happened at last
+func (t throttleRule) decide(failures int64, last, now time.Time) throttleDecision {
+	if wait := last.Add(t.backoff(failures)).Sub(now); wait > 0 {
+		return throttleDecision{failures: failures, backoffFor: wait}
+	}
+
+	return throttleDecision{failures: failures + 1}
+}
+
+// Lets an attempt go ahead unless the subject is locked out or backing off, in which case the
+// reason and how long to wait are returned instead. The attempt is counted as a failure in the
+// same step, before its password is checked, so that concurrent guesses can't all slip through
+// before any of them has been counted; it's forgiven if it turns out to have succeeded.
+func (h *authHandler) beginAttempt(ctx context.Context, rule throttleRule, subject string) (auth.AuthFailureReason, time.Duration, int64, error) {
+	if subject == "" {
+		return auth.AuthFailureReason_NONE, 0, 0, nil
+	}
+
+	decision, err := storeFor(ctx, h.store).BeginAttempt(rule.key(subject), rule, FAILURE_WINDOW)
+
+	if err != nil {
+		return auth.AuthFailureReason_NONE, 0, 0, err
+	}
+
+	if decision.lockedFor > 0 {
+		return auth.AuthFailureReason_LOCKED_OUT, decision.lockedFor, 0, nil
+	}
+
+	if decision.backoffFor > 0 {
+		return auth.AuthFailureReason_THROTTLED, decision.backoffFor, 0, nil
+	}
+
+	return auth.AuthFailureReason_NONE, 0, decision.failures, nil
+}
+
+// Takes back the failure counted by beginAttempt, for attempts that didn't fail
+func (h *authHandler) forgiveAttempt(ctx context.Context, rule throttleRule, subject string) error {
+	if subject == "" {
+		return nil
+	}
+
+	return storeFor(ctx, h.store).ForgiveFailure(rule.key(subject))
+}
+
+// Locks the subject out once an attempt begun with the given failure count has failed too.
+// Reports whether it was locked out.
+func (h *authHandler) lockOutIfExceeded(ctx context.Context, rule throttleRule, subject string, failures int64) (bool, error) {
+	if subject == "" || failures < rule.lockoutAfter {
+		return false, nil
+	}
+
+	if err := storeFor(ctx, h.store).LockOut(rule.key(subject), LOCKOUT_DURATION); err != nil {
+		return false, err
+	}
+
+	logf(ctx, "Locked out %s %s for %s after %d failed attempts", rule.kind, subject, LOCKOUT_DURATION, failures)
+
+	return true, nil
+}
+
+func (h *authHandler) resetThrottle(ctx context.Context, rule throttleRule, subject string) error {
+	if subject == "" {
+		return nil
+	}
+
+	return storeFor(ctx, h.store).ResetThrottle(rule.key(subject))
+}
+
+// Builds the status returned when a login attempt is refused without checking the password.
+// The AuthResponse detail carries the reason and how long the caller should wait.
+func throttleError(reason auth.AuthFailureReason, retryAfter time.Duration) error {
+	code, message := codes.ResourceExhausted, "too many failed attempts; try again later"
+
+	if reason == auth.AuthFailureReason_LOCKED_OUT {
+		code, message = codes.PermissionDenied, "account is temporarily locked"
+	}
+
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+
+	st, err := status.New(code, message).WithDetails(&auth.AuthResponse{
+		Reason:            reason,
+		RetryAfterSeconds: seconds,
+	})
+
+	if err != nil {
+		return status.Error(code, message)
+	}
+
+	return st.Err()
+}
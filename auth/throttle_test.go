@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Adds a user to the store with a cheap hash, so that tests don't spend their time in bcrypt
+func addTestUser(t *testing.T, store *memoryStore, username, password string, roles ...string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.addUser(username, string(hash), roles)
+}
+
+func TestThrottleRuleBackoff(t *testing.T) {
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{10, 128 * time.Second},
+		{11, 256 * time.Second},
+		{12, MAX_BACKOFF},
+		{1000, MAX_BACKOFF},
+	}
+
+	for _, tt := range tests {
+		if got := userThrottle.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestThrottleRuleDecide(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		failures int64
+		last     time.Time
+		want     throttleDecision
+	}{
+		{"no failures", 0, time.Time{}, throttleDecision{failures: 1}},
+		{"below the backoff threshold", 2, now, throttleDecision{failures: 3}},
+		{"backing off", 3, now, throttleDecision{failures: 3, backoffFor: time.Second}},
+		{"partway through the backoff", 4, now.Add(-time.Second), throttleDecision{failures: 4, backoffFor: time.Second}},
+		{"backoff over", 3, now.Add(-time.Second), throttleDecision{failures: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userThrottle.decide(tt.failures, tt.last, now); got != tt.want {
+				t.Errorf("decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Guesses that arrive at the same time mustn't all get past the throttle before any of them
+// has been counted
+func TestLoginConcurrentGuesses(t *testing.T) {
+	store := newMemoryStore()
+
+	addTestUser(t, store, "tony", "right")
+
+	h := &authHandler{store: store}
+
+	const guesses = 20
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		checked   int
+		throttled int
+	)
+
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := h.login(context.Background(), "tony", "wrong", "203.0.113.7")
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch status.Code(err) {
+			case codes.OK:
+				checked++
+			case codes.ResourceExhausted:
+				throttled++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if checked != int(userThrottle.backoffAfter) {
+		t.Errorf("%d guesses had their passwords checked, want %d", checked, userThrottle.backoffAfter)
+	}
+
+	if checked+throttled != guesses {
+		t.Errorf("%d guesses were checked or throttled, want %d", checked+throttled, guesses)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	const ip = "203.0.113.7"
+
+	tests := []struct {
+		name         string
+		userFailures int64
+		lastFailure  time.Duration
+		password     string
+		wantCode     codes.Code
+		wantOK       bool
+		wantUser     int64
+		wantIP       int64
+	}{
+		{"success", 0, 0, "right", codes.OK, true, 0, 0},
+		{"success clears earlier failures", 2, 0, "right", codes.OK, true, 0, 0},
+		{"failure is counted", 1, 0, "wrong", codes.OK, false, 2, 1},
+		{"backing off", 3, 0, "right", codes.ResourceExhausted, false, 3, 0},
+		{"backoff over", 3, time.Second, "wrong", codes.OK, false, 4, 1},
+		{"last failure before the lockout", 9, MAX_BACKOFF, "wrong", codes.OK, false, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+
+			addTestUser(t, store, "tony", "right")
+
+			h := &authHandler{store: store}
+
+			if tt.userFailures > 0 {
+				store.failures[userThrottle.key("tony")] = &memoryFailures{
+					count:     tt.userFailures,
+					last:      time.Now().Add(-tt.lastFailure),
+					expiresAt: time.Now().Add(FAILURE_WINDOW),
+				}
+			}
+
+			ok, err := h.login(context.Background(), "tony", tt.password, ip)
+
+			if status.Code(err) != tt.wantCode || ok != tt.wantOK {
+				t.Fatalf("login() = %t, %v, want %t with code %s", ok, err, tt.wantOK, tt.wantCode)
+			}
+
+			count := func(key string) int64 {
+				if f, ok := store.failures[key]; ok {
+					return f.count
+				}
+
+				return 0
+			}
+
+			if got := count(userThrottle.key("tony")); got != tt.wantUser {
+				t.Errorf("user failures = %d, want %d", got, tt.wantUser)
+			}
+
+			if got := count(ipThrottle.key(ip)); got != tt.wantIP {
+				t.Errorf("IP failures = %d, want %d", got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	store := newMemoryStore()
+
+	addTestUser(t, store, "tony", "right")
+
+	h := &authHandler{store: store}
+
+	store.failures[userThrottle.key("tony")] = &memoryFailures{
+		count:     userThrottle.lockoutAfter - 1,
+		expiresAt: time.Now().Add(FAILURE_WINDOW),
+	}
+
+	if ok, err := h.login(context.Background(), "tony", "wrong", ""); ok || err != nil {
+		t.Fatalf("login() = %t, %v, want a plain failure", ok, err)
+	}
+
+	// Even the right password is refused while locked out
+	_, err := h.login(context.Background(), "tony", "right", "")
+
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("login() while locked out = %v, want PermissionDenied", err)
+	}
+}
+
+// Failures and lockouts of subjects that are never seen again are dropped once they expire
+func TestMemoryStoreSweepsExpiredThrottles(t *testing.T) {
+	store := newMemoryStore()
+
+	now := time.Now()
+
+	store.failures["expired"] = &memoryFailures{count: 1, expiresAt: now.Add(-time.Second)}
+	store.failures["live"] = &memoryFailures{count: 1, expiresAt: now.Add(time.Hour)}
+	store.lockouts["expired"] = now.Add(-time.Second)
+	store.lockouts["live"] = now.Add(time.Hour)
+
+	if _, err := store.BeginAttempt(userThrottle.key("tony"), userThrottle, FAILURE_WINDOW); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.failures["expired"]; ok {
+		t.Error("expired failures weren't dropped")
+	}
+
+	if _, ok := store.lockouts["expired"]; ok {
+		t.Error("an expired lockout wasn't dropped")
+	}
+
+	if _, ok := store.failures["live"]; !ok {
+		t.Error("live failures were dropped")
+	}
+
+	if _, ok := store.lockouts["live"]; !ok {
+		t.Error("a live lockout was dropped")
+	}
+
+	// Sweeping waits for the interval to pass rather than scanning on every attempt
+	store.failures["expired"] = &memoryFailures{count: 1, expiresAt: now.Add(-time.Second)}
+
+	if _, err := store.BeginAttempt(userThrottle.key("tony"), userThrottle, FAILURE_WINDOW); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.failures["expired"]; !ok {
+		t.Error("swept again before the interval had passed")
+	}
+
+	store.sweptAt = now.Add(-MEMORY_STORE_SWEEP_INTERVAL)
+
+	if _, err := store.BeginAttempt(userThrottle.key("tony"), userThrottle, FAILURE_WINDOW); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.failures["expired"]; ok {
+		t.Error("expired failures weren't dropped once the interval had passed")
+	}
+}
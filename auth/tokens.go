@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// A PEM-encoded ECDSA P-256 private key, mounted from a Kubernetes secret. Every auth
+	// replica has to sign with the same key for the web service to verify their tokens.
+	SIGNING_KEY_FILE = "/etc/colossus/auth/signing-key.pem"
+
+	TOKEN_ISSUER = "colossus-auth"
+
+	TOKEN_TTL = 15 * time.Minute
+)
+
+// Access token claims. Every token belongs to the refresh token family that it was issued
+// under, so that revoking a family also revokes its outstanding access tokens.
+type tokenClaims struct {
+	Family string `json:"fam,omitempty"`
+	jwt.StandardClaims
+}
+
+type tokenIssuer struct {
+	key          *ecdsa.PrivateKey
+	keyID        string
+	publicKeyPEM string
+}
+
+// Loads the signing key from the given file. A missing file is an error unless ephemeral keys
+// are allowed, in which case a throwaway key is generated instead. That's only suitable for
+// local development with a single replica, since every replica would sign with a different key
+// and every token stops working on restart.
+func newTokenIssuer(path string, allowEphemeral bool) (*tokenIssuer, error) {
+	var key *ecdsa.PrivateKey
+
+	keyPEM, err := ioutil.ReadFile(path)
+
+	switch {
+	case os.IsNotExist(err) && allowEphemeral:
+		log.Printf("No signing key found at %s; generating an ephemeral key", path)
+
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("no signing key found at %s; create one with make k8s-signing-key, or set ephemeral_signing_key for local development", path)
+	case err != nil:
+		return nil, err
+	default:
+		key, err = jwt.ParseECPrivateKeyFromPEM(keyPEM)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key %s: %v", path, err)
+		}
+	}
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(publicKeyDER)
+
+	return &tokenIssuer{
+		key:          key,
+		keyID:        hex.EncodeToString(fingerprint[:8]),
+		publicKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})),
+	}, nil
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Signs a short-lived access token for the given user
+func (t *tokenIssuer) issue(username, family string) (string, time.Time, error) {
+	id, err := newTokenID()
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(TOKEN_TTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &tokenClaims{
+		Family: family,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Issuer:    TOKEN_ISSUER,
+			Subject:   username,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+
+	token.Header["kid"] = t.keyID
+
+	signed, err := token.SignedString(t.key)
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiresAt, nil
+}
+
+// Verifies the token's signature, expiry, and issuer and returns its claims
+func (t *tokenIssuer) validate(tokenString string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		return &t.key.PublicKey, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+
+	if !claims.VerifyIssuer(TOKEN_ISSUER, true) {
+		return nil, fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Changing the cost causes stored hashes to be upgraded the next time each user logs in
+	BCRYPT_COST = 12
+)
+
+// A throwaway hash used when no user record exists, so that a lookup for an unknown
+// username costs as much as a lookup for a known one
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("colossus"), BCRYPT_COST)
+
+// Checks the supplied password against the user's stored bcrypt hash. A missing user is
+// reported as a failed verification rather than as an error.
+func (h *authHandler) verifyPassword(ctx context.Context, username, password string) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+
+	hash, err := storeFor(ctx, h.store).PasswordHash(username)
+
+	if err == errNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	h.rehashIfNeeded(ctx, username, hash, password)
+
+	return true, nil
+}
+
+// Replaces the user's stored hash when it was generated with a different cost than the
+// current one. Failures are logged but never fail the login.
+func (h *authHandler) rehashIfNeeded(ctx context.Context, username, hash, password string) {
+	cost, err := bcrypt.Cost([]byte(hash))
+
+	if err != nil || cost == BCRYPT_COST {
+		return
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+
+	if err != nil {
+		logf(ctx, "Could not rehash password for user %s: %v", username, err)
+		return
+	}
+
+	if err := storeFor(ctx, h.store).SetPasswordHash(username, string(newHash)); err != nil {
+		logf(ctx, "Could not store rehashed password for user %s: %v", username, err)
+		return
+	}
+
+	logf(ctx, "Upgraded password hash for user %s from cost %d to %d", username, cost, BCRYPT_COST)
+}
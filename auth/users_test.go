@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	cheap := testHash(t, "tonydanza")
+
+	current, err := bcrypt.GenerateFromPassword([]byte("tonydanza"), BCRYPT_COST)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		hash       string
+		username   string
+		password   string
+		want       bool
+		wantErr    bool
+		wantRehash bool
+	}{
+		{name: "right password", hash: string(current), username: "tony", password: "tonydanza", want: true},
+		{name: "wrong password", hash: string(current), username: "tony", password: "tonydanz"},
+		{name: "old cost is upgraded", hash: cheap, username: "tony", password: "tonydanza", want: true, wantRehash: true},
+		{name: "old cost with the wrong password", hash: cheap, username: "tony", password: "wrong"},
+		{name: "htpasswd's $2y$ prefix", hash: strings.Replace(cheap, "$2a$", "$2y$", 1), username: "tony", password: "tonydanza", want: true, wantRehash: true},
+		{name: "unknown user", username: "ghost", password: "tonydanza"},
+		{name: "no username", username: "", password: "tonydanza"},
+		{name: "corrupt hash", hash: "$2a$04$short", username: "tony", password: "tonydanza", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+
+			if tt.hash != "" {
+				store.addUser("tony", tt.hash, nil)
+			}
+
+			h := &authHandler{store: store}
+
+			ok, err := h.verifyPassword(context.Background(), tt.username, tt.password)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyPassword() error = %v, want error: %t", err, tt.wantErr)
+			}
+
+			if ok != tt.want {
+				t.Errorf("verifyPassword() = %t, want %t", ok, tt.want)
+			}
+
+			if tt.hash == "" {
+				return
+			}
+
+			stored, _ := store.PasswordHash("tony")
+
+			if rehashed := stored != tt.hash; rehashed != tt.wantRehash {
+				t.Fatalf("rehashed = %t, want %t", rehashed, tt.wantRehash)
+			}
+
+			if !tt.wantRehash {
+				return
+			}
+
+			if cost, _ := bcrypt.Cost([]byte(stored)); cost != BCRYPT_COST {
+				t.Errorf("rehashed with cost %d, want %d", cost, BCRYPT_COST)
+			}
+
+			if bcrypt.CompareHashAndPassword([]byte(stored), []byte(tt.password)) != nil {
+				t.Error("the new hash doesn't match the password")
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Package config loads the configuration for the Colossus Go services. Every setting can
+// come from, in increasing order of precedence: its default, a YAML or TOML file, an
+// environment variable, and a command-line flag.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// The file to load settings from can be passed with either of these
+	CONFIG_FILE_FLAG = "config"
+
+	CONFIG_FILE_ENV = "CONFIG_FILE"
+
+	REDACTED = "[redacted]"
+)
+
+// The places a setting's value can come from
+const (
+	SOURCE_DEFAULT = "default"
+
+	SOURCE_FILE = "file"
+
+	SOURCE_ENV = "env"
+
+	SOURCE_FLAG = "flag"
+)
+
+// A single configuration setting. Keys are dotted paths, such as "redis.address", which is
+// how the setting is nested in a config file. The matching environment variable is the key
+// in upper case with dots replaced by underscores (REDIS_ADDRESS) and the matching flag
+// replaces dots and underscores with dashes (--redis-address).
+type Setting struct {
+	Key string
+
+	// Determines the setting's type, which must be a string, bool, int, float64, []string, or
+	// time.Duration
+	Default interface{}
+
+	Usage string
+
+	// Secret settings are never shown in the effective configuration
+	Secret bool
+}
+
+func (s Setting) env() string {
+	return strings.ToUpper(strings.Replace(s.Key, ".", "_", -1))
+}
+
+func (s Setting) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.Key)
+}
+
+// The loaded configuration of a service
+type Config struct {
+	settings []Setting
+	v        *viper.Viper
+	flags    *pflag.FlagSet
+	file     string
+
+	// Holds only what was read from the file, to tell which settings it provided
+	fromFile *viper.Viper
+}
+
+// Loads the given settings for the named service. args are the command-line arguments without
+// the program name, i.e. os.Args[1:].
+func Load(service string, settings []Setting, args []string) (*Config, error) {
+	v := viper.New()
+
+	flags := pflag.NewFlagSet(service, pflag.ContinueOnError)
+
+	file := flags.String(CONFIG_FILE_FLAG, os.Getenv(CONFIG_FILE_ENV), "A YAML or TOML file to load settings from")
+
+	for _, s := range settings {
+		v.SetDefault(s.Key, s.Default)
+
+		if err := v.BindEnv(s.Key, s.env()); err != nil {
+			return nil, err
+		}
+
+		switch d := s.Default.(type) {
+		case string:
+			flags.String(s.flag(), d, s.Usage)
+		case bool:
+			flags.Bool(s.flag(), d, s.Usage)
+		case int:
+			flags.Int(s.flag(), d, s.Usage)
+		case float64:
+			flags.Float64(s.flag(), d, s.Usage)
+		case []string:
+			flags.StringSlice(s.flag(), d, s.Usage)
+		case time.Duration:
+			flags.Duration(s.flag(), d, s.Usage)
+		default:
+			return nil, fmt.Errorf("setting %s has unsupported type %T", s.Key, s.Default)
+		}
+
+		if err := v.BindPFlag(s.Key, flags.Lookup(s.flag())); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	fromFile := viper.New()
+
+	if *file != "" {
+		for _, fv := range []*viper.Viper{v, fromFile} {
+			fv.SetConfigFile(*file)
+
+			if err := fv.ReadInConfig(); err != nil {
+				return nil, fmt.Errorf("could not read config file %s: %v", *file, err)
+			}
+		}
+	}
+
+	return &Config{
+		settings: settings,
+		v:        v,
+		flags:    flags,
+		file:     *file,
+		fromFile: fromFile,
+	}, nil
+}
+
+// Decodes the configuration into target, a pointer to a struct whose fields are tagged with
+// `mapstructure:"<key>"`, and validates it if it implements Validator
+func (c *Config) Decode(target interface{}) error {
+	if err := c.v.Unmarshal(target); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	if validator, ok := target.(Validator); ok {
+		return validator.Validate()
+	}
+
+	return nil
+}
+
+// Where the current value of the setting comes from
+func (c *Config) source(s Setting) string {
+	if f := c.flags.Lookup(s.flag()); f != nil && f.Changed {
+		return SOURCE_FLAG
+	}
+
+	if _, ok := os.LookupEnv(s.env()); ok {
+		return SOURCE_ENV
+	}
+
+	if c.fromFile.IsSet(s.Key) {
+		return SOURCE_FILE
+	}
+
+	return SOURCE_DEFAULT
+}
+
+type EffectiveSetting struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// Reads a setting as the type of its default, since values from files, the environment, and
+// flags may all be strings
+func (c *Config) get(s Setting) interface{} {
+	switch s.Default.(type) {
+	case bool:
+		return c.v.GetBool(s.Key)
+	case int:
+		return c.v.GetInt(s.Key)
+	case float64:
+		return c.v.GetFloat64(s.Key)
+	case []string:
+		// Environment variables hold comma-separated lists, which Decode splits on commas
+		if raw, ok := c.v.Get(s.Key).(string); ok {
+			if raw == "" {
+				return []string{}
+			}
+
+			return strings.Split(raw, ",")
+		}
+
+		return c.v.GetStringSlice(s.Key)
+	case time.Duration:
+		return c.v.GetDuration(s.Key).String()
+	default:
+		return c.v.GetString(s.Key)
+	}
+}
+
+// The value and source of every setting, with the values of secret settings redacted
+func (c *Config) Effective() map[string]EffectiveSetting {
+	effective := make(map[string]EffectiveSetting, len(c.settings))
+
+	for _, s := range c.settings {
+		value := c.get(s)
+
+		if s.Secret && c.v.GetString(s.Key) != "" {
+			value = REDACTED
+		}
+
+		effective[s.Key] = EffectiveSetting{
+			Value:  value,
+			Source: c.source(s),
+		}
+	}
+
+	return effective
+}
+
+// Serves the effective configuration as JSON
+func (c *Config) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+
+		enc.SetIndent("", "  ")
+
+		enc.Encode(map[string]interface{}{
+			"file":     c.file,
+			"settings": c.Effective(),
+		})
+	})
+}
+
+// Summarizes every setting and where it came from on a single line for logging, with secrets
+// redacted
+func (c *Config) Describe() string {
+	effective := c.Effective()
+
+	keys := make([]string, 0, len(effective))
+
+	for key := range effective {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	lines := make([]string, len(keys))
+
+	for i, key := range keys {
+		lines[i] = fmt.Sprintf("%s=%v (%s)", key, effective[key].Value, effective[key].Source)
+	}
+
+	return strings.Join(lines, ", ")
+}
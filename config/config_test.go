@@ -0,0 +1,351 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSettings = []Setting{
+	{Key: "name", Default: "default-name", Usage: "A name"},
+	{Key: "redis.address", Default: "localhost:6379", Usage: "A nested setting"},
+	{Key: "port", Default: 8080, Usage: "A port"},
+	{Key: "timeout", Default: time.Second, Usage: "A duration"},
+	{Key: "origins", Default: []string{}, Usage: "A list"},
+	{Key: "password", Default: "", Usage: "A secret", Secret: true},
+}
+
+type testConfig struct {
+	Name  string `mapstructure:"name"`
+	Redis struct {
+		Address string `mapstructure:"address"`
+	} `mapstructure:"redis"`
+	Port     int           `mapstructure:"port"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Origins  []string      `mapstructure:"origins"`
+	Password string        `mapstructure:"password"`
+}
+
+func (c *testConfig) Validate() error {
+	var problems Problems
+
+	problems.NonEmpty("name", c.Name)
+	problems.Port("port", c.Port)
+	problems.PositiveDuration("timeout", c.Timeout)
+
+	return problems.Err()
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", "name: file-name\nredis:\n  address: file:6379\n")
+
+	tests := []struct {
+		name       string
+		file       bool
+		env        map[string]string
+		args       []string
+		want       string
+		wantSource string
+	}{
+		{"default", false, nil, nil, "default-name", SOURCE_DEFAULT},
+		{"file over default", true, nil, nil, "file-name", SOURCE_FILE},
+		{"env over file", true, map[string]string{"NAME": "env-name"}, nil, "env-name", SOURCE_ENV},
+		{"flag over env", true, map[string]string{"NAME": "env-name"}, []string{"--name", "flag-name"}, "flag-name", SOURCE_FLAG},
+		{"flag over file", true, nil, []string{"--name=flag-name"}, "flag-name", SOURCE_FLAG},
+		{"env without a file", false, map[string]string{"NAME": "env-name"}, nil, "env-name", SOURCE_ENV},
+		{"file from the environment", false, map[string]string{CONFIG_FILE_ENV: file}, nil, "file-name", SOURCE_FILE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			args := tt.args
+
+			if tt.file {
+				args = append([]string{"--config", file}, args...)
+			}
+
+			c, err := Load("test", testSettings, args)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cfg testConfig
+
+			if err := c.Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Name != tt.want {
+				t.Errorf("decoded name = %q, want %q", cfg.Name, tt.want)
+			}
+
+			effective := c.Effective()["name"]
+
+			if effective.Value != tt.want || effective.Source != tt.wantSource {
+				t.Errorf("effective name = %v from %s, want %q from %s", effective.Value, effective.Source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+// Nested keys map onto environment variables and flags as the Setting doc describes
+func TestNestedKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		args       []string
+		want       string
+		wantSource string
+	}{
+		{"env", map[string]string{"REDIS_ADDRESS": "env:6379"}, nil, "env:6379", SOURCE_ENV},
+		{"flag", nil, []string{"--redis-address", "flag:6379"}, "flag:6379", SOURCE_FLAG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			c, err := Load("test", testSettings, tt.args)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cfg testConfig
+
+			if err := c.Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			effective := c.Effective()["redis.address"]
+
+			if cfg.Redis.Address != tt.want || effective.Value != tt.want || effective.Source != tt.wantSource {
+				t.Errorf("redis.address = %q, effective %v from %s, want %q from %s",
+					cfg.Redis.Address, effective.Value, effective.Source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+// Lists are shown as they're decoded, wherever they come from
+func TestStringSlices(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		want     []string
+		wantDesc string
+	}{
+		{"default", "", nil, nil, []string{}, "origins=[] (default)"},
+		{"file", "origins:\n  - a\n  - b\n", nil, nil, []string{"a", "b"}, "origins=[a b] (file)"},
+		{"env", "", map[string]string{"ORIGINS": "b,c"}, nil, []string{"b", "c"}, "origins=[b c] (env)"},
+		{"empty env", "", map[string]string{"ORIGINS": ""}, nil, []string{}, "origins=[] (env)"},
+		{"flag", "", nil, []string{"--origins", "c,d"}, []string{"c", "d"}, "origins=[c d] (flag)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			args := tt.args
+
+			if tt.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, "config.yaml", tt.file)}, args...)
+			}
+
+			c, err := Load("test", testSettings, args)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cfg testConfig
+
+			if err := c.Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(cfg.Origins, tt.want) {
+				t.Errorf("decoded origins = %q, want %q", cfg.Origins, tt.want)
+			}
+
+			if got := c.Effective()["origins"].Value; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("effective origins = %q, want %q", got, tt.want)
+			}
+
+			if desc := c.Describe(); !strings.Contains(desc, tt.wantDesc) {
+				t.Errorf("Describe() = %s, want it to contain %s", desc, tt.wantDesc)
+			}
+		})
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantProblems []string
+	}{
+		{"valid", nil, nil},
+		{"one problem", []string{"--port", "0"}, []string{"port: 0 is not a valid port"}},
+		{
+			"every problem at once",
+			[]string{"--name", "", "--port", "70000", "--timeout", "-1s"},
+			[]string{"name: must be set", "port: 70000 is not a valid port", "timeout: must be greater than zero, not -1s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load("test", testSettings, tt.args)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Decode(&testConfig{})
+
+			if (err != nil) != (len(tt.wantProblems) > 0) {
+				t.Fatalf("Decode() = %v, want problems %q", err, tt.wantProblems)
+			}
+
+			for _, problem := range tt.wantProblems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Decode() = %v, want it to report %q", err, problem)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []Setting
+		args     []string
+	}{
+		{"unsupported type", []Setting{{Key: "ratio", Default: float32(0.5)}}, nil},
+		{"unknown flag", testSettings, []string{"--nope"}},
+		{"badly typed flag", testSettings, []string{"--port", "eighty"}},
+		{"missing file", testSettings, []string{"--config", "/nonexistent/config.yaml"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load("test", tt.settings, tt.args); err == nil {
+				t.Error("Load() succeeded")
+			}
+		})
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	const secret = "hunter2"
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		file string
+	}{
+		{"env", map[string]string{"PASSWORD": secret}, nil, ""},
+		{"flag", nil, []string{"--password", secret}, ""},
+		{"file", nil, nil, "password: " + secret + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			args := tt.args
+
+			if tt.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, "config.yaml", tt.file)}, args...)
+			}
+
+			c, err := Load("test", testSettings, args)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cfg testConfig
+
+			if err := c.Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Password != secret {
+				t.Errorf("decoded password = %q, want the secret itself", cfg.Password)
+			}
+
+			if got := c.Effective()["password"].Value; got != REDACTED {
+				t.Errorf("effective password = %v, want %s", got, REDACTED)
+			}
+
+			if desc := c.Describe(); strings.Contains(desc, secret) {
+				t.Errorf("Describe() shows the secret: %s", desc)
+			}
+
+			rec := httptest.NewRecorder()
+
+			c.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+
+			if strings.Contains(rec.Body.String(), secret) {
+				t.Errorf("the config handler shows the secret: %s", rec.Body)
+			}
+
+			var body struct {
+				Settings map[string]EffectiveSetting
+			}
+
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Settings["password"].Value != REDACTED {
+				t.Errorf("the config handler shows the password as %v, want %s", body.Settings["password"].Value, REDACTED)
+			}
+		})
+	}
+}
+
+// An unset secret is shown as empty, so that it's clear that it's missing
+func TestUnsetSecretsAreShown(t *testing.T) {
+	c, err := Load("test", testSettings, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.Effective()["password"].Value; got != "" {
+		t.Errorf("effective password = %v, want it empty", got)
+	}
+}
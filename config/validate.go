@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Implemented by configuration structs that check their own values
+type Validator interface {
+	Validate() error
+}
+
+// Collects every problem with a configuration, so that they can all be reported at once
+// instead of one per restart
+type Problems []string
+
+func (p *Problems) Add(key, format string, args ...interface{}) {
+	*p = append(*p, key+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *Problems) NonEmpty(key, value string) {
+	if value == "" {
+		p.Add(key, "must be set")
+	}
+}
+
+func (p *Problems) Port(key string, port int) {
+	if port < 1 || port > 65535 {
+		p.Add(key, "%d is not a valid port", port)
+	}
+}
+
+func (p *Problems) Positive(key string, value int) {
+	if value <= 0 {
+		p.Add(key, "must be greater than zero, not %d", value)
+	}
+}
+
+func (p *Problems) Fraction(key string, value float64) {
+	if value < 0 || value > 1 {
+		p.Add(key, "must be between 0 and 1, not %g", value)
+	}
+}
+
+func (p *Problems) PositiveDuration(key string, d time.Duration) {
+	if d <= 0 {
+		p.Add(key, "must be greater than zero, not %s", d)
+	}
+}
+
+func (p *Problems) NonNegativeDuration(key string, d time.Duration) {
+	if d < 0 {
+		p.Add(key, "must not be negative, not %s", d)
+	}
+}
+
+func (p *Problems) OneOf(key, value string, options ...string) {
+	for _, option := range options {
+		if value == option {
+			return
+		}
+	}
+
+	p.Add(key, "%q is not one of %s", value, strings.Join(options, ", "))
+}
+
+// Returns nil if there were no problems
+func (p Problems) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(p, "\n  "))
+}
@@ -32,6 +32,11 @@ public class DataHandler {
             .help("Streaming requests to the data service")
             .register();
 
+    private static final Counter exchangeMessages = Counter.build()
+            .name("data_svc_exchange_messages")
+            .help("Messages answered over Exchange streams")
+            .register();
+
     private Server grpcServer;
     private static HTTPServer prometheusHttpServer;
 
@@ -65,6 +70,35 @@ public class DataHandler {
         }
     }
 
+    static class ExchangeResponder implements StreamObserver<Data.DataRequest> {
+        private StreamObserver<Data.DataResponse> observer;
+
+        ExchangeResponder(StreamObserver<Data.DataResponse> observer) {
+            this.observer = observer;
+        }
+
+        @Override
+        public void onNext(Data.DataRequest req) {
+            Data.DataResponse res = Data.DataResponse.newBuilder()
+                    .setValue(req.getRequest().toUpperCase())
+                    .build();
+
+            exchangeMessages.inc();
+
+            observer.onNext(res);
+        }
+
+        @Override
+        public void onError(Throwable t) {
+            LOG.info(String.format("Exchange ended by the client: %s", t.getMessage()));
+        }
+
+        @Override
+        public void onCompleted() {
+            observer.onCompleted();
+        }
+    }
+
     static class DataImpl extends DataServiceGrpc.DataServiceImplBase {
         private static final Logger LOG = Logger.getLogger(DataImpl.class.getName());
 
@@ -106,6 +140,13 @@ public class DataHandler {
             return new StreamingResponder(resObserver);
         }
 
+        @Override
+        public StreamObserver<Data.DataRequest> exchange(final StreamObserver<Data.DataResponse> resObserver) {
+            LOG.info("Exchange started");
+
+            return new ExchangeResponder(resObserver);
+        }
+
     }
 
     private void blockUntilShutdown() throws InterruptedException {
@@ -0,0 +1,9 @@
+//go:build tools
+
+// Tracks the Go tools that the build uses, so that go.mod pins their versions and dependencies
+// along with everyone else's. Bazel builds protoc-gen-grpc-gateway from source.
+package tools
+
+import (
+	_ "github.com/grpc-ecosystem/grpc-gateway/protoc-gen-grpc-gateway"
+)
@@ -0,0 +1,126 @@
+// Package tracing sets up OpenTelemetry tracing for the Colossus Go services. Trace context is
+// propagated between services using the W3C traceparent and tracestate headers, and finished
+// spans are exported either to stdout or to an OpenTelemetry collector over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/lucperkins/colossus/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// Values for the tracing.exporter setting
+const (
+	EXPORTER_STDOUT = "stdout"
+
+	EXPORTER_OTLP = "otlp"
+
+	EXPORTER_NONE = "none"
+)
+
+// The OTLP/HTTP endpoint of a collector running alongside the service
+const OTLP_ENDPOINT = "http://localhost:4318/v1/traces"
+
+type Config struct {
+	// Where finished spans are sent: stdout, otlp, or none
+	Exporter string `mapstructure:"exporter"`
+
+	// The collector's OTLP/HTTP traces endpoint, for the otlp exporter
+	OTLPEndpoint string `mapstructure:"otlp_endpoint"`
+
+	// The fraction of new traces that are recorded. Traces that callers started keep the
+	// caller's decision, so that a trace is either recorded in every service or in none.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// The tracing settings, which services add to their own under the "tracing" key
+var Settings = []config.Setting{
+	{Key: "tracing.exporter", Default: EXPORTER_NONE, Usage: "Where trace spans are sent: stdout, otlp, or none"},
+	{Key: "tracing.otlp_endpoint", Default: OTLP_ENDPOINT, Usage: "The OTLP/HTTP traces endpoint of the OpenTelemetry collector, for the otlp exporter"},
+	{Key: "tracing.sample_ratio", Default: 1.0, Usage: "The fraction of new traces that are recorded, from 0 to 1"},
+}
+
+func (c Config) Validate(problems *config.Problems) {
+	problems.OneOf("tracing.exporter", c.Exporter, EXPORTER_STDOUT, EXPORTER_OTLP, EXPORTER_NONE)
+
+	if c.Exporter == EXPORTER_OTLP {
+		problems.NonEmpty("tracing.otlp_endpoint", c.OTLPEndpoint)
+	}
+
+	problems.Fraction("tracing.sample_ratio", c.SampleRatio)
+}
+
+// Installs the tracer provider and propagator that the OpenTelemetry API uses for the named
+// service. The returned function exports any spans that are still buffered, and is called on
+// shutdown so that the last few requests aren't lost.
+func Setup(service string, cfg Config) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	}
+
+	switch cfg.Exporter {
+	case EXPORTER_STDOUT:
+		exp, err := stdouttrace.New()
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case EXPORTER_OTLP:
+		exp, err := newOTLPExporter(cfg.OTLPEndpoint)
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case EXPORTER_NONE:
+		// Spans are still started, so that trace context is passed along, but go nowhere
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// Exports spans to the collector's OTLP/HTTP traces endpoint, given as a URL
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %v", endpoint, err)
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+	}
+
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return otlptracehttp.New(context.Background(), opts...)
+}
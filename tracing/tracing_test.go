@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const TRACE_ID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestSetupSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		ratio       float64
+		traceparent string
+		wantSampled bool
+	}{
+		{"new trace, all sampled", 1, "", true},
+		{"new trace, none sampled", 0, "", false},
+		{"caller sampled", 0, "00-" + TRACE_ID + "-00f067aa0ba902b7-01", true},
+		{"caller didn't sample", 1, "00-" + TRACE_ID + "-00f067aa0ba902b7-00", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := Setup("test", Config{Exporter: EXPORTER_NONE, SampleRatio: tt.ratio})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer shutdown(context.Background())
+
+			ctx := context.Background()
+
+			if tt.traceparent != "" {
+				ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier{"traceparent": tt.traceparent})
+			}
+
+			_, span := otel.Tracer("test").Start(ctx, "test")
+			defer span.End()
+
+			sc := span.SpanContext()
+
+			if sc.IsSampled() != tt.wantSampled {
+				t.Errorf("sampled = %t, want %t", sc.IsSampled(), tt.wantSampled)
+			}
+
+			// Spans in a trace that a caller started carry on with the caller's trace ID
+			if tt.traceparent != "" && sc.TraceID().String() != TRACE_ID {
+				t.Errorf("trace ID = %s, want %s", sc.TraceID(), TRACE_ID)
+			}
+		})
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	if _, err := Setup("test", Config{Exporter: "jaeger", SampleRatio: 1}); err == nil {
+		t.Error("Setup() with an unknown exporter succeeded")
+	}
+}
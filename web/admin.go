@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Holds every metric that the web service reports, along with the Go runtime's and the
+// process's own. Using a registry of our own instead of the global one means that only what's
+// registered here gets exported.
+var metricsRegistry = prometheus.NewRegistry()
+
+func registerMetrics() {
+	metricsRegistry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(os.Getpid(), ""))
+	metricsRegistry.MustRegister(httpRequestsCounter, httpDurationHistogram, httpResponseSizeHistogram, httpInFlightGauge)
+	metricsRegistry.MustRegister(endpointsGauge, endpointRequestsCounter, endpointInFlightGauge)
+	metricsRegistry.MustRegister(webSocketsGauge)
+	metricsRegistry.MustRegister(clientStartedCounter, clientHandledCounter, clientHandlingHistogram, clientMsgSentCounter, clientMsgReceivedCounter, connectivityGauge)
+}
+
+// The server for endpoints meant for operators, Prometheus, and Kubernetes rather than for
+// clients. It listens on its own port, which the ingress doesn't expose, so none of its requests
+// go through the authentication layer or show up in the request metrics. Profiling is only
+// served when enabled, since profiles expose memory contents and can be used to slow the
+// process down.
+func newAdminServer(port int, configHandler http.Handler, health *healthChecker, profiling bool) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	mux.HandleFunc("/healthz", health.handleHealthz)
+	mux.HandleFunc("/readyz", health.handleReadyz)
+
+	mux.Handle("/config", configHandler)
+
+	// Registered by hand, since importing net/http/pprof only adds them to the default mux
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+}
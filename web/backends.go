@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Checks whether a call to the given full method may go ahead
+type authorizeFunc func(ctx context.Context, method string) error
+
+// A gRPC service that the web service calls. Deadlines and retries are gRPC's own, set by the
+// backend's service config.
+type backend struct {
+	name          string
+	serviceConfig string
+	authorize     authorizeFunc
+}
+
+func newBackend(name, serviceConfigJSON, balancerSetting string, authorize authorizeFunc) (*backend, error) {
+	sc, err := serviceConfigWithBalancer(serviceConfigJSON, balancerNames[balancerSetting])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend{
+		name:          name,
+		serviceConfig: sc,
+		authorize:     authorize,
+	}, nil
+}
+
+// Checks and measures every call. gRPC retries calls below the interceptors, so a call counts
+// once however many attempts it takes.
+func (b *backend) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := b.authorize(ctx, method); err != nil {
+		return err
+	}
+
+	call := startCall(b.name, method, RPC_TYPE_UNARY)
+
+	err := invoker(forwardRequestID(ctx), method, req, reply, cc, opts...)
+
+	call.handled(err)
+
+	return err
+}
+
+// Checks streams and measures them from start to finish
+func (b *backend) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if err := b.authorize(ctx, method); err != nil {
+		return nil, err
+	}
+
+	ctx = forwardRequestID(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	call := startCall(b.name, method, rpcType(desc))
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+
+	if err != nil {
+		call.handled(err)
+		cancel()
+		return nil, err
+	}
+
+	s := &finishingStream{
+		ClientStream:  stream,
+		serverStreams: desc.ServerStreams,
+		cancel:        cancel,
+		call:          call,
+	}
+
+	// Streams that are abandoned before they finish, such as uploads cut short by a malformed
+	// body, end when their context does
+	go func() {
+		<-ctx.Done()
+		s.finish(ctx.Err())
+	}()
+
+	return s, nil
+}
+
+// Counts a stream's messages, and records how it went and releases its context as soon as it's
+// finished
+type finishingStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	cancel        context.CancelFunc
+	call          *callMetrics
+	once          sync.Once
+}
+
+func (s *finishingStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+
+	if err == nil {
+		s.call.sent()
+	}
+
+	return err
+}
+
+func (s *finishingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+
+	if err == nil {
+		s.call.received()
+	}
+
+	// Server streams end with an error (io.EOF when all went well) while client streams end
+	// with their single response
+	if err != nil || !s.serverStreams {
+		s.finish(err)
+	}
+
+	return err
+}
+
+func (s *finishingStream) finish(err error) {
+	s.once.Do(func() {
+		s.call.handled(err)
+		s.cancel()
+	})
+}
+
+// Connects to every endpoint of the backend, balancing calls across them and applying the
+// backend's service config to every call
+func (b *backend) dial(endpoints []string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	tracing := otelgrpc.WithSpanOptions(trace.WithAttributes(attribute.String("peer.service", b.name)))
+
+	opts = append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithAuthority(endpoints[0]),
+		grpc.WithDefaultServiceConfig(b.serviceConfig),
+		grpc.WithChainUnaryInterceptor(b.unaryInterceptor, otelgrpc.UnaryClientInterceptor(tracing)),
+		grpc.WithChainStreamInterceptor(b.streamInterceptor, otelgrpc.StreamClientInterceptor(tracing)),
+	}, opts...)
+
+	conn, err := grpc.Dial(backendTarget(b.name, endpoints), opts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	go watchConnectivity(b.name, conn)
+
+	return conn, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The scheme of the targets that backends are dialed with: "colossus://<backend>/<endpoints>",
+	// where the endpoints are a comma-separated list of host:port pairs
+	RESOLVER_SCHEME = "colossus"
+
+	// How long a single round of DNS lookups may take
+	RESOLVE_TIMEOUT = 5 * time.Second
+
+	// Values for a backend's balancer setting
+	BALANCER_ROUND_ROBIN   = "round_robin"
+	BALANCER_LEAST_REQUEST = "least_request"
+)
+
+// The names that the balancers are registered with gRPC under. These differ from the setting
+// values so that they don't replace gRPC's own round_robin balancer.
+var balancerNames = map[string]string{
+	BALANCER_ROUND_ROBIN:   "colossus_round_robin",
+	BALANCER_LEAST_REQUEST: "colossus_least_request",
+}
+
+// Looks up the addresses of an endpoint's host name. A variable so that tests can stand in for DNS.
+var lookupHost = net.DefaultResolver.LookupHost
+
+var (
+	endpointsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "web_svc_grpc_endpoints",
+			Help:        "The number of endpoints each backend currently resolves to",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend"},
+	)
+
+	endpointRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_grpc_endpoint_requests",
+			Help:        "gRPC calls to backends by backend, endpoint, and status code",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "endpoint", "code"},
+	)
+
+	endpointInFlightGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "web_svc_grpc_endpoint_in_flight",
+			Help:        "gRPC calls currently in flight by backend and endpoint",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "endpoint"},
+	)
+)
+
+// The metrics of one endpoint of a backend, which the resolver passes to the balancers in the
+// endpoint's address attributes. Calls can still be in flight on an endpoint when it goes away,
+// so once the resolver has dropped its metrics, those calls finishing mustn't bring them back.
+type endpointMetrics struct {
+	backend string
+	address string
+
+	mu      sync.RWMutex
+	removed bool
+}
+
+func (m *endpointMetrics) started() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.removed {
+		endpointInFlightGauge.WithLabelValues(m.backend, m.address).Inc()
+	}
+}
+
+func (m *endpointMetrics) finished(err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.removed {
+		endpointInFlightGauge.WithLabelValues(m.backend, m.address).Dec()
+		endpointRequestsCounter.WithLabelValues(m.backend, m.address, status.Code(err).String()).Inc()
+	}
+}
+
+// Drops the endpoint's series, so that every pod that has ever come and gone doesn't stay in
+// the metrics for as long as the web service runs
+func (m *endpointMetrics) remove() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removed = true
+
+	endpointInFlightGauge.DeleteLabelValues(m.backend, m.address)
+
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		endpointRequestsCounter.DeleteLabelValues(m.backend, m.address, code.String())
+	}
+}
+
+type endpointMetricsKey struct{}
+
+// The metrics that the resolver attached to an address
+func addressMetrics(addr resolver.Address) *endpointMetrics {
+	m, _ := addr.BalancerAttributes.Value(endpointMetricsKey{}).(*endpointMetrics)
+	return m
+}
+
+func init() {
+	balancer.Register(&balancerBuilder{name: balancerNames[BALANCER_ROUND_ROBIN]})
+	balancer.Register(&balancerBuilder{name: balancerNames[BALANCER_LEAST_REQUEST], leastRequest: true})
+}
+
+// The target to dial a backend with, which resolves to all of its endpoints
+func backendTarget(backend string, endpoints []string) string {
+	return fmt.Sprintf("%s://%s/%s", RESOLVER_SCHEME, backend, strings.Join(endpoints, ","))
+}
+
+// Resolves "colossus://" targets. Host names are looked up in DNS, which for a headless
+// Kubernetes service returns the address of every ready pod, and looked up again every interval
+// so that the backend's endpoints follow the pods as they come and go.
+type resolverBuilder struct {
+	interval time.Duration
+}
+
+func (b *resolverBuilder) Scheme() string {
+	return RESOLVER_SCHEME
+}
+
+func (b *resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	backend := target.URL.Host
+
+	if target.Endpoint() == "" {
+		return nil, fmt.Errorf("no endpoints given for backend %s", backend)
+	}
+
+	endpoints := strings.Split(target.Endpoint(), ",")
+
+	for _, endpoint := range endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q for backend %s: %v", endpoint, backend, err)
+		}
+	}
+
+	r := &endpointResolver{
+		backend:    backend,
+		endpoints:  endpoints,
+		interval:   b.interval,
+		cc:         cc,
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	go r.watch()
+
+	return r, nil
+}
+
+type endpointResolver struct {
+	backend    string
+	endpoints  []string
+	interval   time.Duration
+	cc         resolver.ClientConn
+	resolveNow chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// The addresses from the last successful resolution
+	addrs []string
+
+	// The metrics of each of those addresses. The same metrics are handed out for an address
+	// for as long as it's resolved, so that calls on its connection keep counting towards them.
+	metrics map[string]*endpointMetrics
+}
+
+func (r *endpointResolver) watch() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.resolve()
+
+		select {
+		case <-ticker.C:
+		case <-r.resolveNow:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *endpointResolver) resolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVE_TIMEOUT)
+	defer cancel()
+
+	seen := map[string]bool{}
+
+	var addrs []string
+
+	for _, endpoint := range r.endpoints {
+		host, port, _ := net.SplitHostPort(endpoint)
+
+		ips := []string{host}
+
+		if net.ParseIP(host) == nil {
+			var err error
+
+			ips, err = lookupHost(ctx, host)
+
+			if err != nil {
+				log.Printf("Could not resolve %s for backend %s: %v", host, r.backend, err)
+				continue
+			}
+		}
+
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, port)
+
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	// Keep using the last known endpoints rather than dropping every connection because DNS
+	// is having a bad moment
+	if len(addrs) == 0 {
+		return
+	}
+
+	sort.Strings(addrs)
+
+	if strings.Join(addrs, ",") == strings.Join(r.addrs, ",") {
+		return
+	}
+
+	metrics := make(map[string]*endpointMetrics, len(addrs))
+
+	for _, addr := range addrs {
+		m, ok := r.metrics[addr]
+
+		if !ok {
+			m = &endpointMetrics{backend: r.backend, address: addr}
+		}
+
+		metrics[addr] = m
+	}
+
+	for addr, m := range r.metrics {
+		if !seen[addr] {
+			m.remove()
+		}
+	}
+
+	log.Printf("Backend %s resolved to %d endpoints: %s", r.backend, len(addrs), strings.Join(addrs, ", "))
+
+	r.addrs = addrs
+	r.metrics = metrics
+
+	endpointsGauge.WithLabelValues(r.backend).Set(float64(len(addrs)))
+
+	resolved := make([]resolver.Address, len(addrs))
+
+	for i, addr := range addrs {
+		resolved[i] = resolver.Address{
+			Addr:               addr,
+			BalancerAttributes: attributes.New(endpointMetricsKey{}, metrics[addr]),
+		}
+	}
+
+	if err := r.cc.UpdateState(resolver.State{Addresses: resolved}); err != nil {
+		log.Printf("Could not update the endpoints of backend %s: %v", r.backend, err)
+	}
+}
+
+// gRPC asks for this when a connection fails, which usually means a pod has gone away
+func (r *endpointResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *endpointResolver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// Builds balancers that keep a connection to every endpoint of a backend and spread calls
+// across the ready ones, either in turn or by picking whichever of two random endpoints has
+// fewer calls in flight
+type balancerBuilder struct {
+	name         string
+	leastRequest bool
+}
+
+func (b *balancerBuilder) Name() string {
+	return b.name
+}
+
+func (b *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	// Each connection gets its own picker builder, so that in-flight counts carry over from one
+	// picker to the next as endpoints come and go
+	pb := &pickerBuilder{
+		leastRequest: b.leastRequest,
+		inFlight:     map[balancer.SubConn]*int64{},
+	}
+
+	return base.NewBalancerBuilder(b.name, pb, base.Config{}).Build(cc, opts)
+}
+
+type pickerBuilder struct {
+	leastRequest bool
+	inFlight     map[balancer.SubConn]*int64
+}
+
+type endpoint struct {
+	subConn  balancer.SubConn
+	metrics  *endpointMetrics
+	inFlight *int64
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	inFlight := map[balancer.SubConn]*int64{}
+
+	var endpoints []*endpoint
+
+	for sc, scInfo := range info.ReadySCs {
+		n, ok := b.inFlight[sc]
+
+		if !ok {
+			n = new(int64)
+		}
+
+		inFlight[sc] = n
+
+		endpoints = append(endpoints, &endpoint{
+			subConn:  sc,
+			metrics:  addressMetrics(scInfo.Address),
+			inFlight: n,
+		})
+	}
+
+	b.inFlight = inFlight
+
+	return &picker{
+		next:         uint64(rand.Intn(len(endpoints))),
+		endpoints:    endpoints,
+		leastRequest: b.leastRequest,
+	}
+}
+
+type picker struct {
+	// Kept first so that it's 64-bit aligned for atomic access
+	next uint64
+
+	endpoints    []*endpoint
+	leastRequest bool
+}
+
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	var e *endpoint
+
+	if p.leastRequest && len(p.endpoints) > 1 {
+		a := p.endpoints[rand.Intn(len(p.endpoints))]
+		b := p.endpoints[rand.Intn(len(p.endpoints))]
+
+		e = a
+
+		if atomic.LoadInt64(b.inFlight) < atomic.LoadInt64(a.inFlight) {
+			e = b
+		}
+	} else {
+		e = p.endpoints[atomic.AddUint64(&p.next, 1)%uint64(len(p.endpoints))]
+	}
+
+	atomic.AddInt64(e.inFlight, 1)
+	e.metrics.started()
+
+	done := func(info balancer.DoneInfo) {
+		atomic.AddInt64(e.inFlight, -1)
+		e.metrics.finished(info.Err)
+	}
+
+	return balancer.PickResult{SubConn: e.subConn, Done: done}, nil
+}
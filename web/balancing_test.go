@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/resolver"
+)
+
+// Records the addresses that a resolver hands to gRPC
+type fakeClientConn struct {
+	resolver.ClientConn
+
+	addrs []resolver.Address
+}
+
+func (c *fakeClientConn) UpdateState(state resolver.State) error {
+	c.addrs = state.Addresses
+	return nil
+}
+
+// The number of series that a collector currently exports
+func seriesCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+
+	c.Collect(ch)
+	close(ch)
+
+	return len(ch)
+}
+
+func TestEndpointMetricsFollowResolution(t *testing.T) {
+	cc := &fakeClientConn{}
+
+	r := &endpointResolver{
+		backend:   "test",
+		endpoints: []string{"10.0.0.1:8888", "10.0.0.2:8888"},
+		cc:        cc,
+	}
+
+	r.resolve()
+
+	if len(cc.addrs) != 2 {
+		t.Fatalf("resolved %d addresses, want 2", len(cc.addrs))
+	}
+
+	kept := addressMetrics(cc.addrs[0])
+	dropped := addressMetrics(cc.addrs[1])
+
+	kept.started()
+	kept.finished(nil)
+	dropped.started()
+	dropped.finished(errors.New("unavailable"))
+
+	// A call that's still in flight when its endpoint goes away
+	dropped.started()
+
+	inFlightBefore := seriesCount(endpointInFlightGauge)
+	requestsBefore := seriesCount(endpointRequestsCounter)
+
+	r.endpoints = []string{"10.0.0.1:8888", "10.0.0.3:8888"}
+	r.resolve()
+
+	if got := addressMetrics(cc.addrs[0]); got != kept {
+		t.Errorf("an endpoint that's still resolved was given new metrics")
+	}
+
+	dropped.finished(nil)
+
+	if got := seriesCount(endpointInFlightGauge); got != inFlightBefore-1 {
+		t.Errorf("%d in-flight series after dropping an endpoint, want %d", got, inFlightBefore-1)
+	}
+
+	if got := seriesCount(endpointRequestsCounter); got != requestsBefore-1 {
+		t.Errorf("%d request series after dropping an endpoint, want %d", got, requestsBefore-1)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The proxies, usually just the ingress, whose X-Forwarded-For and X-Real-IP headers are
+// believed. Anyone else could set those headers to whatever they like, for instance to get
+// around per-client throttling or to get someone else locked out.
+type trustedProxies []*net.IPNet
+
+// Parses a list of CIDR ranges and single addresses
+func parseTrustedProxies(specs []string) (trustedProxies, error) {
+	proxies := trustedProxies{}
+
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an IP address nor a CIDR range", spec)
+			}
+
+			bits := 8 * net.IPv4len
+
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(spec)
+
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR range", spec)
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (p trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The address of the client, as seen by the closest untrusted hop. X-Forwarded-For is read from
+// the right, skipping the trusted proxies that appended to it, since everything to the left of
+// the first untrusted address was written by the client.
+func (p trustedProxies) clientAddr(r *http.Request) string {
+	peer := clientIP(r)
+
+	if !p.trusts(peer) {
+		return peer
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			if !p.trusts(hop) || i == 0 {
+				return hop
+			}
+		}
+
+		return peer
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+
+	return peer
+}
+
+// Middleware that replaces the remote address with the client's, for requests that came
+// through a trusted proxy
+func (p trustedProxies) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = p.clientAddr(r)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the IP of the client that made the request. The realIP middleware has already
+// replaced the remote address with the one forwarded by a trusted proxy, if any.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		specs   []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "::1"}, false},
+		{[]string{"10.0.0.0/33"}, true},
+		{[]string{"ingress"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseTrustedProxies(tt.specs); (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, want error: %t", tt.specs, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4000", "", "", "203.0.113.7"},
+		{"untrusted peer's headers are ignored", "203.0.113.7:4000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:4000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed hops left of the client are skipped", "10.0.0.2:4000", "1.1.1.1, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:4000", "198.51.100.1, 10.0.0.3", "", "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.2:4000", "10.0.0.4, 10.0.0.3", "", "10.0.0.4"},
+		{"garbage hop", "10.0.0.2:4000", "198.51.100.1, nonsense", "", "10.0.0.2"},
+		{"real IP from trusted proxy", "10.0.0.2:4000", "", "198.51.100.1", "198.51.100.1"},
+		{"invalid real IP", "10.0.0.2:4000", "", "nonsense", "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := proxies.clientAddr(r); got != tt.want {
+				t.Errorf("clientAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Values for the type label of the client metrics
+const (
+	RPC_TYPE_UNARY = "unary"
+
+	RPC_TYPE_CLIENT_STREAM = "client_stream"
+
+	RPC_TYPE_SERVER_STREAM = "server_stream"
+
+	RPC_TYPE_BIDI_STREAM = "bidi_stream"
+)
+
+var (
+	clientStartedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_grpc_client_started",
+			Help:        "gRPC calls to backends started, by backend, method, and type",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "method", "type"},
+	)
+
+	clientHandledCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_grpc_client_handled",
+			Help:        "gRPC calls to backends finished, by backend, method, type, and status code",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "method", "type", "code"},
+	)
+
+	clientHandlingHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "web_svc_grpc_client_handling_seconds",
+			Help:        "How long gRPC calls to backends took, from start until the status was received, by backend, method, and type",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+			Buckets:     prometheus.DefBuckets,
+		},
+		[]string{"backend", "method", "type"},
+	)
+
+	clientMsgSentCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_grpc_client_msg_sent",
+			Help:        "Stream messages sent to backends, by backend and method",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "method"},
+	)
+
+	clientMsgReceivedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_grpc_client_msg_received",
+			Help:        "Stream messages received from backends, by backend and method",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "method"},
+	)
+
+	connectivityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "web_svc_grpc_connectivity_state",
+			Help:        "The connectivity state of each backend's connection: 1 for the current state and 0 for the others",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"backend", "state"},
+	)
+)
+
+var connectivityStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+func rpcType(desc *grpc.StreamDesc) string {
+	switch {
+	case desc.ClientStreams && desc.ServerStreams:
+		return RPC_TYPE_BIDI_STREAM
+	case desc.ClientStreams:
+		return RPC_TYPE_CLIENT_STREAM
+	default:
+		return RPC_TYPE_SERVER_STREAM
+	}
+}
+
+// The status code that a call ended with. io.EOF, which ends a stream that went well, is a
+// success, and calls given up on by the web service itself count as cancelled or timed out.
+func callCode(err error) codes.Code {
+	switch err {
+	case io.EOF:
+		return codes.OK
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	}
+
+	return status.Code(err)
+}
+
+// Records a single call in the client metrics
+type callMetrics struct {
+	backend string
+	method  string
+	rpcType string
+	start   time.Time
+}
+
+func startCall(backend, method, rpcType string) *callMetrics {
+	clientStartedCounter.WithLabelValues(backend, method, rpcType).Inc()
+
+	return &callMetrics{
+		backend: backend,
+		method:  method,
+		rpcType: rpcType,
+		start:   time.Now(),
+	}
+}
+
+func (m *callMetrics) sent() {
+	clientMsgSentCounter.WithLabelValues(m.backend, m.method).Inc()
+}
+
+func (m *callMetrics) received() {
+	clientMsgReceivedCounter.WithLabelValues(m.backend, m.method).Inc()
+}
+
+func (m *callMetrics) handled(err error) {
+	clientHandledCounter.WithLabelValues(m.backend, m.method, m.rpcType, callCode(err).String()).Inc()
+	clientHandlingHistogram.WithLabelValues(m.backend, m.method, m.rpcType).Observe(time.Since(m.start).Seconds())
+}
+
+// Keeps the backend's connectivity gauge up to date until the connection is closed
+func watchConnectivity(backend string, conn *grpc.ClientConn) {
+	state := conn.GetState()
+
+	for {
+		for _, s := range connectivityStates {
+			value := 0.0
+
+			if s == state {
+				value = 1
+			}
+
+			connectivityGauge.WithLabelValues(backend, s.String()).Set(value)
+		}
+
+		if state == connectivity.Shutdown || !conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+
+		state = conn.GetState()
+	}
+}
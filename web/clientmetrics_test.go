@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestCallCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{nil, codes.OK},
+		{io.EOF, codes.OK},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{status.Error(codes.NotFound, "gone"), codes.NotFound},
+		{io.ErrUnexpectedEOF, codes.Unknown},
+	}
+
+	for _, tt := range tests {
+		if got := callCode(tt.err); got != tt.want {
+			t.Errorf("callCode(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+// The client metrics of a single backend and method, to compare before and after a call
+type callCounts struct {
+	started, handled, handling, sent, received float64
+}
+
+func countCalls(t *testing.T, backend, method, rpcType string, code codes.Code) callCounts {
+	labels := prometheus.Labels{"backend": backend, "method": method, "type": rpcType}
+	handled := prometheus.Labels{"backend": backend, "method": method, "type": rpcType, "code": code.String()}
+	messages := prometheus.Labels{"backend": backend, "method": method}
+
+	return callCounts{
+		started:  metricValue(t, clientStartedCounter, labels),
+		handled:  metricValue(t, clientHandledCounter, handled),
+		handling: metricValue(t, clientHandlingHistogram, labels),
+		sent:     metricValue(t, clientMsgSentCounter, messages),
+		received: metricValue(t, clientMsgReceivedCounter, messages),
+	}
+}
+
+func (c callCounts) minus(o callCounts) callCounts {
+	return callCounts{c.started - o.started, c.handled - o.handled, c.handling - o.handling, c.sent - o.sent, c.received - o.received}
+}
+
+func allowAll(ctx context.Context, method string) error {
+	return nil
+}
+
+func TestUnaryInterceptorMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		authorize authorizeFunc
+		err       error
+		wantCode  codes.Code
+		want      callCounts
+	}{
+		{"succeeded", allowAll, nil, codes.OK, callCounts{started: 1, handled: 1, handling: 1}},
+		{"failed", allowAll, status.Error(codes.Unavailable, "down"), codes.Unavailable, callCounts{started: 1, handled: 1, handling: 1}},
+		{
+			// Calls that the web service refuses to make never reach the backend, so they aren't counted
+			"refused",
+			func(context.Context, string) error { return status.Error(codes.PermissionDenied, "no") },
+			nil,
+			codes.PermissionDenied,
+			callCounts{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backend{name: "unary-" + tt.name, authorize: tt.authorize}
+
+			before := countCalls(t, b.name, "/test.Service/Unary", RPC_TYPE_UNARY, tt.wantCode)
+
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return tt.err
+			}
+
+			err := b.unaryInterceptor(context.Background(), "/test.Service/Unary", nil, nil, nil, invoker)
+
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("unaryInterceptor() = %v, want %s", err, tt.wantCode)
+			}
+
+			if got := countCalls(t, b.name, "/test.Service/Unary", RPC_TYPE_UNARY, tt.wantCode).minus(before); got != tt.want {
+				t.Errorf("metrics changed by %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A stream that answers each RecvMsg with the next of a list of errors
+type fakeClientStream struct {
+	grpc.ClientStream
+
+	recv []error
+}
+
+func (s *fakeClientStream) SendMsg(m interface{}) error {
+	return nil
+}
+
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	err := s.recv[0]
+	s.recv = s.recv[1:]
+
+	return err
+}
+
+func TestStreamInterceptorMetrics(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	tests := []struct {
+		name     string
+		desc     *grpc.StreamDesc
+		rpcType  string
+		sends    int
+		recv     []error
+		wantCode codes.Code
+		want     callCounts
+	}{
+		{
+			"server stream",
+			&grpc.StreamDesc{ServerStreams: true},
+			RPC_TYPE_SERVER_STREAM,
+			0,
+			[]error{nil, nil, io.EOF},
+			codes.OK,
+			callCounts{started: 1, handled: 1, handling: 1, received: 2},
+		},
+		{
+			"failed server stream",
+			&grpc.StreamDesc{ServerStreams: true},
+			RPC_TYPE_SERVER_STREAM,
+			0,
+			[]error{nil, unavailable},
+			codes.Unavailable,
+			callCounts{started: 1, handled: 1, handling: 1, received: 1},
+		},
+		{
+			// Client streams finish with their single response
+			"client stream",
+			&grpc.StreamDesc{ClientStreams: true},
+			RPC_TYPE_CLIENT_STREAM,
+			3,
+			[]error{nil},
+			codes.OK,
+			callCounts{started: 1, handled: 1, handling: 1, sent: 3, received: 1},
+		},
+		{
+			"bidi stream",
+			&grpc.StreamDesc{ClientStreams: true, ServerStreams: true},
+			RPC_TYPE_BIDI_STREAM,
+			2,
+			[]error{nil, nil, io.EOF},
+			codes.OK,
+			callCounts{started: 1, handled: 1, handling: 1, sent: 2, received: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backend{name: "stream-" + tt.name, authorize: allowAll}
+
+			before := countCalls(t, b.name, "/test.Service/Stream", tt.rpcType, tt.wantCode)
+
+			streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return &fakeClientStream{recv: tt.recv}, nil
+			}
+
+			stream, err := b.streamInterceptor(context.Background(), tt.desc, nil, "/test.Service/Stream", streamer)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.sends; i++ {
+				if err := stream.SendMsg(nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for range tt.recv {
+				stream.RecvMsg(nil)
+			}
+
+			if got := countCalls(t, b.name, "/test.Service/Stream", tt.rpcType, tt.wantCode).minus(before); got != tt.want {
+				t.Errorf("metrics changed by %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Streams that are given up on before they finish count as cancelled, once
+func TestAbandonedStreamMetrics(t *testing.T) {
+	b := &backend{name: "abandoned", authorize: allowAll}
+
+	before := countCalls(t, b.name, "/test.Service/Stream", RPC_TYPE_CLIENT_STREAM, codes.Canceled)
+
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := b.streamInterceptor(ctx, &grpc.StreamDesc{ClientStreams: true}, nil, "/test.Service/Stream", streamer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.SendMsg(nil)
+
+	cancel()
+
+	want := callCounts{started: 1, handled: 1, handling: 1, sent: 1}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		got := countCalls(t, b.name, "/test.Service/Stream", RPC_TYPE_CLIENT_STREAM, codes.Canceled).minus(before)
+
+		if got == want {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics changed by %+v, want %+v", got, want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchConnectivity(t *testing.T) {
+	conn, err := grpc.Dial("passthrough:///localhost:1", grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watched := make(chan struct{})
+
+	go func() {
+		defer close(watched)
+
+		watchConnectivity("watched", conn)
+	}()
+
+	// Exactly one state is current at a time
+	current := func() []string {
+		var states []string
+
+		for _, s := range connectivityStates {
+			if metricValue(t, connectivityGauge, prometheus.Labels{"backend": "watched", "state": s.String()}) == 1 {
+				states = append(states, s.String())
+			}
+		}
+
+		return states
+	}
+
+	conn.Close()
+
+	select {
+	case <-watched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchConnectivity() didn't return once the connection was closed")
+	}
+
+	if got := current(); len(got) != 1 || got[0] != connectivity.Shutdown.String() {
+		t.Errorf("current states = %v, want only %s", got, connectivity.Shutdown)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lucperkins/colossus/config"
+	"github.com/lucperkins/colossus/tracing"
+	"google.golang.org/grpc"
+)
+
+type (
+	Config struct {
+		Port int `mapstructure:"port"`
+
+		// The port for metrics, health checks, profiling, and the effective config, which isn't
+		// exposed by the ingress
+		AdminPort int `mapstructure:"admin_port"`
+
+		// Whether the admin port also serves net/http/pprof's profiles
+		Pprof bool `mapstructure:"pprof"`
+
+		// The addresses and CIDR ranges of the proxies in front of the web service, whose
+		// X-Forwarded-For and X-Real-IP headers are believed
+		TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+		// Shared with the auth service, which requires it for account and API key RPCs
+		ServiceToken string `mapstructure:"service_token"`
+
+		AuthService BackendConfig `mapstructure:"auth_service"`
+
+		DataService BackendConfig `mapstructure:"data_service"`
+
+		UserInfoService BackendConfig `mapstructure:"userinfo_service"`
+
+		// How often backend host names are looked up again to pick up new or removed endpoints
+		ResolveInterval time.Duration `mapstructure:"resolve_interval"`
+
+		// How long the auth service's answer to whether a principal has a permission is reused.
+		// Role changes take up to this long to take effect.
+		PermissionCacheTTL time.Duration `mapstructure:"permission_cache_ttl"`
+
+		// The largest item, in bytes, and the most items that PUT /stream accepts
+		MaxUploadItemSize int `mapstructure:"max_upload_item_size"`
+
+		MaxUploadItems int `mapstructure:"max_upload_items"`
+
+		// How long to keep serving after failing the readiness probe on shutdown, before
+		// draining. Kubernetes only stops routing requests here once the probe has failed
+		// failureThreshold times in a row, so this needs to be at least the probe's period times
+		// its failureThreshold.
+		ReadinessGracePeriod time.Duration `mapstructure:"readiness_grace_period"`
+
+		// How long in-flight requests get to finish on shutdown. Added to the readiness grace
+		// period, this needs to be shorter than the pod's termination grace period, after which
+		// Kubernetes kills the process outright.
+		ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+		Tracing tracing.Config `mapstructure:"tracing"`
+	}
+
+	// Where to reach one of the gRPC services behind the web service
+	BackendConfig struct {
+		Host string `mapstructure:"host"`
+
+		Port int `mapstructure:"port"`
+
+		// A static list of host:port endpoints to use instead of host and port
+		Endpoints []string `mapstructure:"endpoints"`
+
+		// How calls are spread across the endpoints: round_robin or least_request
+		Balancer string `mapstructure:"balancer"`
+
+		// Per-method deadlines and retry policies, in the gRPC service config JSON format
+		ServiceConfig string `mapstructure:"service_config"`
+
+		// Whether readiness also depends on the backend's grpc.health.v1.Health service, which
+		// not every backend implements
+		HealthCheck bool `mapstructure:"health_check"`
+	}
+)
+
+var settings = append([]config.Setting{
+	{Key: "port", Default: PORT, Usage: "The port the HTTP server listens on"},
+	{Key: "admin_port", Default: ADMIN_PORT, Usage: "The port for metrics, health checks, profiling, and the effective config"},
+	{Key: "pprof", Default: false, Usage: "Serve net/http/pprof's profiles on the admin port"},
+	{Key: "trusted_proxies", Default: []string{}, Usage: "The addresses and CIDR ranges of the proxies whose forwarded client IPs are believed"},
+	{Key: "service_token", Default: "", Usage: "The token shared with the auth service, which account and API key RPCs require", Secret: true},
+	{Key: "auth_service.host", Default: "colossus-auth-svc", Usage: "The host of the auth service"},
+	{Key: "auth_service.port", Default: 8888, Usage: "The port of the auth service"},
+	{Key: "auth_service.endpoints", Default: []string{}, Usage: "A static list of host:port endpoints of the auth service to use instead of its host and port"},
+	{Key: "auth_service.balancer", Default: BALANCER_ROUND_ROBIN, Usage: "How calls are spread across the auth service's endpoints: round_robin or least_request"},
+	{Key: "auth_service.service_config", Default: AUTH_SERVICE_CONFIG, Usage: "Deadlines and retry policies for calls to the auth service"},
+	{Key: "auth_service.health_check", Default: true, Usage: "Whether readiness also checks the auth service's gRPC health service"},
+	{Key: "data_service.host", Default: "colossus-data-svc", Usage: "The host of the data service"},
+	{Key: "data_service.port", Default: 1111, Usage: "The port of the data service"},
+	{Key: "data_service.endpoints", Default: []string{}, Usage: "A static list of host:port endpoints of the data service to use instead of its host and port"},
+	{Key: "data_service.balancer", Default: BALANCER_ROUND_ROBIN, Usage: "How calls are spread across the data service's endpoints: round_robin or least_request"},
+	{Key: "data_service.service_config", Default: DATA_SERVICE_CONFIG, Usage: "Deadlines and retry policies for calls to the data service"},
+	{Key: "data_service.health_check", Default: false, Usage: "Whether readiness also checks the data service's gRPC health service"},
+	{Key: "userinfo_service.host", Default: "colossus-userinfo-svc", Usage: "The host of the userinfo service"},
+	{Key: "userinfo_service.port", Default: 7777, Usage: "The port of the userinfo service"},
+	{Key: "userinfo_service.endpoints", Default: []string{}, Usage: "A static list of host:port endpoints of the userinfo service to use instead of its host and port"},
+	{Key: "userinfo_service.balancer", Default: BALANCER_ROUND_ROBIN, Usage: "How calls are spread across the userinfo service's endpoints: round_robin or least_request"},
+	{Key: "userinfo_service.service_config", Default: USERINFO_SERVICE_CONFIG, Usage: "Deadlines and retry policies for calls to the userinfo service"},
+	{Key: "userinfo_service.health_check", Default: false, Usage: "Whether readiness also checks the userinfo service's gRPC health service"},
+	{Key: "resolve_interval", Default: 30 * time.Second, Usage: "How often backend host names are looked up again"},
+	{Key: "permission_cache_ttl", Default: 5 * time.Second, Usage: "How long to reuse the auth service's answer to whether a principal has a permission (0 to always ask)"},
+	{Key: "max_upload_item_size", Default: MAX_UPLOAD_ITEM_SIZE, Usage: "The largest item, in bytes, that PUT /stream accepts"},
+	{Key: "max_upload_items", Default: MAX_UPLOAD_ITEMS, Usage: "The most items that PUT /stream accepts at once"},
+	{Key: "readiness_grace_period", Default: 15 * time.Second, Usage: "How long to keep serving after failing the readiness probe on shutdown, before draining"},
+	{Key: "shutdown_timeout", Default: 25 * time.Second, Usage: "How long in-flight requests get to finish on shutdown"},
+}, tracing.Settings...)
+
+func (b BackendConfig) validate(problems *config.Problems, key string) {
+	problems.NonEmpty(key+".host", b.Host)
+	problems.Port(key+".port", b.Port)
+
+	for _, endpoint := range b.Endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			problems.Add(key+".endpoints", "%q is not a host:port pair", endpoint)
+		}
+	}
+
+	problems.OneOf(key+".balancer", b.Balancer, BALANCER_ROUND_ROBIN, BALANCER_LEAST_REQUEST)
+
+	if _, err := serviceConfigWithBalancer(b.ServiceConfig, balancerNames[b.Balancer]); err != nil {
+		problems.Add(key+".service_config", "%v", err)
+	}
+}
+
+func (c *Config) Validate() error {
+	var problems config.Problems
+
+	problems.Port("port", c.Port)
+	problems.Port("admin_port", c.AdminPort)
+	problems.NonEmpty("service_token", c.ServiceToken)
+	c.AuthService.validate(&problems, "auth_service")
+	c.DataService.validate(&problems, "data_service")
+	c.UserInfoService.validate(&problems, "userinfo_service")
+	problems.PositiveDuration("resolve_interval", c.ResolveInterval)
+	problems.NonNegativeDuration("permission_cache_ttl", c.PermissionCacheTTL)
+	problems.Positive("max_upload_item_size", c.MaxUploadItemSize)
+	problems.Positive("max_upload_items", c.MaxUploadItems)
+	problems.NonNegativeDuration("readiness_grace_period", c.ReadinessGracePeriod)
+	problems.PositiveDuration("shutdown_timeout", c.ShutdownTimeout)
+	c.Tracing.Validate(&problems)
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		problems.Add("trusted_proxies", "%v", err)
+	}
+
+	if c.Port == c.AdminPort {
+		problems.Add("admin_port", "must differ from port")
+	}
+
+	return problems.Err()
+}
+
+// The endpoints to balance calls across: the static list if there is one, otherwise every
+// address that the host resolves to
+func (b BackendConfig) endpoints() []string {
+	if len(b.Endpoints) > 0 {
+		return b.Endpoints
+	}
+
+	return []string{net.JoinHostPort(b.Host, strconv.Itoa(b.Port))}
+}
+
+// Connects to the backend with its balancer, deadlines, and retry policies applied, with every
+// call checked by authorize first
+func (b BackendConfig) dial(name string, authorize authorizeFunc, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	be, err := newBackend(name, b.ServiceConfig, b.Balancer, authorize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return be.dial(b.endpoints(), opts...)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/lucperkins/colossus/proto/auth"
+	"github.com/lucperkins/colossus/proto/data"
+	"github.com/lucperkins/colossus/proto/userinfo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type permission struct {
+	action   string
+	resource string
+}
+
+// The permission that each RPC exposed through the gateway requires, keyed by full method name.
+// A nil permission means that any authenticated principal may make the call. RPCs that have an
+// HTTP annotation but aren't listed here are refused, so exposing a new RPC takes an annotation
+// in its proto and a line here, but no handler. The auth service checks the permissions of its
+// own account and API key RPCs again, since it can be reached without going through here.
+var gatewayPermissions = map[string]*permission{
+	"/auth.AuthService/PublicKey":      nil,
+	"/auth.AuthService/UnlockAccount":  {"write", "accounts"},
+	"/auth.ApiKeyService/CreateApiKey": {"write", "apikeys"},
+	"/auth.ApiKeyService/ListApiKeys":  {"read", "apikeys"},
+	"/auth.ApiKeyService/ScopeApiKey":  {"write", "apikeys"},
+	"/auth.ApiKeyService/RotateApiKey": {"write", "apikeys"},
+	"/auth.ApiKeyService/RevokeApiKey": {"write", "apikeys"},
+	"/data.DataService/Get":            {"read", "data"},
+	"/data.DataService/StreamingGet":   {"read", "data"},
+	"/data.DataService/StreamingPut":   {"write", "data"},
+	"/userinfo.UserInfo/GetUserInfo":   {"read", "userinfo"},
+}
+
+// Marks calls that come in through the gateway, which are the only ones that the gateway's
+// permission checks apply to
+type gatewayCallKey struct{}
+
+// Serves the RPCs of every backend as REST/JSON, using the routes that their protos' google.api.http
+// annotations declare. The mapping from requests to RPCs is generated by protoc-gen-grpc-gateway.
+type gateway struct {
+	mux         *runtime.ServeMux
+	permissions *permissionCache
+}
+
+func newGateway() *gateway {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{OrigName: true, EmitDefaults: true}),
+
+		// Credentials and other request headers are for the web service, not the backends
+		runtime.WithIncomingHeaderMatcher(func(string) (string, bool) {
+			return "", false
+		}),
+	)
+
+	// Errors from the gateway look the same as the rest of the web service's
+	runtime.HTTPError = func(_ context.Context, _ *runtime.ServeMux, _ runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+		writeError(w, r, err)
+	}
+
+	runtime.OtherErrorHandler = func(w http.ResponseWriter, r *http.Request, message string, code int) {
+		writeError(w, r, newProblem(code, statusCode(code), "%s", message))
+	}
+
+	return &gateway{mux: mux}
+}
+
+// Adds the routes of every backend. The permission checks need the auth service, so this has to
+// happen once all of the backends have been dialed.
+func (g *gateway) register(ctx context.Context, permissions *permissionCache, authConn, dataConn, userInfoConn *grpc.ClientConn) error {
+	g.permissions = permissions
+
+	registrations := []struct {
+		register func(context.Context, *runtime.ServeMux, *grpc.ClientConn) error
+		conn     *grpc.ClientConn
+	}{
+		{auth.RegisterAuthServiceHandler, authConn},
+		{auth.RegisterApiKeyServiceHandler, authConn},
+		{data.RegisterDataServiceHandler, dataConn},
+		{userinfo.RegisterUserInfoHandler, userInfoConn},
+	}
+
+	for _, r := range registrations {
+		if err := r.register(ctx, g.mux, r.conn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), gatewayCallKey{}, true)
+
+	g.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Checks that the principal may make a call that came in through the gateway. The generated
+// gateway code calls the backends directly, so this runs as part of every backend's client
+// interceptors, where the method being called is known.
+func (g *gateway) authorize(ctx context.Context, method string) error {
+	if viaGateway, _ := ctx.Value(gatewayCallKey{}).(bool); !viaGateway {
+		return nil
+	}
+
+	perm, ok := gatewayPermissions[method]
+
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s isn't available through the gateway", method)
+	}
+
+	if perm == nil {
+		return nil
+	}
+
+	// The Authorize call itself goes through the auth backend's interceptors, so it must not be
+	// checked in turn
+	ctx = context.WithValue(ctx, gatewayCallKey{}, false)
+
+	allowed, err := g.permissions.allowed(ctx, principal(ctx), *perm)
+
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return status.Error(codes.PermissionDenied, "You are not allowed to access this resource")
+	}
+
+	return nil
+}
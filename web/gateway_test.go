@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Records whether the Authorize call was still marked as a gateway call, which would have the
+// auth backend's interceptors check it in turn
+type gatewayMarkRecorder struct {
+	*fakeRoleService
+
+	markedCalls int
+}
+
+func (s *gatewayMarkRecorder) Authorize(ctx context.Context, req *auth.AuthorizeRequest, opts ...grpc.CallOption) (*auth.AuthorizeResponse, error) {
+	if viaGateway, _ := ctx.Value(gatewayCallKey{}).(bool); viaGateway {
+		s.markedCalls++
+	}
+
+	return s.fakeRoleService.Authorize(ctx, req, opts...)
+}
+
+func TestGatewayAuthorize(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		principal   string
+		viaGateway  bool
+		unavailable bool
+		want        codes.Code
+		wantCalls   int
+	}{
+		{"allowed", "/data.DataService/Get", "tony", true, false, codes.OK, 1},
+		{"denied", "/data.DataService/StreamingPut", "tony", true, false, codes.PermissionDenied, 1},
+		{"another principal", "/data.DataService/Get", "alice", true, false, codes.PermissionDenied, 1},
+		{"auth unavailable", "/data.DataService/Get", "tony", true, true, codes.Unavailable, 1},
+		{"open to any principal", "/auth.AuthService/PublicKey", "tony", true, false, codes.OK, 0},
+		{"not exposed", "/auth.AuthService/Authenticate", "tony", true, false, codes.PermissionDenied, 0},
+
+		// Calls that the web service makes itself are checked by the routes that make them
+		{"not through the gateway", "/data.DataService/StreamingPut", "tony", false, false, codes.OK, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles := &gatewayMarkRecorder{
+				fakeRoleService: &fakeRoleService{granted: map[string]bool{"tony read:data": true}},
+			}
+
+			if tt.unavailable {
+				roles.err = status.Error(codes.Unavailable, "auth is down")
+			}
+
+			g := newGateway()
+
+			g.permissions = newPermissionCache(roles, 0)
+
+			ctx := context.WithValue(context.Background(), principalContextKey, tt.principal)
+			ctx = context.WithValue(ctx, gatewayCallKey{}, tt.viaGateway)
+
+			err := g.authorize(ctx, tt.method)
+
+			if status.Code(err) != tt.want {
+				t.Errorf("authorize(%s) = %v, want %s", tt.method, err, tt.want)
+			}
+
+			if roles.calls != tt.wantCalls {
+				t.Errorf("%d calls to Authorize, want %d", roles.calls, tt.wantCalls)
+			}
+
+			if roles.markedCalls != 0 {
+				t.Error("Authorize was called as a gateway call")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// How long a backend gets to answer a health check before it counts as not ready
+const HEALTH_CHECK_TIMEOUT = time.Second
+
+// A backend that the web service calls
+type dependency struct {
+	name string
+	conn *grpc.ClientConn
+
+	// Whether the web service can't serve anything without the backend. Backends that only some
+	// routes need leave the web service degraded rather than unready when they're unavailable.
+	required bool
+
+	// Whether to call the backend's grpc.health.v1.Health service as well as looking at the
+	// connection's state
+	healthCheck bool
+}
+
+type (
+	dependencyStatus struct {
+		Ready    bool   `json:"ready"`
+		Required bool   `json:"required"`
+		State    string `json:"state"`
+
+		// The backend's own health status, for backends that are health checked
+		Health string `json:"health,omitempty"`
+
+		Error string `json:"error,omitempty"`
+	}
+
+	readiness struct {
+		Ready bool `json:"ready"`
+
+		// Whether a backend that isn't required is unavailable, which fails only the routes that
+		// need it
+		Degraded bool `json:"degraded"`
+
+		ShuttingDown      bool                         `json:"shutting_down,omitempty"`
+		RevocationsLoaded bool                         `json:"revocations_loaded"`
+		Dependencies      map[string]*dependencyStatus `json:"dependencies"`
+	}
+)
+
+// Reports whether the web service can serve requests, which means that it isn't shutting down,
+// that it has the token revocation list and that its required backends can be reached. Dialing
+// doesn't wait for connections to be made, so this is the only way to tell that the backends are
+// actually there. Taking every replica out of rotation because of a backend that only some routes
+// need would fail all of the other routes as well, so other backends are only reported.
+type healthChecker struct {
+	dependencies      []dependency
+	revocationsLoaded func() bool
+
+	mu           sync.RWMutex
+	shuttingDown bool
+}
+
+func newHealthChecker(dependencies []dependency, revocationsLoaded func() bool) *healthChecker {
+	return &healthChecker{
+		dependencies:      dependencies,
+		revocationsLoaded: revocationsLoaded,
+	}
+}
+
+// Fails the readiness probe from now on, so that Kubernetes stops sending new requests. The
+// liveness probe keeps passing, since failing it would get the pod killed before it has drained.
+func (h *healthChecker) shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.shuttingDown = true
+}
+
+func (h *healthChecker) isShuttingDown() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.shuttingDown
+}
+
+// A backend is ready once its connection is, and once it reports SERVING if it's health checked
+func (h *healthChecker) check(ctx context.Context, dep dependency) *dependencyStatus {
+	state := dep.conn.GetState()
+
+	status := &dependencyStatus{
+		Ready:    state == connectivity.Ready,
+		Required: dep.required,
+		State:    state.String(),
+	}
+
+	if !dep.healthCheck {
+		return status
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+
+	defer cancel()
+
+	res, err := healthpb.NewHealthClient(dep.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+
+	if err != nil {
+		status.Ready = false
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Health = res.Status.String()
+
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		status.Ready = false
+	}
+
+	return status
+}
+
+// Checks every backend at once, so that one that's slow to answer doesn't hold up the rest
+func (h *healthChecker) readiness(ctx context.Context) *readiness {
+	statuses := make([]*dependencyStatus, len(h.dependencies))
+
+	var wg sync.WaitGroup
+
+	for i, dep := range h.dependencies {
+		wg.Add(1)
+
+		go func(i int, dep dependency) {
+			defer wg.Done()
+
+			statuses[i] = h.check(ctx, dep)
+		}(i, dep)
+	}
+
+	wg.Wait()
+
+	shuttingDown := h.isShuttingDown()
+	revocationsLoaded := h.revocationsLoaded()
+
+	res := &readiness{
+		Ready:             !shuttingDown && revocationsLoaded,
+		ShuttingDown:      shuttingDown,
+		RevocationsLoaded: revocationsLoaded,
+		Dependencies:      make(map[string]*dependencyStatus),
+	}
+
+	for i, dep := range h.dependencies {
+		res.Dependencies[dep.name] = statuses[i]
+
+		switch {
+		case statuses[i].Ready:
+		case dep.required:
+			res.Ready = false
+		default:
+			res.Degraded = true
+		}
+	}
+
+	return res
+}
+
+// The liveness probe passes as long as the server answers. Neither unreachable backends nor
+// shutting down are something that restarting the web service would fix.
+func (h *healthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// The readiness probe, which reports the status of each backend as JSON and fails with a 503
+// unless the web service is ready
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res := h.readiness(r.Context())
+
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
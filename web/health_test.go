@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Starts a gRPC server that reports the given health status, and returns a connection to it that
+// is ready
+func healthyBackend(t *testing.T, serving healthpb.HealthCheckResponse_ServingStatus) *grpc.ClientConn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", serving)
+
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	go server.Serve(listener)
+
+	t.Cleanup(server.Stop)
+
+	conn := dialBackend(t, listener.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn.Connect()
+
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			t.Fatalf("the connection to the backend never became ready")
+		}
+	}
+
+	return conn
+}
+
+// A connection to a backend that isn't there. It's never used, so it stays idle.
+func missingBackend(t *testing.T) *grpc.ClientConn {
+	return dialBackend(t, "127.0.0.1:1")
+}
+
+func dialBackend(t *testing.T, addr string) *grpc.ClientConn {
+	conn, err := grpc.Dial("passthrough:///"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestReadiness(t *testing.T) {
+	const (
+		UP          = "up"
+		DOWN        = "down"
+		NOT_SERVING = "not serving"
+	)
+
+	tests := []struct {
+		name              string
+		auth              string
+		data              string
+		userinfo          string
+		revocationsLoaded bool
+		shuttingDown      bool
+		wantStatus        int
+		wantReady         bool
+		wantDegraded      bool
+	}{
+		{"everything up", UP, UP, UP, true, false, http.StatusOK, true, false},
+		{"data down", UP, DOWN, UP, true, false, http.StatusOK, true, true},
+		{"data and userinfo down", UP, DOWN, DOWN, true, false, http.StatusOK, true, true},
+		{"auth down", DOWN, UP, UP, true, false, http.StatusServiceUnavailable, false, false},
+		{"auth not serving", NOT_SERVING, UP, UP, true, false, http.StatusServiceUnavailable, false, false},
+		{"everything down", DOWN, DOWN, DOWN, true, false, http.StatusServiceUnavailable, false, true},
+		{"revocations not loaded", UP, UP, UP, false, false, http.StatusServiceUnavailable, false, false},
+		{"shutting down", UP, UP, UP, true, true, http.StatusServiceUnavailable, false, false},
+	}
+
+	backend := func(t *testing.T, state string) *grpc.ClientConn {
+		switch state {
+		case UP:
+			return healthyBackend(t, healthpb.HealthCheckResponse_SERVING)
+		case NOT_SERVING:
+			return healthyBackend(t, healthpb.HealthCheckResponse_NOT_SERVING)
+		default:
+			return missingBackend(t)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthChecker([]dependency{
+				{name: "auth", conn: backend(t, tt.auth), healthCheck: true, required: true},
+				{name: "data", conn: backend(t, tt.data)},
+				{name: "userinfo", conn: backend(t, tt.userinfo)},
+			}, func() bool { return tt.revocationsLoaded })
+
+			if tt.shuttingDown {
+				h.shutdown()
+			}
+
+			w := httptest.NewRecorder()
+
+			h.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			var res readiness
+
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Ready != tt.wantReady || res.Degraded != tt.wantDegraded {
+				t.Errorf("ready = %t, degraded = %t, want %t, %t", res.Ready, res.Degraded, tt.wantReady, tt.wantDegraded)
+			}
+
+			if res.ShuttingDown != tt.shuttingDown || res.RevocationsLoaded != tt.revocationsLoaded {
+				t.Errorf("shutting down = %t, revocations loaded = %t, want %t, %t",
+					res.ShuttingDown, res.RevocationsLoaded, tt.shuttingDown, tt.revocationsLoaded)
+			}
+
+			// Every backend is described, whether or not it counts towards readiness
+			for name, state := range map[string]string{"auth": tt.auth, "data": tt.data, "userinfo": tt.userinfo} {
+				dep, ok := res.Dependencies[name]
+
+				if !ok {
+					t.Errorf("%s isn't described", name)
+					continue
+				}
+
+				if dep.Ready != (state == UP) {
+					t.Errorf("%s ready = %t, want %t", name, dep.Ready, state == UP)
+				}
+
+				if dep.Required != (name == "auth") {
+					t.Errorf("%s required = %t", name, dep.Required)
+				}
+			}
+
+			if health := res.Dependencies["auth"].Health; tt.auth != DOWN && health != map[string]string{UP: "SERVING", NOT_SERVING: "NOT_SERVING"}[tt.auth] {
+				t.Errorf("auth health = %q", health)
+			}
+		})
+	}
+}
+
+// Liveness doesn't depend on anything, since restarting wouldn't fix any of it
+func TestLiveness(t *testing.T) {
+	h := newHealthChecker([]dependency{
+		{name: "auth", conn: missingBackend(t), required: true},
+	}, func() bool { return false })
+
+	h.shutdown()
+
+	w := httptest.NewRecorder()
+
+	h.handleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("liveness = %d %q, want 200 ok", w.Code, w.Body)
+	}
+}
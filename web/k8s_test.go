@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const K8S_MANIFEST = "../k8s/colossus.yaml"
+
+// The parts of a Kubernetes object that decide which pods a service's DNS name resolves to
+type k8sObject struct {
+	Kind     string
+	Metadata struct {
+		Name string
+	}
+	Spec struct {
+		ClusterIP string `yaml:"clusterIP"`
+		Replicas  int
+
+		// A Service's selector is a set of labels; a Deployment's is the labels under matchLabels
+		Selector map[string]interface{}
+		Template struct {
+			Metadata struct {
+				Labels map[string]string
+			}
+			Spec struct {
+				Containers []struct {
+					Env []struct {
+						Name  string
+						Value string
+					}
+				}
+			}
+		}
+	}
+}
+
+type k8sPod struct {
+	deployment string
+	ip         string
+	labels     map[string]string
+}
+
+func (p k8sPod) selectedBy(selector map[string]interface{}) bool {
+	for k, v := range selector {
+		if p.labels[k] != fmt.Sprint(v) {
+			return false
+		}
+	}
+
+	return len(selector) > 0
+}
+
+func loadK8sManifest(t *testing.T, path string) []k8sObject {
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var objects []k8sObject
+
+	dec := yaml.NewDecoder(f)
+
+	for {
+		var obj k8sObject
+
+		err := dec.Decode(&obj)
+
+		if err == io.EOF {
+			return objects
+		}
+
+		if err != nil {
+			t.Fatalf("parsing %s: %v", path, err)
+		}
+
+		objects = append(objects, obj)
+	}
+}
+
+// Deploys the manifest onto a pretend cluster and checks that the headless service that the web
+// service is pointed at for each backend resolves to that backend's pods and nothing else
+func TestHeadlessServicesResolveToTheirBackend(t *testing.T) {
+	objects := loadK8sManifest(t, K8S_MANIFEST)
+
+	var (
+		pods     []k8sPod
+		headless = map[string]map[string]interface{}{}
+		replicas = map[string]int{}
+		webEnv   = map[string]string{}
+	)
+
+	for i, obj := range objects {
+		switch {
+		case obj.Kind == "Deployment":
+			labels := obj.Spec.Template.Metadata.Labels
+
+			for n := 0; n < obj.Spec.Replicas; n++ {
+				ip := fmt.Sprintf("10.0.%d.%d", i, n+1)
+				pods = append(pods, k8sPod{deployment: obj.Metadata.Name, ip: ip, labels: labels})
+			}
+
+			replicas[obj.Metadata.Name] = obj.Spec.Replicas
+
+			if matchLabels, ok := obj.Spec.Selector["matchLabels"].(map[interface{}]interface{}); ok {
+				for k, v := range matchLabels {
+					if labels[fmt.Sprint(k)] != fmt.Sprint(v) {
+						t.Errorf("deployment %s doesn't select its own pods", obj.Metadata.Name)
+					}
+				}
+			}
+
+			if obj.Metadata.Name == "colossus-web-deployment" {
+				for _, c := range obj.Spec.Template.Spec.Containers {
+					for _, env := range c.Env {
+						webEnv[env.Name] = env.Value
+					}
+				}
+			}
+		case obj.Kind == "Service" && obj.Spec.ClusterIP == "None":
+			headless[obj.Metadata.Name] = obj.Spec.Selector
+		}
+	}
+
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupHost = orig }(lookupHost)
+
+	// Cluster DNS: a headless service's name resolves to the address of every pod it selects
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		selector, ok := headless[host]
+
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		var ips []string
+
+		for _, pod := range pods {
+			if pod.selectedBy(selector) {
+				ips = append(ips, pod.ip)
+			}
+		}
+
+		return ips, nil
+	}
+
+	for _, backend := range []string{"auth", "data", "userinfo"} {
+		t.Run(backend, func(t *testing.T) {
+			prefix := strings.ToUpper(backend) + "_SERVICE_"
+
+			port, err := strconv.Atoi(webEnv[prefix+"PORT"])
+
+			if err != nil {
+				t.Fatalf("%sPORT: %v", prefix, err)
+			}
+
+			cfg := BackendConfig{Host: webEnv[prefix+"HOST"], Port: port}
+
+			cc := &fakeClientConn{}
+
+			r := &endpointResolver{
+				backend:   backend,
+				endpoints: cfg.endpoints(),
+				cc:        cc,
+			}
+
+			r.resolve()
+
+			deployment := "colossus-" + backend + "-deployment"
+
+			if len(cc.addrs) != replicas[deployment] {
+				t.Errorf("%s resolved to %d endpoints, want the %d pods of %s",
+					cfg.Host, len(cc.addrs), replicas[deployment], deployment)
+			}
+
+			for _, addr := range cc.addrs {
+				host, _, _ := net.SplitHostPort(addr.Addr)
+
+				for _, pod := range pods {
+					if pod.ip == host && pod.deployment != deployment {
+						t.Errorf("%s resolved to %s, a pod of %s", cfg.Host, addr.Addr, pod.deployment)
+					}
+				}
+			}
+		})
+	}
+}
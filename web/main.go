@@ -2,165 +2,492 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/caarlos0/env"
-	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/lucperkins/colossus/config"
 	"github.com/lucperkins/colossus/proto/auth"
 	"github.com/lucperkins/colossus/proto/data"
 	"github.com/lucperkins/colossus/proto/userinfo"
+	"github.com/lucperkins/colossus/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/unrolled/render"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
 )
 
 const (
+	// The default for the port setting
 	PORT = 3000
+
+	// The default for the admin_port setting
+	ADMIN_PORT = 9091
 )
 
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
 type (
 	HttpServer struct {
 		authClient     auth.AuthServiceClient
 		dataClient     data.DataServiceClient
 		renderer       *render.Render
 		userInfoClient userinfo.UserInfoClient
-		httpReqs       *prometheus.CounterVec
-	}
+		permissions    *permissionCache
+		tokens         *tokenVerifier
+		webSockets     *webSockets
+		openAPI        []byte
 
-	Config struct {
-		authServiceHost     string `env:"AUTH_SERVICE_HOST"`
-		authServicePort     int    `env:"AUTH_SERVICE_PORT"`
-		dataServiceHost     string `env:"DATA_SERVICE_HOST"`
-		dataServicePort     int    `env:"DATA_SERVICE_PORT"`
-		userinfoServiceHost string `env:"USERINFO_SERVICE_HOST"`
-		userinfoServicePort int    `env:"USERINFO_SERVICE_PORT"`
+		maxUploadItemSize int
+		maxUploadItems    int
 	}
 )
 
+var (
+	httpRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "web_svc_request_info",
+			Help:        "HTTP request counter by response code, request method, and route",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+		[]string{"code", "method", "route"},
+	)
+
+	httpDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "web_svc_request_duration_seconds",
+			Help:        "How long HTTP requests took to handle by response code, request method, and route",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+			Buckets:     prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "route"},
+	)
+
+	httpResponseSizeHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "web_svc_response_size_bytes",
+			Help:        "Size of HTTP response bodies by response code, request method, and route",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+			Buckets:     prometheus.ExponentialBuckets(100, 10, 7),
+		},
+		[]string{"code", "method", "route"},
+	)
+
+	httpInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:        "web_svc_requests_in_flight",
+			Help:        "HTTP requests currently being handled",
+			ConstLabels: prometheus.Labels{"service": "colossus-web"},
+		},
+	)
+)
+
+// Methods other than these are counted as "other", so that clients can't add label values
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// Records every request's status, duration and response size. Requests are labelled with the
+// route that handled them rather than their path, which would give every distinct path its own
+// time series.
 func (s *HttpServer) PrometheusMetrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpInFlightGauge.Inc()
+
+		defer httpInFlightGauge.Dec()
+
+		start := time.Now()
+
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
 		next.ServeHTTP(ww, r)
 
-		if r.RequestURI != "/metrics" {
-			s.httpReqs.WithLabelValues(http.StatusText(ww.Status()), strings.ToLower(r.Method), r.URL.Path).Inc()
+		method := strings.ToLower(r.Method)
+
+		if !metricMethods[r.Method] {
+			method = "other"
 		}
+
+		labels := prometheus.Labels{
+			"code":   strconv.Itoa(responseStatus(ww)),
+			"method": method,
+			"route":  routePattern(r),
+		}
+
+		httpRequestsCounter.With(labels).Inc()
+		httpDurationHistogram.With(labels).Observe(time.Since(start).Seconds())
+		httpResponseSizeHistogram.With(labels).Observe(float64(ww.BytesWritten()))
 	})
 }
 
 func (s *HttpServer) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI == "/metrics" {
-			next.ServeHTTP(w, r)
+		ctx := r.Context()
+
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			req := &auth.ApiKeyAuthRequest{
+				Key:    key,
+				Method: r.Method,
+				Path:   r.URL.Path,
+			}
+
+			res, err := s.authClient.AuthenticateApiKey(ctx, req)
+
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+
+			if !res.Authenticated {
+				writeError(w, r, newProblem(http.StatusUnauthorized, "UNAUTHENTICATED", "You cannot access this resource"))
+				return
+			}
+
+			if !res.Allowed {
+				writeError(w, r, newProblem(http.StatusForbidden, "API_KEY_NOT_ALLOWED", "This API key cannot be used for this resource"))
+				return
+			}
+
+			logf(ctx, "API key accepted for user: %s", res.Principal)
+
+			ctx = context.WithValue(ctx, principalContextKey, res.Principal)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		ctx := r.Context()
+		if token := bearerToken(r); token != "" {
+			username, err := s.tokens.verify(ctx, token)
+
+			if err == errRevocationsNotLoaded {
+				logf(ctx, "Token not checked: %v", err)
+				writeError(w, r, newProblem(http.StatusServiceUnavailable, "UNAVAILABLE", "Tokens can't be checked yet"))
+				return
+			}
+
+			if err != nil {
+				logf(ctx, "Token rejected: %v", err)
+				writeError(w, r, newProblem(http.StatusUnauthorized, "UNAUTHENTICATED", "You cannot access this resource"))
+				return
+			}
+
+			logf(ctx, "Token accepted for user: %s", username)
+
+			ctx = context.WithValue(ctx, principalContextKey, username)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		username := r.Header.Get("Username")
 
 		password := r.Header.Get("Password")
 
-		if password == "" {
-			http.Error(w, "You cannot access this resource", http.StatusUnauthorized)
+		if username == "" || password == "" {
+			writeError(w, r, newProblem(http.StatusUnauthorized, "MISSING_CREDENTIALS", "You cannot access this resource"))
 			return
 		}
 
-		log.Printf("Password attempted: %s", password)
+		logf(ctx, "Authentication attempted for user: %s", username)
 
 		req := &auth.AuthRequest{
+			Username: username,
 			Password: password,
+			ClientIp: clientIP(r),
 		}
 		res, err := s.authClient.Authenticate(ctx, req)
 
 		if err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 
 		authenticated := res.Authenticated
 
 		if !authenticated {
-			http.Error(w, "You cannot access this resource", http.StatusUnauthorized)
+			writeError(w, r, newProblem(http.StatusUnauthorized, "UNAUTHENTICATED", "You cannot access this resource"))
 			return
 		}
 
+		ctx = context.WithValue(ctx, principalContextKey, username)
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// Returns the username that the authentication layer attached to the request context
+func principal(ctx context.Context) string {
+	username, _ := ctx.Value(principalContextKey).(string)
+	return username
+}
+
+// Middleware that only lets a request through if the authenticated user has a role that
+// grants the action on the resource. Routes declare what they need using r.With.
+func (s *HttpServer) require(action, resource string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			allowed, err := s.permissions.allowed(ctx, principal(ctx), permission{action, resource})
+
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+
+			if !allowed {
+				writeError(w, r, newProblem(http.StatusForbidden, "PERMISSION_DENIED", "You are not allowed to access this resource"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the token from an "Authorization: Bearer <token>" header, if there is one
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+}
+
+func (s *HttpServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Username")
+
+	password := r.Header.Get("Password")
+
+	if username == "" || password == "" {
+		writeError(w, r, newProblem(http.StatusUnauthorized, "MISSING_CREDENTIALS", "You must specify a username and password using the Username and Password headers"))
+		return
+	}
+
+	ctx := r.Context()
+
+	req := &auth.AuthRequest{
+		Username: username,
+		Password: password,
+		ClientIp: clientIP(r),
+	}
+
+	res, err := s.authClient.IssueToken(ctx, req)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.renderTokens(w, res)
+}
+
+func (s *HttpServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	refreshToken := r.Header.Get("Refresh-Token")
+
+	if refreshToken == "" {
+		writeError(w, r, newProblem(http.StatusBadRequest, "MISSING_HEADER", "You must specify a refresh token using the Refresh-Token header"))
+		return
+	}
+
+	ctx := r.Context()
+
+	req := &auth.RefreshTokenRequest{
+		RefreshToken: refreshToken,
+	}
+
+	res, err := s.authClient.RefreshToken(ctx, req)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.renderTokens(w, res)
+}
+
+func (s *HttpServer) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Token")
+
+	if token == "" {
+		writeError(w, r, newProblem(http.StatusBadRequest, "MISSING_HEADER", "You must specify an access or refresh token using the Token header"))
+		return
+	}
+
+	ctx := r.Context()
+
+	req := &auth.RevokeTokenRequest{
+		Token: token,
+	}
+
+	if _, err := s.authClient.RevokeToken(ctx, req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *HttpServer) renderTokens(w http.ResponseWriter, res *auth.TokenResponse) {
+	value := map[string]interface{}{
+		"token":              res.Token,
+		"expires_at":         res.ExpiresAt,
+		"refresh_token":      res.RefreshToken,
+		"refresh_expires_at": res.RefreshExpiresAt,
+	}
+
+	s.renderer.JSON(w, http.StatusOK, value)
+}
+
 func (s *HttpServer) handleString(w http.ResponseWriter, r *http.Request) {
 	requestString := r.Header.Get("String")
 
 	if requestString == "" {
-		http.Error(w, "You must specify a string using the String header", http.StatusBadRequest)
+		writeError(w, r, newProblem(http.StatusBadRequest, "MISSING_HEADER", "You must specify a string using the String header"))
 		return
 	}
 
-	ctx := r.Context()
-
-	s.dataHandler(ctx, requestString, w)
+	s.dataHandler(w, r, requestString)
 }
 
 func (s *HttpServer) handleStream(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	// Cancelling stops the upstream stream when the client goes away or writing to it fails
+	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
+	contentType, ok := negotiate(r, CONTENT_TYPE_JSON, CONTENT_TYPE_NDJSON, CONTENT_TYPE_EVENT_STREAM)
+
+	if !ok {
+		writeError(w, r, newProblem(http.StatusNotAcceptable, "NOT_ACCEPTABLE", "the response can only be %s, %s, or %s", CONTENT_TYPE_JSON, CONTENT_TYPE_NDJSON, CONTENT_TYPE_EVENT_STREAM))
+		return
+	}
+
 	req := &data.EmptyRequest{}
 
 	stream, err := s.dataClient.StreamingGet(ctx, req)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	if contentType == CONTENT_TYPE_JSON {
+		items := []string{}
+
+		for {
+			value, err := stream.Recv()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+
+			items = append(items, value.Value)
+		}
+
+		s.renderer.JSON(w, http.StatusOK, items)
+
 		return
 	}
 
-	items := []string{}
+	items := newItemWriter(w, contentType)
 
 	for {
 		value, err := stream.Recv()
 
 		if err == io.EOF {
-			break
+			items.end()
+			return
 		}
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if ctx.Err() == nil {
+				items.fail(problemFor(r, err))
+			}
+
 			return
 		}
 
-		items = append(items, value.Value)
+		if err := items.item(value.Value); err != nil {
+			return
+		}
 	}
-
-	s.renderer.JSON(w, http.StatusOK, items)
-
 }
 
 func (s *HttpServer) handlePut(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	// Cancelling abandons the upstream stream, so that the data service doesn't act on part of
+	// an upload that turns out to be malformed
+	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
+	items, err := newItemReader(r, s.maxUploadItemSize)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
 	stream, err := s.dataClient.StreamingPut(ctx)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	items := []string{"foo", "bar", "baz"}
+	for count := 1; ; count++ {
+		item, err := items.next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			cancel()
+			writeError(w, r, unreadable(err))
+			return
+		}
+
+		if count > s.maxUploadItems {
+			cancel()
+			writeError(w, r, newProblem(http.StatusRequestEntityTooLarge, "TOO_MANY_ITEMS", "at most %d items may be uploaded at once", s.maxUploadItems))
+			return
+		}
 
-	for _, item := range items {
 		req := &data.DataRequest{
 			Request: item,
 		}
 
-		if err := stream.Send(req); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		err = stream.Send(req)
+
+		// The data service ended the stream early, and only its status, which CloseAndRecv
+		// returns, says why
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
 	}
@@ -168,7 +495,7 @@ func (s *HttpServer) handlePut(w http.ResponseWriter, r *http.Request) {
 	res, err := stream.CloseAndRecv()
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -179,7 +506,9 @@ func (s *HttpServer) handlePut(w http.ResponseWriter, r *http.Request) {
 	s.renderer.JSON(w, http.StatusAccepted, value)
 }
 
-func (s *HttpServer) dataHandler(ctx context.Context, requestString string, w http.ResponseWriter) {
+func (s *HttpServer) dataHandler(w http.ResponseWriter, r *http.Request, requestString string) {
+	ctx := r.Context()
+
 	req := &data.DataRequest{
 		Request: requestString,
 	}
@@ -187,7 +516,7 @@ func (s *HttpServer) dataHandler(ctx context.Context, requestString string, w ht
 	res, err := s.dataClient.Get(ctx, req)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -197,16 +526,17 @@ func (s *HttpServer) dataHandler(ctx context.Context, requestString string, w ht
 	w.Write([]byte(value))
 }
 
+// Looks up the user named by the username query parameter, or the caller if there isn't one.
+// The Username header isn't used for this, since it's the caller's credential, and a caller who
+// authenticates with a token or an API key would otherwise have to send someone else's.
 func (s *HttpServer) handleUserInfo(w http.ResponseWriter, r *http.Request) {
-	var username string
+	ctx := r.Context()
 
-	if r.Header.Get("Username") == "" {
-		username = "NONE"
-	} else {
-		username = r.Header.Get("Username")
-	}
+	username := r.URL.Query().Get("username")
 
-	ctx := r.Context()
+	if username == "" {
+		username = principal(ctx)
+	}
 
 	req := &userinfo.UserInfoRequest{
 		Username: username,
@@ -215,7 +545,7 @@ func (s *HttpServer) handleUserInfo(w http.ResponseWriter, r *http.Request) {
 	res, err := s.userInfoClient.GetUserInfo(ctx, req)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -225,93 +555,189 @@ func (s *HttpServer) handleUserInfo(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(userInfo))
 }
 
-func prometheusWebCounter() *prometheus.CounterVec {
-	return prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name:        "web_svc_request_info",
-			Help:        "HTTP request counter by response code, request method, and request path",
-			ConstLabels: prometheus.Labels{"service": "colossus-web"},
-		},
-		[]string{"code", "method", "path"},
-	)
-}
-
 func main() {
+	loaded, err := config.Load("web", settings, os.Args[1:])
+
+	if err != nil {
+		log.Fatalf("Could not load configuration: %v", err)
+	}
+
 	cfg := Config{}
 
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatalf("Could not parse environment variables: %v", err)
+	if err := loaded.Decode(&cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Loaded configuration: %s", loaded.Describe())
+
+	resolver.Register(&resolverBuilder{interval: cfg.ResolveInterval})
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+
+	if err != nil {
+		log.Fatalf("Could not parse the trusted proxies: %v", err)
 	}
 
-	authConn, err := grpc.Dial(
-		fmt.Sprintf("colossus-%s-svc:%d", cfg.authServiceHost, cfg.authServicePort), grpc.WithInsecure())
+	shutdownTracing, err := tracing.Setup("colossus-web", cfg.Tracing)
+
+	if err != nil {
+		log.Fatalf("Could not set up tracing: %v", err)
+	}
+
+	log.Printf("Exporting traces to %s", cfg.Tracing.Exporter)
+
+	gateway := newGateway()
+
+	authConn, err := cfg.AuthService.dial("auth", gateway.authorize, grpc.WithPerRPCCredentials(serviceCredentials{cfg.ServiceToken}))
 
 	if err != nil {
 		panic(err)
 	}
 
-	log.Print("Established connection with auth service")
+	log.Print("Connecting to the auth service in the background")
 
-	dataConn, err := grpc.Dial(
-		fmt.Sprintf("%s:%d", cfg.dataServiceHost, cfg.dataServicePort), grpc.WithInsecure())
+	dataConn, err := cfg.DataService.dial("data", gateway.authorize)
 
 	if err != nil {
 		panic(err)
 	}
 
-	log.Print("Established connection with data service")
+	log.Print("Connecting to the data service in the background")
 
-	userInfoConn, err := grpc.Dial(
-		fmt.Sprintf("%s:%d", cfg.userinfoServiceHost, cfg.userinfoServicePort), grpc.WithInsecure())
+	userInfoConn, err := cfg.UserInfoService.dial("userinfo", gateway.authorize)
 
 	if err != nil {
 		panic(err)
 	}
 
-	log.Print("Established connection with userinfo service")
+	log.Print("Connecting to the userinfo service in the background")
 
 	authClient := auth.NewAuthServiceClient(authConn)
 	dataClient := data.NewDataServiceClient(dataConn)
 	userInfoClient := userinfo.NewUserInfoClient(userInfoConn)
 
-	r := chi.NewRouter()
+	permissions := newPermissionCache(authClient, cfg.PermissionCacheTTL)
+
+	if err := gateway.register(context.Background(), permissions, authConn, dataConn, userInfoConn); err != nil {
+		log.Fatalf("Could not register the REST gateway: %v", err)
+	}
 
 	renderer := render.New(render.Options{})
 
-	httpReqs := prometheusWebCounter()
+	registerMetrics()
 
-	if err := prometheus.Register(httpReqs); err != nil {
-		log.Fatalf("Could not register Prometheus httpReqs counter vec: %v", err)
-	}
+	tokens := newTokenVerifier(authClient)
+
+	go tokens.runRevocationRefresh()
 
 	server := HttpServer{
 		authClient:     authClient,
 		dataClient:     dataClient,
 		renderer:       renderer,
 		userInfoClient: userInfoClient,
-		httpReqs:       httpReqs,
+		permissions:    permissions,
+		tokens:         tokens,
+		webSockets:     newWebSockets(),
+
+		maxUploadItemSize: cfg.MaxUploadItemSize,
+		maxUploadItems:    cfg.MaxUploadItems,
+	}
+
+	log.Print("Using the following middleware: request IDs, tracing, Prometheus metrics, real IP, authentication")
+
+	routes := server.routes()
+
+	r := server.router(routes, proxies, gateway)
+
+	doc, rpcs, err := newOpenAPIDocument(routes, gatewayProtos)
+
+	if err != nil {
+		log.Fatalf("Could not generate the OpenAPI document: %v", err)
+	}
+
+	// Refuses to start with routes that consumers can't find out about
+	if err := checkOpenAPIDocument(r, doc, rpcs); err != nil {
+		log.Fatalf("The routes and the OpenAPI document disagree: %v", err)
 	}
 
-	log.Print("Using the following middleware: Prometheus metrics, authentication")
+	if server.openAPI, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		log.Fatalf("Could not render the OpenAPI document: %v", err)
+	}
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: r,
+	}
+
+	// Shutdown doesn't wait for hijacked connections, so WebSockets are closed separately
+	httpServer.RegisterOnShutdown(server.webSockets.closeAll)
+
+	go func() {
+		log.Printf("Now starting the server on port %d...", cfg.Port)
+
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	health := newHealthChecker([]dependency{
+		{name: "auth", conn: authConn, healthCheck: cfg.AuthService.HealthCheck, required: true},
+		{name: "data", conn: dataConn, healthCheck: cfg.DataService.HealthCheck},
+		{name: "userinfo", conn: userInfoConn, healthCheck: cfg.UserInfoService.HealthCheck},
+	}, tokens.revocationsLoaded)
+
+	adminServer := newAdminServer(cfg.AdminPort, loaded.Handler(), health, cfg.Pprof)
+
+	go func() {
+		log.Printf("Now starting the admin server on port %d...", cfg.AdminPort)
+
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+
+	sig := waitForSignal()
+
+	log.Printf("Received %s; shutting down", sig)
 
-	// The Prometheus metrics middleware
-	r.Use(server.PrometheusMetrics)
+	// Fails the readiness probe so that Kubernetes stops routing new requests here while the
+	// in-flight ones drain
+	health.shutdown()
 
-	// The authentication layer
-	r.Use(server.authenticate)
+	// Requests keep coming until Kubernetes has seen the readiness probe fail, and are served as
+	// usual until then
+	log.Printf("Waiting %s for Kubernetes to stop routing requests here", cfg.ReadinessGracePeriod)
 
-	r.Post("/string", server.handleString)
+	time.Sleep(cfg.ReadinessGracePeriod)
 
-	r.Get("/stream", server.handleStream)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 
-	r.Put("/stream", server.handlePut)
+	defer cancel()
 
-	r.Get("/user", server.handleUserInfo)
+	// Stops accepting connections and waits for in-flight requests, including streams, to finish
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Drain deadline exceeded; closing the remaining connections: %v", err)
+		httpServer.Close()
+	}
 
-	// The Prometheus metrics handler
-	r.Handle("/metrics", prometheus.Handler())
+	for name, conn := range map[string]*grpc.ClientConn{
+		"auth":     authConn,
+		"data":     dataConn,
+		"userinfo": userInfoConn,
+	} {
+		if err := conn.Close(); err != nil {
+			log.Printf("Could not close connection to the %s service: %v", name, err)
+		}
+	}
 
-	log.Printf("Now starting the server on port %d...", PORT)
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Could not export the remaining trace spans: %v", err)
+	}
+
+	// Kept up until the end so that metrics can be scraped while the server drains
+	if err := adminServer.Shutdown(ctx); err != nil {
+		adminServer.Close()
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", PORT), r)
+	log.Print("Shutdown complete")
 }
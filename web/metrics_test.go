@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The metric with the given labels among the ones that c collects, or nil if it hasn't been
+// created yet
+func findMetric(t *testing.T, c prometheus.Collector, labels prometheus.Labels) *dto.Metric {
+	registry := prometheus.NewRegistry()
+
+	if err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+	metrics:
+		for _, m := range family.GetMetric() {
+			have := map[string]string{}
+
+			for _, pair := range m.GetLabel() {
+				have[pair.GetName()] = pair.GetValue()
+			}
+
+			for name, value := range labels {
+				if have[name] != value {
+					continue metrics
+				}
+			}
+
+			return m
+		}
+	}
+
+	return nil
+}
+
+// A counter's or a gauge's value, or the number of observations a histogram has had
+func metricValue(t *testing.T, c prometheus.Collector, labels prometheus.Labels) float64 {
+	m := findMetric(t, c, labels)
+
+	switch {
+	case m == nil:
+		return 0
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	default:
+		return m.GetCounter().GetValue()
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	s := &HttpServer{}
+
+	var inFlight float64
+
+	r := chi.NewRouter()
+
+	r.Use(s.PrometheusMetrics)
+
+	r.NotFound(handleNotFound)
+
+	r.Get("/data/{key}", func(w http.ResponseWriter, r *http.Request) {
+		inFlight = metricValue(t, httpInFlightGauge, nil)
+
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("12345"))
+	})
+
+	r.Handle("/anything", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		paths  []string
+		labels prometheus.Labels
+	}{
+		{"route pattern rather than path", "GET", []string{"/data/a", "/data/b"}, prometheus.Labels{"code": "418", "method": "get", "route": "/data/{key}"}},
+		{"implicit 200", "POST", []string{"/anything"}, prometheus.Labels{"code": "200", "method": "post", "route": "/anything"}},
+		{"unmatched", "GET", []string{"/nope/1", "/nope/2"}, prometheus.Labels{"code": "404", "method": "get", "route": "unmatched"}},
+		{"unusual method", "BREW", []string{"/anything"}, prometheus.Labels{"code": "405", "method": "other", "route": "unmatched"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[prometheus.Collector]float64{}
+
+			for _, c := range []prometheus.Collector{httpRequestsCounter, httpDurationHistogram, httpResponseSizeHistogram} {
+				before[c] = metricValue(t, c, tt.labels)
+			}
+
+			for _, path := range tt.paths {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, path, nil))
+			}
+
+			for c, value := range before {
+				if got := metricValue(t, c, tt.labels) - value; got != float64(len(tt.paths)) {
+					t.Errorf("%d requests recorded in %T with %v, want %d", int(got), c, tt.labels, len(tt.paths))
+				}
+			}
+		})
+	}
+
+	// Paths never become label values
+	for _, path := range []string{"/data/a", "/data/b", "/nope/1", "/nope/2"} {
+		if findMetric(t, httpRequestsCounter, prometheus.Labels{"route": path}) != nil {
+			t.Errorf("requests labelled with the path %s", path)
+		}
+	}
+
+	if inFlight != 1 {
+		t.Errorf("%g requests in flight while one was being handled, want 1", inFlight)
+	}
+
+	if got := metricValue(t, httpInFlightGauge, nil); got != 0 {
+		t.Errorf("%g requests in flight once they've all finished, want 0", got)
+	}
+}
+
+// Response sizes are measured from what was written, whatever the handler
+func TestPrometheusMetricsResponseSize(t *testing.T) {
+	s := &HttpServer{}
+
+	r := chi.NewRouter()
+
+	r.Use(s.PrometheusMetrics)
+
+	body := strings.Repeat("x", 5000)
+
+	r.Get("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	labels := prometheus.Labels{"code": "200", "method": "get", "route": "/large"}
+
+	before := findMetric(t, httpResponseSizeHistogram, labels).GetHistogram().GetSampleSum()
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/large", nil))
+
+	after := findMetric(t, httpResponseSizeHistogram, labels).GetHistogram().GetSampleSum()
+
+	if after-before != float64(len(body)) {
+		t.Errorf("response size = %g bytes, want %d", after-before, len(body))
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/lucperkins/colossus/proto/auth"
+	"github.com/lucperkins/colossus/proto/data"
+	"github.com/lucperkins/colossus/proto/userinfo"
+	swaggerFiles "github.com/swaggo/files/v2"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+
+	CONTENT_TYPE_HTML = "text/html"
+
+	// How long browsers may cache Swagger UI's files, which only change with the binary
+	SWAGGER_UI_MAX_AGE = 24 * time.Hour
+
+	// Where the REST gateway is mounted. Its routes are documented from the backends' protos.
+	GATEWAY_PATTERN = "/v1/*"
+
+	// The viewer at /docs. Swagger UI is bundled into the binary and served from /docs/, so
+	// the page doesn't depend on a CDN, and upgrading it is a matter of bumping
+	// github.com/swaggo/files/v2.
+	OPENAPI_VIEWER = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Colossus API</title>
+  <link rel="stylesheet" href="docs/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="docs/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+)
+
+// The files of the bundled Swagger UI that the viewer loads, and their content types. Nothing
+// else in the bundle is served, since its own index page points at a demo API.
+var swaggerUIFiles = map[string]string{
+	"swagger-ui.css":       "text/css; charset=utf-8",
+	"swagger-ui-bundle.js": "text/javascript; charset=utf-8",
+}
+
+// One message from each proto file whose RPCs the gateway serves, which is how the files'
+// descriptors are found
+var gatewayProtos = []descriptor.Message{
+	&auth.PublicKeyRequest{},
+	&data.DataRequest{},
+	&userinfo.UserInfoRequest{},
+}
+
+// The ways of authenticating, any one of which the authentication layer accepts
+var authentication = []map[string][]string{
+	{"bearer": {}},
+	{"apiKey": {}},
+	{"username": {}, "password": {}},
+}
+
+// Matches the variables in a google.api.http path template, such as {name} or {name=things/*}
+var pathVariable = regexp.MustCompile(`\{([^}=]+)(=[^}]*)?\}`)
+
+// The parts of the OpenAPI 3 specification that the web service uses
+type (
+	openAPIDocument struct {
+		OpenAPI    string                           `json:"openapi"`
+		Info       info                             `json:"info"`
+		Paths      map[string]map[string]*operation `json:"paths"`
+		Components components                       `json:"components"`
+	}
+
+	info struct {
+		Title       string `json:"title"`
+		Description string `json:"description,omitempty"`
+		Version     string `json:"version"`
+	}
+
+	components struct {
+		Schemas         map[string]*schema         `json:"schemas"`
+		SecuritySchemes map[string]*securityScheme `json:"securitySchemes"`
+	}
+
+	operation struct {
+		OperationID string                `json:"operationId,omitempty"`
+		Tags        []string              `json:"tags,omitempty"`
+		Summary     string                `json:"summary,omitempty"`
+		Description string                `json:"description,omitempty"`
+		Parameters  []*parameter          `json:"parameters,omitempty"`
+		RequestBody *requestBody          `json:"requestBody,omitempty"`
+		Responses   map[string]*response  `json:"responses"`
+		Security    []map[string][]string `json:"security,omitempty"`
+	}
+
+	parameter struct {
+		Name        string  `json:"name"`
+		In          string  `json:"in"`
+		Description string  `json:"description,omitempty"`
+		Required    bool    `json:"required,omitempty"`
+		Schema      *schema `json:"schema"`
+	}
+
+	requestBody struct {
+		Description string                `json:"description,omitempty"`
+		Required    bool                  `json:"required,omitempty"`
+		Content     map[string]*mediaType `json:"content"`
+	}
+
+	response struct {
+		Description string                `json:"description"`
+		Content     map[string]*mediaType `json:"content,omitempty"`
+	}
+
+	mediaType struct {
+		Schema *schema `json:"schema"`
+	}
+
+	schema struct {
+		Ref         string             `json:"$ref,omitempty"`
+		Type        string             `json:"type,omitempty"`
+		Format      string             `json:"format,omitempty"`
+		Description string             `json:"description,omitempty"`
+		Enum        []string           `json:"enum,omitempty"`
+		Items       *schema            `json:"items,omitempty"`
+		Properties  map[string]*schema `json:"properties,omitempty"`
+	}
+
+	securityScheme struct {
+		Type         string `json:"type"`
+		Description  string `json:"description,omitempty"`
+		Name         string `json:"name,omitempty"`
+		In           string `json:"in,omitempty"`
+		Scheme       string `json:"scheme,omitempty"`
+		BearerFormat string `json:"bearerFormat,omitempty"`
+	}
+)
+
+func headerParameter(name, description string, required bool) *parameter {
+	return &parameter{Name: name, In: "header", Description: description, Required: required, Schema: &schema{Type: "string"}}
+}
+
+func queryParameter(name, description string, required bool) *parameter {
+	return &parameter{Name: name, In: "query", Description: description, Required: required, Schema: &schema{Type: "string"}}
+}
+
+func jsonContent(s *schema) map[string]*mediaType {
+	return map[string]*mediaType{CONTENT_TYPE_JSON: {Schema: s}}
+}
+
+func textContent() map[string]*mediaType {
+	return map[string]*mediaType{CONTENT_TYPE_TEXT: {Schema: &schema{Type: "string"}}}
+}
+
+// The JSON schemas of proto scalar types, following the proto3 JSON mapping
+var scalarSchemas = map[pb.FieldDescriptorProto_Type]schema{
+	pb.FieldDescriptorProto_TYPE_STRING:   {Type: "string"},
+	pb.FieldDescriptorProto_TYPE_BYTES:    {Type: "string", Format: "byte"},
+	pb.FieldDescriptorProto_TYPE_BOOL:     {Type: "boolean"},
+	pb.FieldDescriptorProto_TYPE_DOUBLE:   {Type: "number", Format: "double"},
+	pb.FieldDescriptorProto_TYPE_FLOAT:    {Type: "number", Format: "float"},
+	pb.FieldDescriptorProto_TYPE_INT32:    {Type: "integer", Format: "int32"},
+	pb.FieldDescriptorProto_TYPE_SINT32:   {Type: "integer", Format: "int32"},
+	pb.FieldDescriptorProto_TYPE_SFIXED32: {Type: "integer", Format: "int32"},
+	pb.FieldDescriptorProto_TYPE_UINT32:   {Type: "integer", Format: "int64"},
+	pb.FieldDescriptorProto_TYPE_FIXED32:  {Type: "integer", Format: "int64"},
+	pb.FieldDescriptorProto_TYPE_INT64:    {Type: "string", Format: "int64"},
+	pb.FieldDescriptorProto_TYPE_SINT64:   {Type: "string", Format: "int64"},
+	pb.FieldDescriptorProto_TYPE_SFIXED64: {Type: "string", Format: "int64"},
+	pb.FieldDescriptorProto_TYPE_UINT64:   {Type: "string", Format: "uint64"},
+	pb.FieldDescriptorProto_TYPE_FIXED64:  {Type: "string", Format: "uint64"},
+}
+
+// Builds the OpenAPI document for the web service's own routes and for the gateway's routes,
+// which come from the google.api.http annotations in the given messages' proto files. Also
+// returns the full names of the annotated RPCs.
+func newOpenAPIDocument(routes []route, protos []descriptor.Message) (*openAPIDocument, []string, error) {
+	doc := &openAPIDocument{
+		OpenAPI: OPENAPI_VERSION,
+		Info: info{
+			Title:       "Colossus",
+			Description: "The Colossus web API. Routes under /v1 call the backend services' RPCs directly.",
+			Version:     "v1",
+		},
+		Paths: map[string]map[string]*operation{},
+		Components: components{
+			Schemas: map[string]*schema{},
+			SecuritySchemes: map[string]*securityScheme{
+				"bearer":   {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "An access token from /token"},
+				"apiKey":   {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "An API key, which may be limited to some routes"},
+				"username": {Type: "apiKey", In: "header", Name: "Username"},
+				"password": {Type: "apiKey", In: "header", Name: "Password"},
+			},
+		},
+	}
+
+	for _, rt := range routes {
+		op := *rt.doc
+
+		if !rt.public {
+			doc.authenticated(&op, rt.permissions)
+		}
+
+		doc.add(rt.method, rt.pattern, &op)
+	}
+
+	types := protoTypes{}
+
+	for _, msg := range protos {
+		fd, _ := descriptor.ForMessage(msg)
+
+		types.add("."+fd.GetPackage(), fd.MessageType, fd.EnumType)
+	}
+
+	var rpcs []string
+
+	for _, msg := range protos {
+		fd, _ := descriptor.ForMessage(msg)
+
+		for _, service := range fd.Service {
+			for _, method := range service.Method {
+				rule, err := httpRule(method)
+
+				if err != nil {
+					return nil, nil, err
+				}
+
+				if rule == nil {
+					continue
+				}
+
+				fullMethod := fmt.Sprintf("/%s.%s/%s", fd.GetPackage(), service.GetName(), method.GetName())
+
+				rpcs = append(rpcs, fullMethod)
+
+				bindings := append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...)
+
+				for i, binding := range bindings {
+					if err := doc.addGatewayRoute(types, service.GetName(), fullMethod, method, binding, i); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+		}
+	}
+
+	return doc, rpcs, nil
+}
+
+// Adds the operation under the path, with a problem as the body of each of its error responses
+func (d *openAPIDocument) add(method, path string, op *operation) {
+	responses := map[string]*response{}
+
+	for code, res := range op.Responses {
+		if res.Content == nil && (code == "default" || code >= "400") {
+			res = &response{Description: res.Description, Content: map[string]*mediaType{CONTENT_TYPE_PROBLEM: {Schema: d.problemSchema()}}}
+		}
+
+		responses[code] = res
+	}
+
+	op.Responses = responses
+
+	if d.Paths[path] == nil {
+		d.Paths[path] = map[string]*operation{}
+	}
+
+	d.Paths[path][strings.ToLower(method)] = op
+}
+
+// Marks the operation as needing authentication and the given permissions, along with the
+// responses that the authentication layer may give
+func (d *openAPIDocument) authenticated(op *operation, permissions []permission) {
+	op.Security = authentication
+
+	if len(permissions) > 0 {
+		needed := []string{}
+
+		for _, perm := range permissions {
+			needed = append(needed, perm.action+":"+perm.resource)
+		}
+
+		requires := fmt.Sprintf("Requires the %s permission.", strings.Join(needed, " and "))
+
+		if op.Description == "" {
+			op.Description = requires
+		} else {
+			op.Description += " " + requires
+		}
+	}
+
+	responses := map[string]*response{}
+
+	for code, res := range op.Responses {
+		responses[code] = res
+	}
+
+	for code, description := range map[string]string{
+		"401": "The caller could not be authenticated",
+		"403": "The caller isn't allowed to use this route, or their account is temporarily locked",
+		"429": "Too many failed attempts from this client; see the Retry-After header",
+		"503": "The auth service is unavailable; see the Retry-After header",
+	} {
+		if _, ok := responses[code]; !ok {
+			responses[code] = &response{Description: description}
+		}
+	}
+
+	op.Responses = responses
+}
+
+// Returns the method's google.api.http annotation, or nil if it doesn't have one
+func httpRule(method *pb.MethodDescriptorProto) (*annotations.HttpRule, error) {
+	if method.Options == nil {
+		return nil, nil
+	}
+
+	ext, err := proto.GetExtension(method.Options, annotations.E_Http)
+
+	if err == proto.ErrMissingExtension {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read the HTTP annotation of %s: %v", method.GetName(), err)
+	}
+
+	return ext.(*annotations.HttpRule), nil
+}
+
+// Documents one of the routes that the gateway generates for an RPC, the way that the generated
+// code maps requests to it: path variables and, without a "*" body, query parameters fill in the
+// request message's fields
+func (d *openAPIDocument) addGatewayRoute(types protoTypes, service, fullMethod string, method *pb.MethodDescriptorProto, rule *annotations.HttpRule, binding int) error {
+	var httpMethod, template string
+
+	switch {
+	case rule.GetGet() != "":
+		httpMethod, template = http.MethodGet, rule.GetGet()
+	case rule.GetPost() != "":
+		httpMethod, template = http.MethodPost, rule.GetPost()
+	case rule.GetPut() != "":
+		httpMethod, template = http.MethodPut, rule.GetPut()
+	case rule.GetPatch() != "":
+		httpMethod, template = http.MethodPatch, rule.GetPatch()
+	case rule.GetDelete() != "":
+		httpMethod, template = http.MethodDelete, rule.GetDelete()
+	default:
+		return fmt.Errorf("%s has an HTTP annotation without a supported method", fullMethod)
+	}
+
+	input, ok := types.messages[method.GetInputType()]
+
+	if !ok {
+		return fmt.Errorf("%s takes %s, which isn't in any of the gateway's protos", fullMethod, method.GetInputType())
+	}
+
+	op := &operation{
+		OperationID: service + "_" + method.GetName(),
+		Tags:        []string{service},
+		Summary:     "Calls " + fullMethod,
+		Responses:   map[string]*response{},
+	}
+
+	if binding > 0 {
+		op.OperationID += fmt.Sprintf("_%d", binding)
+	}
+
+	inPath := map[string]bool{}
+
+	for _, match := range pathVariable.FindAllStringSubmatch(template, -1) {
+		inPath[match[1]] = true
+	}
+
+	for _, field := range input.Field {
+		if inPath[field.GetName()] {
+			op.Parameters = append(op.Parameters, &parameter{
+				Name:     field.GetName(),
+				In:       "path",
+				Required: true,
+				Schema:   d.fieldSchema(types, field),
+			})
+		}
+	}
+
+	if rule.Body == "*" {
+		body := d.messageSchema(types, method.GetInputType())
+
+		description := ""
+
+		if method.GetClientStreaming() {
+			description = "A stream of JSON objects, one for each request message"
+		}
+
+		op.RequestBody = &requestBody{Description: description, Required: true, Content: jsonContent(body)}
+	} else {
+		for _, field := range input.Field {
+			if inPath[field.GetName()] {
+				continue
+			}
+
+			if field.GetName() == rule.Body {
+				op.RequestBody = &requestBody{Required: true, Content: jsonContent(d.fieldSchema(types, field))}
+				continue
+			}
+
+			// Messages can't be given as query parameters, other than field by field
+			if field.GetType() == pb.FieldDescriptorProto_TYPE_MESSAGE {
+				continue
+			}
+
+			op.Parameters = append(op.Parameters, &parameter{
+				Name:   field.GetName(),
+				In:     "query",
+				Schema: d.fieldSchema(types, field),
+			})
+		}
+	}
+
+	output := d.messageSchema(types, method.GetOutputType())
+
+	if method.GetServerStreaming() {
+		op.Responses["200"] = &response{
+			Description: "A stream of newline-delimited JSON objects, each holding a result or, if the call fails partway, an error",
+			Content: jsonContent(&schema{
+				Type: "object",
+				Properties: map[string]*schema{
+					"result": output,
+					"error":  {Type: "object", Description: "Why the stream failed, including its gRPC and HTTP status codes"},
+				},
+			}),
+		}
+	} else {
+		op.Responses["200"] = &response{Description: "The RPC's response", Content: jsonContent(output)}
+	}
+
+	op.Responses["default"] = &response{Description: "The RPC failed"}
+
+	var permissions []permission
+
+	if perm := gatewayPermissions[fullMethod]; perm != nil {
+		permissions = []permission{*perm}
+	}
+
+	d.authenticated(op, permissions)
+
+	d.add(httpMethod, pathVariable.ReplaceAllString(template, "{$1}"), op)
+
+	return nil
+}
+
+// The body of every error response
+func (d *openAPIDocument) problemSchema() *schema {
+	const name = "Problem"
+
+	if _, ok := d.Components.Schemas[name]; !ok {
+		d.Components.Schemas[name] = &schema{
+			Type:        "object",
+			Description: "An RFC 7807 problem details object",
+			Properties: map[string]*schema{
+				"type":       {Type: "string"},
+				"title":      {Type: "string"},
+				"status":     {Type: "integer", Format: "int32"},
+				"detail":     {Type: "string", Description: "What went wrong, for people to read"},
+				"instance":   {Type: "string", Description: "The request's path"},
+				"code":       {Type: "string", Description: "A stable identifier for the kind of problem, such as NOT_FOUND or LOCKED_OUT"},
+				"request_id": {Type: "string", Description: "The request's ID, for matching the problem up with the logs"},
+				"violations": {Type: "array", Items: &schema{
+					Type: "object",
+					Properties: map[string]*schema{
+						"field":       {Type: "string"},
+						"subject":     {Type: "string"},
+						"type":        {Type: "string"},
+						"description": {Type: "string"},
+					},
+				}},
+				"retry_after_seconds": {Type: "integer", Format: "int64"},
+			},
+		}
+	}
+
+	return &schema{Ref: "#/components/schemas/" + name}
+}
+
+// Returns a reference to the schema of the named message, adding the schemas of it and every
+// type that it uses to the document
+func (d *openAPIDocument) messageSchema(types protoTypes, typeName string) *schema {
+	name := strings.TrimPrefix(typeName, ".")
+	ref := &schema{Ref: "#/components/schemas/" + name}
+
+	if _, ok := d.Components.Schemas[name]; ok {
+		return ref
+	}
+
+	message, ok := types.messages[typeName]
+
+	// Types from other protos, such as the well-known types, aren't described
+	if !ok {
+		return &schema{Type: "object"}
+	}
+
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+
+	// Added before its fields, so that recursive messages end
+	d.Components.Schemas[name] = s
+
+	for _, field := range message.Field {
+		s.Properties[field.GetName()] = d.fieldSchema(types, field)
+	}
+
+	return ref
+}
+
+// The schema of a field, named as the gateway names fields in JSON: by their names in the proto
+func (d *openAPIDocument) fieldSchema(types protoTypes, field *pb.FieldDescriptorProto) *schema {
+	var s *schema
+
+	switch field.GetType() {
+	case pb.FieldDescriptorProto_TYPE_MESSAGE:
+		s = d.messageSchema(types, field.GetTypeName())
+	case pb.FieldDescriptorProto_TYPE_ENUM:
+		s = &schema{Type: "string"}
+
+		if enum, ok := types.enums[field.GetTypeName()]; ok {
+			for _, value := range enum.Value {
+				s.Enum = append(s.Enum, value.GetName())
+			}
+		}
+	default:
+		scalar := scalarSchemas[field.GetType()]
+		s = &scalar
+	}
+
+	if field.GetLabel() == pb.FieldDescriptorProto_LABEL_REPEATED {
+		return &schema{Type: "array", Items: s}
+	}
+
+	return s
+}
+
+// The messages and enums of the gateway's protos, keyed by their fully qualified names
+type protoTypes struct {
+	messages map[string]*pb.DescriptorProto
+	enums    map[string]*pb.EnumDescriptorProto
+}
+
+func (t *protoTypes) add(scope string, messages []*pb.DescriptorProto, enums []*pb.EnumDescriptorProto) {
+	if t.messages == nil {
+		t.messages = map[string]*pb.DescriptorProto{}
+		t.enums = map[string]*pb.EnumDescriptorProto{}
+	}
+
+	for _, enum := range enums {
+		t.enums[scope+"."+enum.GetName()] = enum
+	}
+
+	for _, message := range messages {
+		name := scope + "." + message.GetName()
+
+		t.messages[name] = message
+		t.add(name, message.NestedType, message.EnumType)
+	}
+}
+
+// Makes sure that the document describes every route that the router serves and nothing else,
+// and that every RPC with an HTTP annotation has a gateway permission and the other way around.
+// Routes that are registered without going through the route table, or RPCs that are annotated
+// without being given a permission, are reported here rather than going undocumented.
+func checkOpenAPIDocument(r chi.Routes, doc *openAPIDocument, rpcs []string) error {
+	var problems []string
+
+	served := map[string]bool{}
+
+	chi.Walk(r, func(method, pattern string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if pattern == GATEWAY_PATTERN {
+			return nil
+		}
+
+		served[method+" "+pattern] = true
+
+		if _, ok := doc.Paths[pattern][strings.ToLower(method)]; !ok {
+			problems = append(problems, fmt.Sprintf("%s %s is served but not documented", method, pattern))
+		}
+
+		return nil
+	})
+
+	for path, ops := range doc.Paths {
+		if strings.HasPrefix(path, strings.TrimSuffix(GATEWAY_PATTERN, "*")) {
+			continue
+		}
+
+		for method := range ops {
+			if !served[strings.ToUpper(method)+" "+path] {
+				problems = append(problems, fmt.Sprintf("%s %s is documented but not served", strings.ToUpper(method), path))
+			}
+		}
+	}
+
+	annotated := map[string]bool{}
+
+	for _, rpc := range rpcs {
+		annotated[rpc] = true
+
+		if _, ok := gatewayPermissions[rpc]; !ok {
+			problems = append(problems, fmt.Sprintf("%s has an HTTP annotation but no gateway permission", rpc))
+		}
+	}
+
+	for rpc := range gatewayPermissions {
+		if !annotated[rpc] {
+			problems = append(problems, fmt.Sprintf("%s has a gateway permission but no HTTP annotation", rpc))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (s *HttpServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.Write(s.openAPI)
+}
+
+func handleOpenAPIViewer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_HTML+"; charset=utf-8")
+	w.Write([]byte(OPENAPI_VIEWER))
+}
+
+func handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "file")
+
+	contentType, ok := swaggerUIFiles[name]
+
+	if !ok {
+		handleNotFound(w, r)
+		return
+	}
+
+	contents, err := fs.ReadFile(swaggerFiles.FS, name)
+
+	if err != nil {
+		handleNotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(SWAGGER_UI_MAX_AGE.Seconds())))
+
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+}
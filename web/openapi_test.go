@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The web service refuses to start when its routes and the OpenAPI document disagree, which
+// this catches before a deploy does
+func TestOpenAPIDocumentMatchesRouter(t *testing.T) {
+	s := &HttpServer{}
+
+	routes := s.routes()
+
+	r := s.router(routes, trustedProxies{}, http.NotFoundHandler())
+
+	doc, rpcs, err := newOpenAPIDocument(routes, gatewayProtos)
+
+	if err != nil {
+		t.Fatalf("could not generate the OpenAPI document: %v", err)
+	}
+
+	if err := checkOpenAPIDocument(r, doc, rpcs); err != nil {
+		t.Error(err)
+	}
+}
+
+// The viewer mustn't load anything from another origin, and only the files it loads are served
+func TestOpenAPIViewerServesSwaggerUI(t *testing.T) {
+	s := &HttpServer{}
+
+	r := s.router(s.routes(), trustedProxies{}, http.NotFoundHandler())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	page := get("/docs")
+
+	if page.Code != http.StatusOK {
+		t.Fatalf("GET /docs = %d, want 200", page.Code)
+	}
+
+	assets := regexp.MustCompile(`(?:src|href)="([^"]+)"`).FindAllStringSubmatch(page.Body.String(), -1)
+
+	if len(assets) == 0 {
+		t.Fatal("the viewer doesn't load Swagger UI")
+	}
+
+	for _, asset := range assets {
+		if strings.Contains(asset[1], "//") {
+			t.Errorf("the viewer loads %s from another origin", asset[1])
+			continue
+		}
+
+		if w := get("/" + asset[1]); w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("GET /%s = %d with %d bytes, want the file", asset[1], w.Code, w.Body.Len())
+		}
+	}
+
+	tests := []struct {
+		path            string
+		want            int
+		wantContentType string
+	}{
+		{"/docs/swagger-ui-bundle.js", http.StatusOK, "text/javascript; charset=utf-8"},
+		{"/docs/swagger-ui.css", http.StatusOK, "text/css; charset=utf-8"},
+		{"/docs/index.html", http.StatusNotFound, CONTENT_TYPE_PROBLEM},
+		{"/docs/swagger-initializer.js", http.StatusNotFound, CONTENT_TYPE_PROBLEM},
+		{"/docs/..%2fgo.mod", http.StatusNotFound, CONTENT_TYPE_PROBLEM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := get(tt.path)
+
+			if w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.want)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+type permissionQuery struct {
+	principal string
+	permission
+}
+
+type permissionAnswer struct {
+	allowed bool
+	expires time.Time
+}
+
+// Answers whether principals have permissions, remembering the auth service's answers for a
+// while so that every authenticated request doesn't cost an Authorize call. A change to a
+// principal's roles takes up to the TTL to take effect. Errors aren't remembered, and a TTL of 0
+// asks the auth service every time.
+type permissionCache struct {
+	authClient auth.AuthServiceClient
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	answers   map[permissionQuery]permissionAnswer
+	lastSweep time.Time
+}
+
+func newPermissionCache(authClient auth.AuthServiceClient, ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		authClient: authClient,
+		ttl:        ttl,
+		now:        time.Now,
+		answers:    map[permissionQuery]permissionAnswer{},
+	}
+}
+
+func (c *permissionCache) allowed(ctx context.Context, principal string, perm permission) (bool, error) {
+	query := permissionQuery{principal, perm}
+
+	c.mu.Lock()
+	answer, ok := c.answers[query]
+	c.mu.Unlock()
+
+	if ok && c.now().Before(answer.expires) {
+		return answer.allowed, nil
+	}
+
+	res, err := c.authClient.Authorize(ctx, &auth.AuthorizeRequest{
+		Principal: principal,
+		Action:    perm.action,
+		Resource:  perm.resource,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	if c.ttl > 0 {
+		c.remember(query, res.Allowed)
+	}
+
+	return res.Allowed, nil
+}
+
+// Stores an answer, and every TTL drops the answers that have expired so that principals who
+// have gone away don't stay in memory
+func (c *permissionCache) remember(query permissionQuery, allowed bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for q, answer := range c.answers {
+			if !now.Before(answer.expires) {
+				delete(c.answers, q)
+			}
+		}
+
+		c.lastSweep = now
+	}
+
+	c.answers[query] = permissionAnswer{allowed: allowed, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// An auth service that only answers Authorize, from a fixed set of permissions. Calling any other
+// RPC panics.
+type fakeRoleService struct {
+	auth.AuthServiceClient
+
+	granted map[string]bool
+	err     error
+	calls   int
+}
+
+func (s *fakeRoleService) Authorize(ctx context.Context, req *auth.AuthorizeRequest, opts ...grpc.CallOption) (*auth.AuthorizeResponse, error) {
+	s.calls++
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &auth.AuthorizeResponse{Allowed: s.granted[req.Principal+" "+req.Action+":"+req.Resource]}, nil
+}
+
+func TestPermissionCache(t *testing.T) {
+	readData := permission{"read", "data"}
+	writeData := permission{"write", "data"}
+
+	type check struct {
+		after       time.Duration
+		principal   string
+		perm        permission
+		unavailable bool
+		want        bool
+		wantErr     bool
+		wantCalls   int
+	}
+
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		checks []check
+	}{
+		{
+			name: "answers are reused within the TTL",
+			ttl:  5 * time.Second,
+			checks: []check{
+				{principal: "tony", perm: readData, want: true, wantCalls: 1},
+				{after: 4 * time.Second, principal: "tony", perm: readData, want: true, wantCalls: 1},
+				{after: 5 * time.Second, principal: "tony", perm: readData, want: true, wantCalls: 2},
+			},
+		},
+		{
+			name: "denials are reused too",
+			ttl:  5 * time.Second,
+			checks: []check{
+				{principal: "tony", perm: writeData, want: false, wantCalls: 1},
+				{after: time.Second, principal: "tony", perm: writeData, want: false, wantCalls: 1},
+			},
+		},
+		{
+			name: "answers are per principal and permission",
+			ttl:  5 * time.Second,
+			checks: []check{
+				{principal: "tony", perm: readData, want: true, wantCalls: 1},
+				{principal: "tony", perm: writeData, want: false, wantCalls: 2},
+				{principal: "alice", perm: readData, want: false, wantCalls: 3},
+				{principal: "tony", perm: readData, want: true, wantCalls: 3},
+			},
+		},
+		{
+			name: "errors aren't remembered",
+			ttl:  5 * time.Second,
+			checks: []check{
+				{principal: "tony", perm: readData, unavailable: true, wantErr: true, wantCalls: 1},
+				{principal: "tony", perm: readData, want: true, wantCalls: 2},
+			},
+		},
+		{
+			name: "no TTL always asks",
+			ttl:  0,
+			checks: []check{
+				{principal: "tony", perm: readData, want: true, wantCalls: 1},
+				{principal: "tony", perm: readData, want: true, wantCalls: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles := &fakeRoleService{granted: map[string]bool{"tony read:data": true}}
+
+			cache := newPermissionCache(roles, tt.ttl)
+
+			now := time.Now()
+			cache.now = func() time.Time { return now }
+
+			for i, c := range tt.checks {
+				now = now.Add(c.after)
+
+				roles.err = nil
+
+				if c.unavailable {
+					roles.err = status.Error(codes.Unavailable, "auth is down")
+				}
+
+				allowed, err := cache.allowed(context.Background(), c.principal, c.perm)
+
+				if (err != nil) != c.wantErr {
+					t.Fatalf("check %d: error = %v, want error: %t", i, err, c.wantErr)
+				}
+
+				if allowed != c.want {
+					t.Errorf("check %d: allowed = %t, want %t", i, allowed, c.want)
+				}
+
+				if roles.calls != c.wantCalls {
+					t.Errorf("check %d: %d calls to the auth service, want %d", i, roles.calls, c.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionCacheForgetsExpiredAnswers(t *testing.T) {
+	roles := &fakeRoleService{granted: map[string]bool{}}
+
+	cache := newPermissionCache(roles, time.Second)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for _, principal := range []string{"a", "b", "c"} {
+		if _, err := cache.allowed(context.Background(), principal, permission{"read", "data"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+
+	if _, err := cache.allowed(context.Background(), "d", permission{"read", "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache.answers) != 1 {
+		t.Errorf("%d answers remembered, want only the one that hasn't expired", len(cache.answers))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	CONTENT_TYPE_PROBLEM = "application/problem+json"
+
+	// Sent with 503 responses that don't say how long to wait themselves
+	RETRY_AFTER_SECONDS = 10
+
+	// Returned when the client goes away before the response is ready. It isn't a standard
+	// status, but nginx, which runs the ingress, uses it the same way.
+	STATUS_CLIENT_CLOSED_REQUEST = 499
+)
+
+// An RFC 7807 problem details object, which is the body of every error response. Code is a
+// stable identifier for the kind of problem that clients can rely on, while Detail is meant for
+// people and may change.
+type problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Code       string      `json:"code"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Violations []violation `json:"violations,omitempty"`
+	RetryAfter int64       `json:"retry_after_seconds,omitempty"`
+}
+
+// Something about the request that has to change before it can succeed, taken from the
+// google.rpc error details that a backend attached to its status
+type violation struct {
+	Field       string `json:"field,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description"`
+}
+
+func (p *problem) Error() string {
+	return p.Detail
+}
+
+// A problem that the web service found with a request itself, rather than one that a backend
+// reported
+func newProblem(status int, code, format string, args ...interface{}) *problem {
+	return &problem{Status: status, Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+// The HTTP status and stable code for each gRPC status code, following the mapping documented
+// in google/rpc/code.proto
+var grpcProblems = map[codes.Code]struct {
+	status int
+	code   string
+}{
+	codes.Canceled:           {STATUS_CLIENT_CLOSED_REQUEST, "CANCELLED"},
+	codes.Unknown:            {http.StatusInternalServerError, "UNKNOWN"},
+	codes.InvalidArgument:    {http.StatusBadRequest, "INVALID_ARGUMENT"},
+	codes.DeadlineExceeded:   {http.StatusGatewayTimeout, "DEADLINE_EXCEEDED"},
+	codes.NotFound:           {http.StatusNotFound, "NOT_FOUND"},
+	codes.AlreadyExists:      {http.StatusConflict, "ALREADY_EXISTS"},
+	codes.PermissionDenied:   {http.StatusForbidden, "PERMISSION_DENIED"},
+	codes.ResourceExhausted:  {http.StatusTooManyRequests, "RESOURCE_EXHAUSTED"},
+	codes.FailedPrecondition: {http.StatusBadRequest, "FAILED_PRECONDITION"},
+	codes.Aborted:            {http.StatusConflict, "ABORTED"},
+	codes.OutOfRange:         {http.StatusBadRequest, "OUT_OF_RANGE"},
+	codes.Unimplemented:      {http.StatusNotImplemented, "UNIMPLEMENTED"},
+	codes.Internal:           {http.StatusInternalServerError, "INTERNAL"},
+	codes.Unavailable:        {http.StatusServiceUnavailable, "UNAVAILABLE"},
+	codes.DataLoss:           {http.StatusInternalServerError, "DATA_LOSS"},
+	codes.Unauthenticated:    {http.StatusUnauthorized, "UNAUTHENTICATED"},
+}
+
+// What to tell the caller about statuses whose messages aren't meant for them. The backends put
+// their own errors, such as failed Redis calls, in those messages, so they're only logged.
+var opaqueDetails = map[codes.Code]string{
+	codes.Canceled:         "The request was cancelled",
+	codes.Unknown:          "Something went wrong",
+	codes.DeadlineExceeded: "The request took too long, try again later",
+	codes.Unimplemented:    "This isn't supported",
+	codes.Internal:         "Something went wrong",
+	codes.Unavailable:      "The service is unavailable, try again later",
+	codes.DataLoss:         "Something went wrong",
+}
+
+// Translates an error into a problem. Errors that are already problems are kept as they are,
+// anything else is treated as a gRPC status, and the status's details fill in the rest.
+func toProblem(err error) *problem {
+	if p, ok := err.(*problem); ok {
+		copied := *p
+		return &copied
+	}
+
+	st := status.Convert(err)
+
+	// Codes that gRPC doesn't define are treated as Unknown, including keeping their messages
+	// to ourselves
+	code := st.Code()
+
+	if _, ok := grpcProblems[code]; !ok {
+		code = codes.Unknown
+	}
+
+	mapping := grpcProblems[code]
+
+	p := &problem{Status: mapping.status, Code: mapping.code, Detail: st.Message()}
+
+	if detail, ok := opaqueDetails[code]; ok {
+		p.Detail = detail
+	}
+
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				p.Violations = append(p.Violations, violation{Field: v.Field, Description: v.Description})
+			}
+		case *errdetails.PreconditionFailure:
+			for _, v := range d.Violations {
+				p.Violations = append(p.Violations, violation{Subject: v.Subject, Type: v.Type, Description: v.Description})
+			}
+		case *errdetails.QuotaFailure:
+			for _, v := range d.Violations {
+				p.Violations = append(p.Violations, violation{Subject: v.Subject, Description: v.Description})
+			}
+		case *errdetails.RetryInfo:
+			if delay := d.RetryDelay.AsDuration(); d.RetryDelay.CheckValid() == nil && delay > 0 {
+				p.RetryAfter = int64((delay + time.Second - 1) / time.Second)
+			}
+		case *errdetails.LocalizedMessage:
+			p.Detail = d.Message
+		case *auth.AuthResponse:
+			// Refused logins say why, so that clients can tell a lockout from throttling
+			if d.Reason != auth.AuthFailureReason_NONE {
+				p.Code = d.Reason.String()
+			}
+
+			if d.RetryAfterSeconds > 0 {
+				p.RetryAfter = d.RetryAfterSeconds
+			}
+		}
+	}
+
+	if p.Status == http.StatusServiceUnavailable && p.RetryAfter == 0 {
+		p.RetryAfter = RETRY_AFTER_SECONDS
+	}
+
+	return p
+}
+
+// The problem for an error that happened while handling the request. Server-side errors are
+// logged in full, since the problem itself leaves out what went wrong.
+func problemFor(r *http.Request, err error) *problem {
+	p := toProblem(err)
+
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r.Context())
+
+	if p.Status == STATUS_CLIENT_CLOSED_REQUEST {
+		p.Title = "Client Closed Request"
+	}
+
+	if p.Status >= http.StatusInternalServerError {
+		logf(r.Context(), "%s %s failed: %v", r.Method, r.URL.Path, err)
+	}
+
+	return p
+}
+
+// Responds with the problem for an error. Handlers use this for every error response, instead
+// of http.Error.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problemFor(r, err)
+
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(p.RetryAfter, 10))
+	}
+
+	w.Header().Set("Content-Type", CONTENT_TYPE_PROBLEM)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+
+	json.NewEncoder(w).Encode(p)
+}
+
+// The stable code for a problem that only has an HTTP status to go on, such as "NOT_FOUND"
+func statusCode(status int) string {
+	return strings.ToUpper(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// Responds to requests for routes that don't exist
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newProblem(http.StatusNotFound, statusCode(http.StatusNotFound), "There's nothing at %s", r.URL.Path))
+}
+
+// Responds to requests for routes that exist, but not with the request's method
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newProblem(http.StatusMethodNotAllowed, statusCode(http.StatusMethodNotAllowed), "%s doesn't support %s", r.URL.Path, r.Method))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// A status error carrying the given details, as a backend would return it
+func statusWithDetails(t *testing.T, code codes.Code, message string, details ...proto.Message) error {
+	st, err := status.New(code, message).WithDetails(details...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st.Err()
+}
+
+func TestToProblem(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantDetail     string
+		wantViolations []violation
+		wantRetryAfter int64
+	}{
+		{
+			name:       "problem",
+			err:        newProblem(http.StatusRequestEntityTooLarge, "TOO_LARGE", "at most %d bytes", 10),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   "TOO_LARGE",
+			wantDetail: "at most 10 bytes",
+		},
+		{
+			name:       "not a status",
+			err:        errors.New("redis: connection refused"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   "UNKNOWN",
+			wantDetail: "Something went wrong",
+		},
+		{
+			name:       "unknown code",
+			err:        status.Error(codes.Code(99), "what"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   "UNKNOWN",
+			wantDetail: "Something went wrong",
+		},
+		{
+			name:       "client mistake",
+			err:        status.Error(codes.NotFound, "no such key"),
+			wantStatus: http.StatusNotFound,
+			wantCode:   "NOT_FOUND",
+			wantDetail: "no such key",
+		},
+		{
+			name:       "internal error is hidden",
+			err:        status.Error(codes.Internal, "redis: connection refused"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   "INTERNAL",
+			wantDetail: "Something went wrong",
+		},
+		{
+			name:       "cancelled",
+			err:        status.Error(codes.Canceled, "context canceled"),
+			wantStatus: STATUS_CLIENT_CLOSED_REQUEST,
+			wantCode:   "CANCELLED",
+			wantDetail: "The request was cancelled",
+		},
+		{
+			name:           "unavailable without a delay",
+			err:            status.Error(codes.Unavailable, "connection refused"),
+			wantStatus:     http.StatusServiceUnavailable,
+			wantCode:       "UNAVAILABLE",
+			wantDetail:     "The service is unavailable, try again later",
+			wantRetryAfter: RETRY_AFTER_SECONDS,
+		},
+		{
+			name: "retry delay is rounded up",
+			err: statusWithDetails(t, codes.Unavailable, "connection refused", &errdetails.RetryInfo{
+				RetryDelay: durationpb.New(1500 * time.Millisecond),
+			}),
+			wantStatus:     http.StatusServiceUnavailable,
+			wantCode:       "UNAVAILABLE",
+			wantDetail:     "The service is unavailable, try again later",
+			wantRetryAfter: 2,
+		},
+		{
+			name: "invalid retry delay",
+			err: statusWithDetails(t, codes.Unavailable, "connection refused", &errdetails.RetryInfo{
+				RetryDelay: &durationpb.Duration{Seconds: 1, Nanos: -1},
+			}),
+			wantStatus:     http.StatusServiceUnavailable,
+			wantCode:       "UNAVAILABLE",
+			wantDetail:     "The service is unavailable, try again later",
+			wantRetryAfter: RETRY_AFTER_SECONDS,
+		},
+		{
+			name: "field violations",
+			err: statusWithDetails(t, codes.InvalidArgument, "bad key", &errdetails.BadRequest{
+				FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "key", Description: "must not be empty"}},
+			}),
+			wantStatus:     http.StatusBadRequest,
+			wantCode:       "INVALID_ARGUMENT",
+			wantDetail:     "bad key",
+			wantViolations: []violation{{Field: "key", Description: "must not be empty"}},
+		},
+		{
+			name: "precondition violations",
+			err: statusWithDetails(t, codes.FailedPrecondition, "key exists", &errdetails.PreconditionFailure{
+				Violations: []*errdetails.PreconditionFailure_Violation{{Type: "VERSION", Subject: "foo", Description: "stale version"}},
+			}),
+			wantStatus:     http.StatusBadRequest,
+			wantCode:       "FAILED_PRECONDITION",
+			wantDetail:     "key exists",
+			wantViolations: []violation{{Subject: "foo", Type: "VERSION", Description: "stale version"}},
+		},
+		{
+			name: "quota violations",
+			err: statusWithDetails(t, codes.ResourceExhausted, "too many keys", &errdetails.QuotaFailure{
+				Violations: []*errdetails.QuotaFailure_Violation{{Subject: "user:tony", Description: "at most 100 keys"}},
+			}),
+			wantStatus:     http.StatusTooManyRequests,
+			wantCode:       "RESOURCE_EXHAUSTED",
+			wantDetail:     "too many keys",
+			wantViolations: []violation{{Subject: "user:tony", Description: "at most 100 keys"}},
+		},
+		{
+			name: "localized message replaces the hidden one",
+			err: statusWithDetails(t, codes.Unimplemented, "not yet", &errdetails.LocalizedMessage{
+				Locale:  "en-US",
+				Message: "Streaming isn't supported for this key",
+			}),
+			wantStatus: http.StatusNotImplemented,
+			wantCode:   "UNIMPLEMENTED",
+			wantDetail: "Streaming isn't supported for this key",
+		},
+		{
+			name: "refused login",
+			err: statusWithDetails(t, codes.ResourceExhausted, "too many failed attempts", &auth.AuthResponse{
+				Reason:            auth.AuthFailureReason_THROTTLED,
+				RetryAfterSeconds: 8,
+			}),
+			wantStatus:     http.StatusTooManyRequests,
+			wantCode:       "THROTTLED",
+			wantDetail:     "too many failed attempts",
+			wantRetryAfter: 8,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := toProblem(tt.err)
+
+			if p.Status != tt.wantStatus || p.Code != tt.wantCode || p.Detail != tt.wantDetail {
+				t.Errorf("toProblem() = %d %s %q, want %d %s %q", p.Status, p.Code, p.Detail, tt.wantStatus, tt.wantCode, tt.wantDetail)
+			}
+
+			if !reflect.DeepEqual(p.Violations, tt.wantViolations) {
+				t.Errorf("violations = %+v, want %+v", p.Violations, tt.wantViolations)
+			}
+
+			if p.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("retry after = %d, want %d", p.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+// Problems that handlers keep around, such as ones for a fixed limit, mustn't be changed by
+// being written
+func TestToProblemCopiesProblems(t *testing.T) {
+	original := newProblem(http.StatusBadRequest, "BAD", "bad")
+
+	problemFor(httptest.NewRequest(http.MethodGet, "/data/foo", nil), original)
+
+	if original.Instance != "" || original.Title != "" {
+		t.Errorf("problemFor() changed the original problem: %+v", original)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantTitle      string
+		wantRetryAfter string
+	}{
+		{"client mistake", status.Error(codes.NotFound, "no such key"), http.StatusNotFound, "Not Found", ""},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), http.StatusServiceUnavailable, "Service Unavailable", "10"},
+		{"client went away", status.Error(codes.Canceled, "context canceled"), STATUS_CLIENT_CLOSED_REQUEST, "Client Closed Request", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/data/foo", nil)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, "req-1"))
+
+			w := httptest.NewRecorder()
+
+			writeError(w, r, tt.err)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != CONTENT_TYPE_PROBLEM {
+				t.Errorf("Content-Type = %q, want %q", got, CONTENT_TYPE_PROBLEM)
+			}
+
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+
+			var p problem
+
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+
+			want := problem{
+				Type:      "about:blank",
+				Title:     tt.wantTitle,
+				Status:    tt.wantStatus,
+				Instance:  "/data/foo",
+				RequestID: "req-1",
+			}
+
+			if p.Type != want.Type || p.Title != want.Title || p.Status != want.Status || p.Instance != want.Instance || p.RequestID != want.RequestID {
+				t.Errorf("body = %+v, want %+v", p, want)
+			}
+		})
+	}
+}
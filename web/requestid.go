@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+
+	// The metadata key that carries the request ID to the backends
+	REQUEST_ID_METADATA = "x-request-id"
+)
+
+// Request IDs that clients or the ingress pass in are kept as long as they're short and can't be
+// used to forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// Gives every request an ID: the X-Request-ID that it came with, or a new one if it doesn't have
+// a usable one. The ID is put in the request context, from which it's forwarded to the backends
+// and added to log lines and error responses, and is sent back in the response's X-Request-ID
+// header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Could not generate a request ID: %v", err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Returns the ID of the request that the context belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Adds the request ID to the metadata of the calls made with the context, unless it's already
+// there
+func forwardRequestID(ctx context.Context) context.Context {
+	id := requestID(ctx)
+
+	if id == "" {
+		return ctx
+	}
+
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md[REQUEST_ID_METADATA]) > 0 {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA, id)
+}
+
+// Logs like log.Printf, prefixed with the ID of the request that the context belongs to
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		log.Printf("[%s] %s", id, fmt.Sprintf(format, args...))
+		return
+	}
+
+	log.Printf(format, args...)
+}
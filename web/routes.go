@@ -0,0 +1,322 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// A route that the web service handles itself, along with its entry in the OpenAPI document.
+// Routes are registered from this table and documented from it too, so that the two can't
+// disagree.
+type route struct {
+	method  string
+	pattern string
+	handler http.Handler
+
+	// Public routes sit outside the authentication layer, either because anyone may use them or
+	// because they authenticate callers themselves
+	public bool
+
+	// The permissions that an authenticated principal needs, on top of being authenticated
+	permissions []permission
+
+	doc *operation
+}
+
+// Adds the route to the router, behind checks for each of its permissions
+func (s *HttpServer) mount(r chi.Router, rt route) {
+	checks := []func(http.Handler) http.Handler{}
+
+	for _, perm := range rt.permissions {
+		checks = append(checks, s.require(perm.action, perm.resource))
+	}
+
+	r.With(checks...).Method(rt.method, rt.pattern, rt.handler)
+}
+
+// The router for the public port: the middleware that every request goes through, the public
+// routes, and the authenticated routes and REST gateway behind the authentication layer
+func (s *HttpServer) router(routes []route, proxies trustedProxies, gateway http.Handler) chi.Router {
+	r := chi.NewRouter()
+
+	// Gives every request an ID, which is passed on to the backends and sent back to the client so
+	// that the logs for a request can be matched up across services
+	r.Use(withRequestID)
+
+	// Records a span for every request, which the spans for its backend calls are children of
+	r.Use(s.trace)
+
+	// The Prometheus metrics middleware
+	r.Use(s.PrometheusMetrics)
+
+	// Takes the client IP from the headers set by the ingress, for per-client throttling in the auth service
+	r.Use(proxies.realIP)
+
+	r.NotFound(handleNotFound)
+
+	r.MethodNotAllowed(handleMethodNotAllowed)
+
+	// Public routes, such as the token endpoints, which authenticate callers themselves
+	for _, rt := range routes {
+		if rt.public {
+			s.mount(r, rt)
+		}
+	}
+
+	r.Group(func(r chi.Router) {
+		// The authentication layer
+		r.Use(s.authenticate)
+
+		for _, rt := range routes {
+			if !rt.public {
+				s.mount(r, rt)
+			}
+		}
+
+		// REST/JSON routes for the backends' RPCs, generated from their protos' HTTP annotations.
+		// Each RPC's permission is checked by the gateway itself.
+		r.Handle(GATEWAY_PATTERN, gateway)
+	})
+
+	return r
+}
+
+// The pattern of the route that handled the request, once it has been routed, or "unmatched"
+// for requests that no route matched. Metrics and traces are labelled with this rather than the
+// path, which has no limit on its values.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+
+	return "unmatched"
+}
+
+// The status that a handler responded with. Handlers that write a body without a status get a
+// 200.
+func responseStatus(ww middleware.WrapResponseWriter) int {
+	if status := ww.Status(); status != 0 {
+		return status
+	}
+
+	return http.StatusOK
+}
+
+// Every route that the web service handles itself. The REST gateway's routes come from the
+// backends' protos instead.
+func (s *HttpServer) routes() []route {
+	tokens := &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"token":              {Type: "string", Description: "An access token, to be sent in an Authorization: Bearer header"},
+			"expires_at":         {Type: "integer", Format: "int64", Description: "When the access token expires, in seconds since the epoch"},
+			"refresh_token":      {Type: "string", Description: "A refresh token, for getting a new access token from /token/refresh"},
+			"refresh_expires_at": {Type: "integer", Format: "int64", Description: "When the refresh token expires, in seconds since the epoch"},
+		},
+	}
+
+	return []route{
+		{
+			method:  http.MethodPost,
+			pattern: "/token",
+			handler: http.HandlerFunc(s.handleToken),
+			public:  true,
+			doc: &operation{
+				Summary: "Issues an access token and a refresh token in exchange for a username and password",
+				Parameters: []*parameter{
+					headerParameter("Username", "The user's name", true),
+					headerParameter("Password", "The user's password", true),
+				},
+				Responses: map[string]*response{
+					"200": {Description: "The issued tokens", Content: jsonContent(tokens)},
+					"401": {Description: "The username or password is missing or wrong"},
+					"403": {Description: "The account is temporarily locked; see the Retry-After header"},
+					"429": {Description: "Too many failed attempts from this client; see the Retry-After header"},
+					"503": {Description: "The auth service is unavailable; see the Retry-After header"},
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			pattern: "/token/refresh",
+			handler: http.HandlerFunc(s.handleRefreshToken),
+			public:  true,
+			doc: &operation{
+				Summary: "Exchanges a refresh token for a new access token and refresh token",
+				Parameters: []*parameter{
+					headerParameter("Refresh-Token", "A refresh token issued by /token or /token/refresh", true),
+				},
+				Responses: map[string]*response{
+					"200": {Description: "The issued tokens", Content: jsonContent(tokens)},
+					"400": {Description: "The Refresh-Token header is missing"},
+					"401": {Description: "The refresh token is invalid, expired or revoked"},
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			pattern: "/token/revoke",
+			handler: http.HandlerFunc(s.handleRevokeToken),
+			public:  true,
+			doc: &operation{
+				Summary: "Revokes an access token or refresh token",
+				Parameters: []*parameter{
+					headerParameter("Token", "The access token or refresh token to revoke", true),
+				},
+				Responses: map[string]*response{
+					"204": {Description: "The token has been revoked"},
+					"400": {Description: "The Token header is missing"},
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			pattern: "/openapi.json",
+			handler: http.HandlerFunc(s.handleOpenAPI),
+			public:  true,
+			doc: &operation{
+				Summary: "Returns this document",
+				Responses: map[string]*response{
+					"200": {Description: "An OpenAPI 3 document", Content: jsonContent(&schema{Type: "object"})},
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			pattern: "/docs",
+			handler: http.HandlerFunc(handleOpenAPIViewer),
+			public:  true,
+			doc: &operation{
+				Summary: "Shows this document in Swagger UI",
+				Responses: map[string]*response{
+					"200": {Description: "An HTML page", Content: map[string]*mediaType{CONTENT_TYPE_HTML: {Schema: &schema{Type: "string"}}}},
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			pattern: "/docs/{file}",
+			handler: http.HandlerFunc(handleSwaggerUI),
+			public:  true,
+			doc: &operation{
+				Summary: "Serves the Swagger UI files that /docs loads",
+				Parameters: []*parameter{
+					{Name: "file", In: "path", Description: "swagger-ui.css or swagger-ui-bundle.js", Required: true, Schema: &schema{Type: "string"}},
+				},
+				Responses: map[string]*response{
+					"200": {Description: "The file"},
+					"404": {Description: "There's no such file"},
+				},
+			},
+		},
+		{
+			method:      http.MethodPost,
+			pattern:     "/string",
+			handler:     http.HandlerFunc(s.handleString),
+			permissions: []permission{{"read", "data"}},
+			doc: &operation{
+				Summary: "Looks up a string in the data service",
+				Parameters: []*parameter{
+					headerParameter("String", "The string to look up", true),
+				},
+				Responses: map[string]*response{
+					"200": {Description: "The value stored for the string", Content: textContent()},
+					"400": {Description: "The String header is missing"},
+				},
+			},
+		},
+		{
+			method:      http.MethodGet,
+			pattern:     "/stream",
+			handler:     http.HandlerFunc(s.handleStream),
+			permissions: []permission{{"read", "data"}},
+			doc: &operation{
+				Summary: "Streams every item from the data service",
+				Description: "The format is negotiated using the Accept header. A JSON array is sent once the stream is " +
+					"finished; NDJSON and Server-Sent Events send each item as it arrives. NDJSON streams that fail " +
+					"partway end with an {\"error\": ...} line holding a problem, and event streams end with an end " +
+					"event, or an error event whose data is a problem.",
+				Parameters: []*parameter{
+					headerParameter("Accept", "One of application/json (the default), application/x-ndjson or text/event-stream", false),
+				},
+				Responses: map[string]*response{
+					"200": {
+						Description: "The items",
+						Content: map[string]*mediaType{
+							CONTENT_TYPE_JSON:         {Schema: &schema{Type: "array", Items: &schema{Type: "string"}}},
+							CONTENT_TYPE_NDJSON:       {Schema: &schema{Type: "string", Description: "A JSON string on each line"}},
+							CONTENT_TYPE_EVENT_STREAM: {Schema: &schema{Type: "string", Description: "An event with a JSON string payload for each item"}},
+						},
+					},
+					"406": {Description: "The Accept header accepts none of the formats"},
+				},
+			},
+		},
+		{
+			method:      http.MethodPut,
+			pattern:     "/stream",
+			handler:     http.HandlerFunc(s.handlePut),
+			permissions: []permission{{"write", "data"}},
+			doc: &operation{
+				Summary: "Uploads items to the data service",
+				Description: "Items are passed on to the data service as they're read. A malformed or oversized body " +
+					"abandons the upload, so the data service doesn't act on any of it.",
+				RequestBody: &requestBody{
+					Description: "The items to upload. Bodies without a Content-Type are read as plain text.",
+					Required:    true,
+					Content: map[string]*mediaType{
+						CONTENT_TYPE_JSON:   {Schema: &schema{Type: "array", Items: &schema{Type: "string"}}},
+						CONTENT_TYPE_NDJSON: {Schema: &schema{Type: "string", Description: "A JSON string on each line"}},
+						CONTENT_TYPE_TEXT:   {Schema: &schema{Type: "string", Description: "An item on each line"}},
+					},
+				},
+				Responses: map[string]*response{
+					"202": {Description: "The data service's response to the upload", Content: jsonContent(&schema{
+						Type:       "object",
+						Properties: map[string]*schema{"value": {Type: "string"}},
+					})},
+					"400": {Description: "The body is malformed"},
+					"413": {Description: "An item, or the number of items, is over the limit"},
+					"415": {Description: "The Content-Type isn't supported"},
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			pattern: "/ws",
+			handler: http.HandlerFunc(s.handleWebSocket),
+
+			// Exchanges messages with the data service both ways, so it needs both permissions. The
+			// checks happen once, when the connection is upgraded.
+			permissions: []permission{{"read", "data"}, {"write", "data"}},
+			doc: &operation{
+				Summary: "Exchanges messages with the data service over a WebSocket",
+				Description: "Each text frame is sent to the data service, and each of its responses comes back as a " +
+					"text frame. Binary frames close the connection with status 1003.",
+				Responses: map[string]*response{
+					"101": {Description: "The connection has been upgraded to a WebSocket"},
+					"400": {Description: "The request isn't a WebSocket handshake"},
+				},
+			},
+		},
+		{
+			method:      http.MethodGet,
+			pattern:     "/user",
+			handler:     http.HandlerFunc(s.handleUserInfo),
+			permissions: []permission{{"read", "userinfo"}},
+			doc: &operation{
+				Summary: "Looks up information about a user",
+				Parameters: []*parameter{
+					queryParameter("username", "The user to look up. Callers look themselves up if it's left out.", false),
+				},
+				Responses: map[string]*response{
+					"200": {Description: "The user's information", Content: textContent()},
+				},
+			},
+		},
+	}
+}
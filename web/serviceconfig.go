@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Default service configs for each backend, in the gRPC service config JSON format
+// (https://github.com/grpc/grpc/blob/master/doc/service_config.md). Only calls that are safe to
+// repeat are retried: logins count failed attempts and refresh tokens can only be used once, so
+// retrying either of those could lock users out or revoke their tokens.
+const (
+	AUTH_SERVICE_CONFIG = `{
+  "methodConfig": [
+    {
+      "name": [{"service": "auth.AuthService"}],
+      "timeout": "2s"
+    },
+    {
+      "name": [
+        {"service": "auth.AuthService", "method": "Authorize"},
+        {"service": "auth.AuthService", "method": "AuthenticateApiKey"},
+        {"service": "auth.AuthService", "method": "PublicKey"},
+        {"service": "auth.AuthService", "method": "RevokedTokens"},
+        {"service": "auth.AuthService", "method": "ValidateToken"}
+      ],
+      "timeout": "2s",
+      "retryPolicy": {
+        "maxAttempts": 3,
+        "initialBackoff": "0.05s",
+        "maxBackoff": "0.5s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    }
+  ],
+  "retryThrottling": {"maxTokens": 10, "tokenRatio": 0.1}
+}`
+
+	DATA_SERVICE_CONFIG = `{
+  "methodConfig": [
+    {
+      "name": [{"service": "data.DataService", "method": "Get"}],
+      "timeout": "2s",
+      "retryPolicy": {
+        "maxAttempts": 3,
+        "initialBackoff": "0.1s",
+        "maxBackoff": "1s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    },
+    {
+      "name": [
+        {"service": "data.DataService", "method": "StreamingGet"},
+        {"service": "data.DataService", "method": "StreamingPut"}
+      ],
+      "timeout": "10s"
+    }
+  ],
+  "retryThrottling": {"maxTokens": 10, "tokenRatio": 0.1}
+}`
+
+	USERINFO_SERVICE_CONFIG = `{
+  "methodConfig": [
+    {
+      "name": [{"service": "userinfo.UserInfo", "method": "GetUserInfo"}],
+      "timeout": "2s",
+      "retryPolicy": {
+        "maxAttempts": 3,
+        "initialBackoff": "0.1s",
+        "maxBackoff": "1s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    }
+  ],
+  "retryThrottling": {"maxTokens": 10, "tokenRatio": 0.1}
+}`
+)
+
+// Adds the balancer to a backend's service config. gRPC applies the rest of it to every call:
+// the timeouts, which cover every attempt of a call, the retry policies, and the retry budget
+// (retryThrottling), which stops retries while a backend is failing a lot so that they can't pile
+// extra load onto it. gRPC checks the config itself when the backend is dialed.
+func serviceConfigWithBalancer(js, balancer string) (string, error) {
+	var sc map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(js), &sc); err != nil {
+		return "", fmt.Errorf("a service config must be a JSON object: %v", err)
+	}
+
+	if sc == nil {
+		sc = map[string]json.RawMessage{}
+	}
+
+	lb, err := json.Marshal([]map[string]struct{}{{balancer: {}}})
+
+	if err != nil {
+		return "", err
+	}
+
+	sc["loadBalancingConfig"] = lb
+
+	out, err := json.Marshal(sc)
+
+	return string(out), err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestServiceConfigWithBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr bool
+	}{
+		{"empty", `{}`, `{"loadBalancingConfig":[{"colossus_round_robin":{}}]}`, false},
+		{"null", `null`, `{"loadBalancingConfig":[{"colossus_round_robin":{}}]}`, false},
+		{"kept", `{"methodConfig":[{"timeout":"1s"}]}`, `{"loadBalancingConfig":[{"colossus_round_robin":{}}],"methodConfig":[{"timeout":"1s"}]}`, false},
+		{"balancer replaced", `{"loadBalancingConfig":[{"pick_first":{}}]}`, `{"loadBalancingConfig":[{"colossus_round_robin":{}}]}`, false},
+		{"not JSON", `methodConfig`, "", true},
+		{"not an object", `[]`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serviceConfigWithBalancer(tt.config, balancerNames[BALANCER_ROUND_ROBIN])
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serviceConfigWithBalancer() error = %v, want error: %t", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !jsonEqual(t, got, tt.want) {
+				t.Errorf("serviceConfigWithBalancer() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func jsonEqual(t *testing.T, a, b string) bool {
+	var x, y interface{}
+
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatal(err)
+	}
+
+	return reflect.DeepEqual(x, y)
+}
+
+// gRPC checks the default service config when dialing, so the defaults have to pass its checks
+// along with the balancers, and configs that it would reject have to fail the dial
+func TestServiceConfigsAreAcceptedByGRPC(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"auth", AUTH_SERVICE_CONFIG, false},
+		{"data", DATA_SERVICE_CONFIG, false},
+		{"userinfo", USERINFO_SERVICE_CONFIG, false},
+		{"method configured twice", `{"methodConfig": [{"name": [{"service": "data.DataService"}], "timeout": "1s"}, {"name": [{"service": "data.DataService"}], "timeout": "2s"}]}`, true},
+		{"invalid timeout", `{"methodConfig": [{"name": [{"service": "data.DataService"}], "timeout": "soon"}]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, setting := range []string{BALANCER_ROUND_ROBIN, BALANCER_LEAST_REQUEST} {
+				sc, err := serviceConfigWithBalancer(tt.config, balancerNames[setting])
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				conn, err := grpc.Dial("passthrough:///localhost:1",
+					grpc.WithTransportCredentials(insecure.NewCredentials()),
+					grpc.WithDefaultServiceConfig(sc),
+				)
+
+				if err == nil {
+					conn.Close()
+				}
+
+				if (err != nil) != tt.wantErr {
+					t.Errorf("dialing with the %s balancer: %v, want error: %t", setting, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
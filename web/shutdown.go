@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Blocks until the process is asked to stop, which Kubernetes does with SIGTERM
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	return <-signals
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE_JSON         = "application/json"
+	CONTENT_TYPE_NDJSON       = "application/x-ndjson"
+	CONTENT_TYPE_EVENT_STREAM = "text/event-stream"
+)
+
+// Picks the first of the offered content types that the request's Accept header accepts, going
+// by the header's quality values and then by the order of the offers. Requests without an Accept
+// header get the first offer, and ok is false if the header accepts none of them.
+func negotiate(r *http.Request, offers ...string) (contentType string, ok bool) {
+	accept := r.Header.Get("Accept")
+
+	if accept == "" {
+		return offers[0], true
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, best != ""
+}
+
+// The quality value that an Accept header gives a content type, with exact matches taking
+// precedence over "type/*" and "*/*"
+func acceptQuality(accept, contentType string) float64 {
+	q, specificity := 0.0, -1
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err != nil {
+			continue
+		}
+
+		var s int
+
+		switch {
+		case mediaType == contentType:
+			s = 2
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")):
+			s = 1
+		case mediaType == "*/*":
+			s = 0
+		default:
+			continue
+		}
+
+		if s < specificity {
+			continue
+		}
+
+		partQ := 1.0
+
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				partQ = parsed
+			}
+		}
+
+		q, specificity = partQ, s
+	}
+
+	return q
+}
+
+// Writes items to the client one at a time as they arrive
+type itemWriter interface {
+	item(value string) error
+
+	// Reports a problem that happened after the response had started, when it's too late to
+	// change the status code
+	fail(p *problem)
+
+	end()
+}
+
+// Starts a streaming response in the given content type, which must be NDJSON or SSE
+func newItemWriter(w http.ResponseWriter, contentType string) itemWriter {
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Stops nginx, which runs the ingress, from buffering the response
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	w.WriteHeader(http.StatusOK)
+
+	if contentType == CONTENT_TYPE_EVENT_STREAM {
+		return &eventStreamWriter{w: w, flusher: flusher}
+	}
+
+	return &ndjsonWriter{w: w, flusher: flusher}
+}
+
+func flush(flusher http.Flusher) {
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Writes each item as a JSON value on its own line, and a problem as a final {"error": ...}
+// object
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (n *ndjsonWriter) write(v interface{}) error {
+	line, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := n.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	flush(n.flusher)
+
+	return nil
+}
+
+func (n *ndjsonWriter) item(value string) error {
+	return n.write(value)
+}
+
+func (n *ndjsonWriter) fail(p *problem) {
+	n.write(map[string]*problem{"error": p})
+}
+
+func (n *ndjsonWriter) end() {}
+
+// Writes each item as a Server-Sent Event with a JSON payload. The stream finishes with an "end"
+// event, or an "error" event if it fails, so that browsers know not to reconnect.
+type eventStreamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	id      int
+}
+
+func (e *eventStreamWriter) write(event string, v interface{}) error {
+	payload, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	if event != "" {
+		_, err = fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, payload)
+	} else {
+		e.id++
+		_, err = fmt.Fprintf(e.w, "id: %d\ndata: %s\n\n", e.id, payload)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	flush(e.flusher)
+
+	return nil
+}
+
+func (e *eventStreamWriter) item(value string) error {
+	return e.write("", value)
+}
+
+func (e *eventStreamWriter) fail(p *problem) {
+	e.write("error", p)
+}
+
+func (e *eventStreamWriter) end() {
+	e.write("end", nil)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucperkins/colossus/proto/data"
+	"github.com/unrolled/render"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		want        float64
+	}{
+		{"application/json", "application/json", 1},
+		{"application/json", "application/x-ndjson", 0},
+		{"application/json;q=0.5", "application/json", 0.5},
+		{"application/json; q=0.5", "application/json", 0.5},
+		{"application/json;q=0", "application/json", 0},
+		{"application/*", "application/x-ndjson", 1},
+		{"application/*;q=0.3", "application/json", 0.3},
+		{"application/*", "text/event-stream", 0},
+		{"*/*", "text/event-stream", 1},
+		{"*/*;q=0.1", "text/event-stream", 0.1},
+		{"text/html, application/json;q=0.9", "application/json", 0.9},
+
+		// The most specific match wins, whatever order the header lists them in
+		{"*/*;q=0.1, application/json;q=0.8", "application/json", 0.8},
+		{"application/json;q=0.8, */*;q=0.1", "application/json", 0.8},
+		{"application/*;q=0.2, application/json;q=0.7, */*;q=1", "application/json", 0.7},
+		{"application/json;q=0, */*", "application/json", 0},
+		{"application/*;q=0.4, */*", "application/json", 0.4},
+
+		// Malformed parts and quality values are skipped rather than failing the whole header
+		{"application/json;q=high", "application/json", 1},
+		{"nonsense;;, application/json;q=0.6", "application/json", 0.6},
+		{"", "application/json", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept+" "+tt.contentType, func(t *testing.T) {
+			if got := acceptQuality(tt.accept, tt.contentType); got != tt.want {
+				t.Errorf("acceptQuality(%q, %q) = %g, want %g", tt.accept, tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{CONTENT_TYPE_JSON, CONTENT_TYPE_NDJSON, CONTENT_TYPE_EVENT_STREAM}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+		wantOK bool
+	}{
+		{"no Accept header", "", CONTENT_TYPE_JSON, true},
+		{"exact", CONTENT_TYPE_NDJSON, CONTENT_TYPE_NDJSON, true},
+		{"event stream", CONTENT_TYPE_EVENT_STREAM, CONTENT_TYPE_EVENT_STREAM, true},
+		{"anything", "*/*", CONTENT_TYPE_JSON, true},
+		{"ties go to the first offer", "application/*", CONTENT_TYPE_JSON, true},
+		{"highest quality", "application/json;q=0.5, text/event-stream;q=0.9", CONTENT_TYPE_EVENT_STREAM, true},
+		{"wildcard below an exact match", "*/*;q=0.1, application/x-ndjson", CONTENT_TYPE_NDJSON, true},
+		{"wildcard with an exclusion", "application/*, application/json;q=0", CONTENT_TYPE_NDJSON, true},
+		{"unsupported types alongside", "text/html, application/x-ndjson;q=0.2", CONTENT_TYPE_NDJSON, true},
+		{"no match", "text/html", "", false},
+		{"everything excluded", "application/json;q=0, application/x-ndjson;q=0, text/*;q=0", "", false},
+		{"malformed", ";;", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			got, ok := negotiate(r, offers...)
+
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("negotiate(%q) = %q, %t, want %q, %t", tt.accept, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestItemWriters(t *testing.T) {
+	failure := &problem{Status: http.StatusServiceUnavailable, Code: "UNAVAILABLE", Detail: "gone"}
+
+	tests := []struct {
+		name        string
+		contentType string
+		items       []string
+		fail        *problem
+		want        string
+	}{
+		{"NDJSON", CONTENT_TYPE_NDJSON, []string{"a", `b"c`}, nil, "\"a\"\n\"b\\\"c\"\n"},
+		{"NDJSON without items", CONTENT_TYPE_NDJSON, nil, nil, ""},
+		{
+			"NDJSON failure",
+			CONTENT_TYPE_NDJSON,
+			[]string{"a"},
+			failure,
+			"\"a\"\n" + `{"error":{"type":"","title":"","status":503,"detail":"gone","code":"UNAVAILABLE"}}` + "\n",
+		},
+		{
+			"event stream",
+			CONTENT_TYPE_EVENT_STREAM,
+			[]string{"a", "b\nc"},
+			nil,
+			"id: 1\ndata: \"a\"\n\nid: 2\ndata: \"b\\nc\"\n\nevent: end\ndata: null\n\n",
+		},
+		{"event stream without items", CONTENT_TYPE_EVENT_STREAM, nil, nil, "event: end\ndata: null\n\n"},
+		{
+			"event stream failure",
+			CONTENT_TYPE_EVENT_STREAM,
+			[]string{"a"},
+			failure,
+			"id: 1\ndata: \"a\"\n\nevent: error\ndata: " + `{"type":"","title":"","status":503,"detail":"gone","code":"UNAVAILABLE"}` + "\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			items := newItemWriter(w, tt.contentType)
+
+			for _, item := range tt.items {
+				if err := items.item(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.fail != nil {
+				items.fail(tt.fail)
+			} else {
+				items.end()
+			}
+
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			for header, want := range map[string]string{
+				"Content-Type":      tt.contentType,
+				"Cache-Control":     "no-cache",
+				"X-Accel-Buffering": "no",
+			} {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+
+			if !w.Flushed && len(tt.items) > 0 {
+				t.Error("items weren't flushed as they were written")
+			}
+
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A data service that streams a fixed list of items and then ends the stream with err, or
+// cleanly if it's nil
+type fakeStreamService struct {
+	data.DataServiceClient
+
+	items []string
+	err   error
+	calls int
+}
+
+func (s *fakeStreamService) StreamingGet(ctx context.Context, req *data.EmptyRequest, opts ...grpc.CallOption) (data.DataService_StreamingGetClient, error) {
+	s.calls++
+
+	return &fakeGetStream{items: s.items, err: s.err}, nil
+}
+
+type fakeGetStream struct {
+	grpc.ClientStream
+
+	items []string
+	err   error
+}
+
+func (s *fakeGetStream) Recv() (*data.DataResponse, error) {
+	if len(s.items) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		return nil, io.EOF
+	}
+
+	item := s.items[0]
+	s.items = s.items[1:]
+
+	return &data.DataResponse{Value: item}, nil
+}
+
+// The code of the problem on the last line of a body, which is either a problem itself or an NDJSON
+// stream that ends with one
+func lastProblemCode(t *testing.T, body string) string {
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+
+	var last struct {
+		problem
+		Error *problem `json:"error"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("the body doesn't end with a problem: %q", body)
+	}
+
+	if last.Error != nil {
+		return last.Error.Code
+	}
+
+	return last.Code
+}
+
+func TestHandleStream(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "data is down")
+
+	tests := []struct {
+		name            string
+		accept          string
+		err             error
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+
+		// The code of the problem that the body ends with, for failures
+		wantCode  string
+		wantCalls int
+	}{
+		{"JSON by default", "", nil, http.StatusOK, CONTENT_TYPE_JSON, `["a","b"]`, "", 1},
+		{"NDJSON", CONTENT_TYPE_NDJSON, nil, http.StatusOK, CONTENT_TYPE_NDJSON, "\"a\"\n\"b\"\n", "", 1},
+		{"event stream", CONTENT_TYPE_EVENT_STREAM, nil, http.StatusOK, CONTENT_TYPE_EVENT_STREAM, "id: 1\ndata: \"a\"\n\nid: 2\ndata: \"b\"\n\nevent: end\ndata: null\n\n", "", 1},
+		{"JSON failure", CONTENT_TYPE_JSON, unavailable, http.StatusServiceUnavailable, CONTENT_TYPE_PROBLEM, "", "UNAVAILABLE", 1},
+
+		// Once items have gone out the status can't change, so the failure is reported in the stream
+		{"NDJSON failure", CONTENT_TYPE_NDJSON, unavailable, http.StatusOK, CONTENT_TYPE_NDJSON, "", "UNAVAILABLE", 1},
+
+		// The data service isn't asked for a stream that can't be sent
+		{"not acceptable", "text/html", nil, http.StatusNotAcceptable, CONTENT_TYPE_PROBLEM, "", "NOT_ACCEPTABLE", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &fakeStreamService{items: []string{"a", "b"}, err: tt.err}
+
+			s := &HttpServer{
+				dataClient: service,
+				renderer:   render.New(render.Options{}),
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+
+			s.handleStream(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if got, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+
+			if tt.wantCode != "" {
+				if code := lastProblemCode(t, w.Body.String()); code != tt.wantCode {
+					t.Errorf("body = %q, want it to end with a %s problem", w.Body, tt.wantCode)
+				}
+			} else if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+
+			if service.calls != tt.wantCalls {
+				t.Errorf("%d calls to StreamingGet, want %d", service.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lucperkins/colossus/proto/auth"
+)
+
+const (
+	TOKEN_ISSUER = "colossus-auth"
+
+	// The auth service is asked for its public key at most this often, so that tokens
+	// carrying unknown key IDs can't be used to flood it with requests
+	PUBLIC_KEY_REFRESH_INTERVAL = 30 * time.Second
+
+	// How often the list of revoked tokens is fetched from the auth service
+	REVOCATION_REFRESH_INTERVAL = 10 * time.Second
+)
+
+// Returned by verify until the revocation list has been fetched, since until then there's no
+// telling whether a token has been revoked
+var errRevocationsNotLoaded = errors.New("the token revocation list hasn't been loaded yet")
+
+// Mirrors the claims of the access tokens issued by the auth service
+type tokenClaims struct {
+	Family string `json:"fam,omitempty"`
+	jwt.StandardClaims
+}
+
+// Verifies access tokens locally using the public keys published by the auth service
+type tokenVerifier struct {
+	authClient auth.AuthServiceClient
+
+	mu          sync.RWMutex
+	keys        map[string]*ecdsa.PublicKey
+	lastRefresh time.Time
+
+	// Nil until the revocation list has been fetched for the first time
+	revokedMu sync.RWMutex
+	revoked   map[string]struct{}
+}
+
+func newTokenVerifier(authClient auth.AuthServiceClient) *tokenVerifier {
+	return &tokenVerifier{
+		authClient: authClient,
+		keys:       map[string]*ecdsa.PublicKey{},
+	}
+}
+
+// Replaces the locally cached revocation list with the auth service's current one
+func (v *tokenVerifier) refreshRevocations(ctx context.Context) error {
+	res, err := v.authClient.RevokedTokens(ctx, &auth.RevokedTokensRequest{})
+
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]struct{}, len(res.Ids))
+
+	for _, id := range res.Ids {
+		revoked[id] = struct{}{}
+	}
+
+	v.revokedMu.Lock()
+	v.revoked = revoked
+	v.revokedMu.Unlock()
+
+	return nil
+}
+
+func (v *tokenVerifier) runRevocationRefresh() {
+	ticker := time.NewTicker(REVOCATION_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), REVOCATION_REFRESH_INTERVAL)
+
+		if err := v.refreshRevocations(ctx); err != nil {
+			log.Printf("Could not refresh the token revocation list: %v", err)
+		}
+
+		cancel()
+
+		<-ticker.C
+	}
+}
+
+// Reports whether the revocation list has been fetched yet
+func (v *tokenVerifier) revocationsLoaded() bool {
+	v.revokedMu.RLock()
+	defer v.revokedMu.RUnlock()
+
+	return v.revoked != nil
+}
+
+// Fails closed: until the revocation list has been fetched, every token counts as revoked
+func (v *tokenVerifier) isRevoked(ids ...string) (bool, error) {
+	v.revokedMu.RLock()
+	defer v.revokedMu.RUnlock()
+
+	if v.revoked == nil {
+		return true, errRevocationsNotLoaded
+	}
+
+	for _, id := range ids {
+		if _, ok := v.revoked[id]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns the public key with the given ID, fetching the auth service's current key if it isn't
+// known yet. The lock isn't held while the auth service is being asked, so that a slow call
+// doesn't hold up requests signed with keys that are already known.
+func (v *tokenVerifier) publicKey(ctx context.Context, keyID string) (*ecdsa.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[keyID]
+	v.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	v.mu.Lock()
+
+	if key, ok := v.keys[keyID]; ok {
+		v.mu.Unlock()
+		return key, nil
+	}
+
+	if time.Since(v.lastRefresh) < PUBLIC_KEY_REFRESH_INTERVAL {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+
+	// Claimed before fetching, so that only one request at a time goes to the auth service
+	v.lastRefresh = time.Now()
+
+	v.mu.Unlock()
+
+	res, err := v.authClient.PublicKey(ctx, &auth.PublicKeyRequest{})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch public key from auth service: %v", err)
+	}
+
+	key, err = jwt.ParseECPublicKeyFromPEM([]byte(res.PublicKey))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key %q: %v", res.KeyId, err)
+	}
+
+	v.mu.Lock()
+	v.keys[res.KeyId] = key
+	v.mu.Unlock()
+
+	if res.KeyId != keyID {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+
+	return key, nil
+}
+
+// Verifies the token and returns the username that it was issued to
+func (v *tokenVerifier) verify(ctx context.Context, tokenString string) (string, error) {
+	claims := &tokenClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		keyID, _ := token.Header["kid"].(string)
+
+		return v.publicKey(ctx, keyID)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if claims.ExpiresAt == 0 {
+		return "", fmt.Errorf("token has no expiry")
+	}
+
+	if !claims.VerifyIssuer(TOKEN_ISSUER, true) {
+		return "", fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+
+	revoked, err := v.isRevoked(claims.Id, claims.Family)
+
+	if err != nil {
+		return "", err
+	}
+
+	if revoked {
+		return "", fmt.Errorf("token %s has been revoked", claims.Id)
+	}
+
+	return claims.Subject, nil
+}
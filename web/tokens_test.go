@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lucperkins/colossus/proto/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const TEST_KEY_ID = "test-key"
+
+// An auth service that only publishes its public key and revoked tokens. Calling any other RPC
+// panics.
+type fakeKeyService struct {
+	auth.AuthServiceClient
+
+	keyID     string
+	publicKey string
+	calls     int32
+
+	revoked    []string
+	revokedErr error
+}
+
+func (s *fakeKeyService) PublicKey(ctx context.Context, req *auth.PublicKeyRequest, opts ...grpc.CallOption) (*auth.PublicKeyResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+
+	return &auth.PublicKeyResponse{KeyId: s.keyID, PublicKey: s.publicKey}, nil
+}
+
+func (s *fakeKeyService) RevokedTokens(ctx context.Context, req *auth.RevokedTokensRequest, opts ...grpc.CallOption) (*auth.RevokedTokensResponse, error) {
+	if s.revokedErr != nil {
+		return nil, s.revokedErr
+	}
+
+	return &auth.RevokedTokensResponse{Ids: s.revoked}, nil
+}
+
+func newSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, keyID string, claims *tokenClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+
+	token.Header["kid"] = keyID
+
+	signed, err := token.SignedString(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	key, publicKeyPEM := newSigningKey(t)
+	otherKey, _ := newSigningKey(t)
+
+	// The claims of a token that the auth service would issue, changed as the test needs
+	claims := func(change func(c *tokenClaims)) *tokenClaims {
+		c := &tokenClaims{
+			Family: "family",
+			StandardClaims: jwt.StandardClaims{
+				Id:        "token",
+				Issuer:    TOKEN_ISSUER,
+				Subject:   "tony",
+				IssuedAt:  time.Now().Unix(),
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+		}
+
+		if change != nil {
+			change(c)
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(nil)),
+			want:  "tony",
+		},
+		{
+			name: "expired",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(func(c *tokenClaims) {
+				c.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+			})),
+			wantErr: true,
+		},
+		{
+			name: "no expiry",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(func(c *tokenClaims) {
+				c.ExpiresAt = 0
+			})),
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(func(c *tokenClaims) {
+				c.Issuer = "someone-else"
+			})),
+			wantErr: true,
+		},
+		{
+			name:    "signed with another key",
+			token:   signToken(t, jwt.SigningMethodES256, otherKey, TEST_KEY_ID, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "unknown key ID",
+			token:   signToken(t, jwt.SigningMethodES256, otherKey, "other-key", claims(nil)),
+			wantErr: true,
+		},
+		{
+			// The public key is no secret, so accepting it as an HMAC secret would let anyone
+			// sign tokens
+			name:    "HMAC signed with the public key",
+			token:   signToken(t, jwt.SigningMethodHS256, []byte(publicKeyPEM), TEST_KEY_ID, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "unsigned",
+			token:   signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, TEST_KEY_ID, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name: "revoked token",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(func(c *tokenClaims) {
+				c.Id = "revoked-token"
+			})),
+			wantErr: true,
+		},
+		{
+			name: "revoked family",
+			token: signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, claims(func(c *tokenClaims) {
+				c.Family = "revoked-family"
+			})),
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			token:   "not.a.token",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTokenVerifier(&fakeKeyService{keyID: TEST_KEY_ID, publicKey: publicKeyPEM})
+
+			v.revoked = map[string]struct{}{"revoked-token": {}, "revoked-family": {}}
+
+			got, err := v.verify(context.Background(), tt.token)
+
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("verify() = %q, %v, want %q with error: %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Tokens with made-up key IDs mustn't each send the web service off to the auth service
+func TestTokenVerifierPublicKeyRefreshIsRateLimited(t *testing.T) {
+	key, publicKeyPEM := newSigningKey(t)
+
+	keys := &fakeKeyService{keyID: TEST_KEY_ID, publicKey: publicKeyPEM}
+
+	v := newTokenVerifier(keys)
+
+	for _, keyID := range []string{"made-up-1", "made-up-2", "made-up-3"} {
+		if _, err := v.publicKey(context.Background(), keyID); err == nil {
+			t.Errorf("publicKey(%q) succeeded", keyID)
+		}
+	}
+
+	if keys.calls != 1 {
+		t.Errorf("the auth service was asked for its key %d times, want 1", keys.calls)
+	}
+
+	// The key fetched along the way is cached, so the real key ID still works
+	got, err := v.publicKey(context.Background(), TEST_KEY_ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.X.Cmp(key.PublicKey.X) != 0 || got.Y.Cmp(key.PublicKey.Y) != 0 {
+		t.Error("publicKey() returned the wrong key")
+	}
+
+	if keys.calls != 1 {
+		t.Errorf("the auth service was asked for its key %d times, want 1", keys.calls)
+	}
+}
+
+// Until the revocation list has been fetched there's no telling whether a token has been revoked,
+// so none are accepted
+func TestTokenVerifierFailsClosedUntilRevocationsAreLoaded(t *testing.T) {
+	key, publicKeyPEM := newSigningKey(t)
+
+	keys := &fakeKeyService{
+		keyID:      TEST_KEY_ID,
+		publicKey:  publicKeyPEM,
+		revokedErr: status.Error(codes.Unavailable, "auth is down"),
+	}
+
+	v := newTokenVerifier(keys)
+
+	token := signToken(t, jwt.SigningMethodES256, key, TEST_KEY_ID, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "token",
+			Issuer:    TOKEN_ISSUER,
+			Subject:   "tony",
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	})
+
+	if _, err := v.verify(context.Background(), token); err != errRevocationsNotLoaded {
+		t.Fatalf("verify() before the revocation list is loaded = %v, want errRevocationsNotLoaded", err)
+	}
+
+	if err := v.refreshRevocations(context.Background()); err == nil {
+		t.Fatal("refreshRevocations() succeeded while the auth service is down")
+	}
+
+	if _, err := v.verify(context.Background(), token); err != errRevocationsNotLoaded {
+		t.Fatalf("verify() after a failed load = %v, want errRevocationsNotLoaded", err)
+	}
+
+	keys.revokedErr = nil
+
+	if err := v.refreshRevocations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.revocationsLoaded() {
+		t.Error("the revocation list isn't loaded after a successful refresh")
+	}
+
+	got, err := v.verify(context.Background(), token)
+
+	if err != nil || got != "tony" {
+		t.Errorf("verify() once loaded = %q, %v, want tony", got, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name that the web service's own spans are recorded under
+const TRACER_NAME = "github.com/lucperkins/colossus/web"
+
+// Records a server span for every request, continuing the trace from the request's traceparent
+// header if it has one. Spans are named after the route that handled the request, such as
+// "GET /stream", rather than the path, so that requests for the same route group together.
+func (s *HttpServer) trace(next http.Handler) http.Handler {
+	tracer := otel.Tracer(TRACER_NAME)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := routePattern(r)
+
+		status := responseStatus(ww)
+
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.Int("http.status_code", status),
+			attribute.String("http.request_id", requestID(ctx)),
+		)
+
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		span.End()
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE_TEXT = "text/plain"
+
+	// The defaults for the upload limit settings
+	MAX_UPLOAD_ITEM_SIZE = 64 * 1024
+	MAX_UPLOAD_ITEMS     = 10000
+
+	// A JSON string can take up to six bytes per character (\uXXXX), so its encoded form may be
+	// that much longer than the item it decodes to
+	MAX_JSON_ESCAPE_RATIO = 6
+)
+
+func malformed(format string, args ...interface{}) error {
+	return newProblem(http.StatusBadRequest, "MALFORMED_BODY", format, args...)
+}
+
+func tooLarge(format string, args ...interface{}) error {
+	return newProblem(http.StatusRequestEntityTooLarge, "ITEM_TOO_LARGE", format, args...)
+}
+
+// The problem for a failure to read an upload. The readers report what's wrong with the body
+// as problems themselves, so anything else means the body couldn't be read at all.
+func unreadable(err error) error {
+	if _, ok := err.(*problem); ok {
+		return err
+	}
+
+	return newProblem(http.StatusBadRequest, "UNREADABLE_BODY", "could not read the request body: %v", err)
+}
+
+// Reads the items of an upload one at a time, so that each can be passed on as soon as it has
+// been parsed. next returns io.EOF once the body is finished.
+type itemReader interface {
+	next() (string, error)
+}
+
+// Picks the reader for the request body's content type: a JSON array of strings, NDJSON with a
+// JSON string on each line, or plain text with an item on each line. Bodies without a content
+// type are read as plain text.
+func newItemReader(r *http.Request, maxItemSize int) (itemReader, error) {
+	contentType := CONTENT_TYPE_TEXT
+
+	if header := r.Header.Get("Content-Type"); header != "" {
+		mediaType, _, err := mime.ParseMediaType(header)
+
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, "INVALID_HEADER", "invalid Content-Type: %v", err)
+		}
+
+		contentType = mediaType
+	}
+
+	switch contentType {
+	case CONTENT_TYPE_JSON:
+		return &jsonArrayReader{r: bufio.NewReader(r.Body), maxItemSize: maxItemSize}, nil
+	case CONTENT_TYPE_NDJSON:
+		return newLineReader(r.Body, maxItemSize*MAX_JSON_ESCAPE_RATIO+2, maxItemSize, decodeJSONLine), nil
+	case CONTENT_TYPE_TEXT:
+		return newLineReader(r.Body, maxItemSize, maxItemSize, nil), nil
+	default:
+		return nil, newProblem(http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE", "the body must be %s, %s, or %s", CONTENT_TYPE_JSON, CONTENT_TYPE_NDJSON, CONTENT_TYPE_TEXT)
+	}
+}
+
+// Reads a JSON array of strings without holding more than one item in memory
+type jsonArrayReader struct {
+	r           *bufio.Reader
+	maxItemSize int
+	started     bool
+	done        bool
+	items       int
+}
+
+// Returns the next byte that isn't JSON whitespace
+func (j *jsonArrayReader) nextToken() (byte, error) {
+	for {
+		c, err := j.r.ReadByte()
+
+		if err != nil {
+			return 0, err
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		return c, nil
+	}
+}
+
+// Returns the next token, reporting the end of the body as a truncated array
+func (j *jsonArrayReader) expectToken() (byte, error) {
+	c, err := j.nextToken()
+
+	if err == io.EOF {
+		return 0, malformed("the body ends before the end of the JSON array")
+	}
+
+	return c, err
+}
+
+func (j *jsonArrayReader) next() (string, error) {
+	if j.done {
+		return "", io.EOF
+	}
+
+	if !j.started {
+		c, err := j.nextToken()
+
+		if err == io.EOF || (err == nil && c != '[') {
+			return "", malformed("the body must be a JSON array of strings")
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		j.started = true
+
+		if c, err = j.expectToken(); err != nil {
+			return "", err
+		}
+
+		if c == ']' {
+			if err := j.finish(); err != nil {
+				return "", err
+			}
+
+			return "", io.EOF
+		}
+
+		j.r.UnreadByte()
+	}
+
+	item := j.items + 1
+
+	c, err := j.expectToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	if c != '"' {
+		return "", malformed("item %d is not a JSON string", item)
+	}
+
+	raw := []byte{'"'}
+	escaped := false
+
+	for {
+		c, err := j.r.ReadByte()
+
+		if err == io.EOF {
+			return "", malformed("item %d is an unterminated JSON string", item)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		raw = append(raw, c)
+
+		if len(raw) > j.maxItemSize*MAX_JSON_ESCAPE_RATIO+2 {
+			return "", tooLarge("item %d is larger than the maximum of %d bytes", item, j.maxItemSize)
+		}
+
+		if escaped {
+			escaped = false
+		} else if c == '\\' {
+			escaped = true
+		} else if c == '"' {
+			break
+		}
+	}
+
+	var value string
+
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", malformed("item %d is not a valid JSON string: %v", item, err)
+	}
+
+	if len(value) > j.maxItemSize {
+		return "", tooLarge("item %d is larger than the maximum of %d bytes", item, j.maxItemSize)
+	}
+
+	j.items = item
+
+	c, err = j.expectToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	switch c {
+	case ',':
+	case ']':
+		if err := j.finish(); err != nil {
+			return "", err
+		}
+	default:
+		return "", malformed("expected , or ] after item %d", item)
+	}
+
+	return value, nil
+}
+
+// Makes sure that nothing but whitespace follows the end of the array
+func (j *jsonArrayReader) finish() error {
+	j.done = true
+
+	_, err := j.nextToken()
+
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return malformed("unexpected data after the end of the JSON array")
+	default:
+		return err
+	}
+}
+
+// Reads an item from each line of the body, skipping blank lines
+type lineReader struct {
+	scanner     *bufio.Scanner
+	maxItemSize int
+	decode      func(line string) (string, error)
+	line        int
+}
+
+func newLineReader(body io.Reader, maxLineSize, maxItemSize int, decode func(string) (string, error)) *lineReader {
+	scanner := bufio.NewScanner(body)
+
+	// Leaves room for a trailing \r
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize+2)
+
+	return &lineReader{scanner: scanner, maxItemSize: maxItemSize, decode: decode}
+}
+
+func (l *lineReader) next() (string, error) {
+	for l.scanner.Scan() {
+		l.line++
+
+		line := strings.TrimSuffix(l.scanner.Text(), "\r")
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if l.decode != nil {
+			value, err := l.decode(line)
+
+			if err != nil {
+				return "", malformed("line %d: %v", l.line, err)
+			}
+
+			line = value
+		}
+
+		if len(line) > l.maxItemSize {
+			return "", tooLarge("line %d is larger than the maximum item size of %d bytes", l.line, l.maxItemSize)
+		}
+
+		return line, nil
+	}
+
+	if err := l.scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return "", tooLarge("line %d is larger than the maximum item size of %d bytes", l.line+1, l.maxItemSize)
+		}
+
+		return "", err
+	}
+
+	return "", io.EOF
+}
+
+func decodeJSONLine(line string) (string, error) {
+	var value string
+
+	if err := json.Unmarshal([]byte(line), &value); err != nil {
+		return "", fmt.Errorf("not a JSON string: %v", err)
+	}
+
+	return value, nil
+}
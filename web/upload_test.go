@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lucperkins/colossus/proto/data"
+	"github.com/unrolled/render"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reads every item of an upload
+func readItems(items itemReader) ([]string, error) {
+	values := []string{}
+
+	for {
+		value, err := items.next()
+
+		if err == io.EOF {
+			return values, nil
+		}
+
+		if err != nil {
+			return values, err
+		}
+
+		values = append(values, value)
+	}
+}
+
+// The stable code of the problem that an error is, if it is one
+func problemCode(err error) string {
+	if p, ok := err.(*problem); ok {
+		return p.Code
+	}
+
+	return ""
+}
+
+func TestItemReader(t *testing.T) {
+	const maxItemSize = 8
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		wantCode    string
+	}{
+		{"empty JSON array", CONTENT_TYPE_JSON, "[]", []string{}, ""},
+		{"JSON array", CONTENT_TYPE_JSON, `["a","b"]`, []string{"a", "b"}, ""},
+		{"JSON whitespace and escapes", CONTENT_TYPE_JSON, " [ \"a\" ,\n\"b\\\"c\", \"\\u00e9\" ] \n", []string{"a", `b"c`, "é"}, ""},
+		{"JSON escapes up to the limit", CONTENT_TYPE_JSON, `["` + strings.Repeat(`\u0041`, maxItemSize) + `"]`, []string{"AAAAAAAA"}, ""},
+		{"JSON item too large", CONTENT_TYPE_JSON, `["123456789"]`, nil, "ITEM_TOO_LARGE"},
+		{"JSON escapes beyond the limit", CONTENT_TYPE_JSON, `["` + strings.Repeat(`\u0041`, maxItemSize+1) + `"]`, nil, "ITEM_TOO_LARGE"},
+		{"empty JSON body", CONTENT_TYPE_JSON, "", nil, "MALFORMED_BODY"},
+		{"JSON object", CONTENT_TYPE_JSON, `{"a":"b"}`, nil, "MALFORMED_BODY"},
+		{"JSON number", CONTENT_TYPE_JSON, `["a",1]`, nil, "MALFORMED_BODY"},
+		{"missing comma", CONTENT_TYPE_JSON, `["a" "b"]`, nil, "MALFORMED_BODY"},
+		{"truncated JSON array", CONTENT_TYPE_JSON, `["a",`, nil, "MALFORMED_BODY"},
+		{"unterminated JSON string", CONTENT_TYPE_JSON, `["a`, nil, "MALFORMED_BODY"},
+		{"invalid JSON escape", CONTENT_TYPE_JSON, `["\x"]`, nil, "MALFORMED_BODY"},
+		{"data after the JSON array", CONTENT_TYPE_JSON, `["a"] ["b"]`, nil, "MALFORMED_BODY"},
+		{"NDJSON", CONTENT_TYPE_NDJSON, "\"a\"\n\n\"b\"\r\n", []string{"a", "b"}, ""},
+		{"NDJSON line isn't a string", CONTENT_TYPE_NDJSON, "\"a\"\nb\n", nil, "MALFORMED_BODY"},
+		{"NDJSON item too large", CONTENT_TYPE_NDJSON, `"123456789"`, nil, "ITEM_TOO_LARGE"},
+		{"text", CONTENT_TYPE_TEXT, "a\n\nb\r\nc", []string{"a", "b", "c"}, ""},
+		{"text with a charset", CONTENT_TYPE_TEXT + "; charset=utf-8", "a\n", []string{"a"}, ""},
+		{"no content type", "", "a\nb\n", []string{"a", "b"}, ""},
+		{"text line too large", CONTENT_TYPE_TEXT, "123456789\n", nil, "ITEM_TOO_LARGE"},
+		{"text line beyond the buffer", CONTENT_TYPE_TEXT, "a\n" + strings.Repeat("x", 100) + "\n", nil, "ITEM_TOO_LARGE"},
+		{"unsupported content type", "application/xml", "<a/>", nil, "UNSUPPORTED_MEDIA_TYPE"},
+		{"invalid content type", "text/plain; charset", "a", nil, "INVALID_HEADER"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/data", strings.NewReader(tt.body))
+
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			items, err := newItemReader(r, maxItemSize)
+
+			if err == nil {
+				var values []string
+
+				values, err = readItems(items)
+
+				if err == nil && !reflect.DeepEqual(values, tt.want) {
+					t.Errorf("items = %q, want %q", values, tt.want)
+				}
+			}
+
+			if got := problemCode(err); got != tt.wantCode {
+				t.Errorf("error = %v, want code %q", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+// A data service that accepts a number of items and then ends the upload with the given status
+type fakeDataService struct {
+	data.DataServiceClient
+
+	accept int
+	err    error
+
+	received []string
+	closed   bool
+}
+
+func (s *fakeDataService) StreamingPut(ctx context.Context, opts ...grpc.CallOption) (data.DataService_StreamingPutClient, error) {
+	return &fakePutStream{service: s}, nil
+}
+
+type fakePutStream struct {
+	grpc.ClientStream
+
+	service *fakeDataService
+}
+
+func (s *fakePutStream) Send(req *data.DataRequest) error {
+	if len(s.service.received) == s.service.accept {
+		return io.EOF
+	}
+
+	s.service.received = append(s.service.received, req.Request)
+
+	return nil
+}
+
+func (s *fakePutStream) CloseAndRecv() (*data.DataResponse, error) {
+	s.service.closed = true
+
+	if s.service.err != nil {
+		return nil, s.service.err
+	}
+
+	return &data.DataResponse{Value: strconv.Itoa(len(s.service.received))}, nil
+}
+
+func TestHandlePut(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		accept     int
+		err        error
+		wantStatus int
+		wantCode   string
+		wantClosed bool
+	}{
+		{"stored", "a\nb\n", 10, nil, http.StatusAccepted, "", true},
+		{"too many items", "a\nb\nc\nd\n", 10, nil, http.StatusRequestEntityTooLarge, "TOO_MANY_ITEMS", false},
+		{"malformed item", "a\n" + strings.Repeat("x", 100) + "\n", 10, nil, http.StatusRequestEntityTooLarge, "ITEM_TOO_LARGE", false},
+		{"refused", "a\nb\n", 10, status.Error(codes.PermissionDenied, "read only"), http.StatusForbidden, "PERMISSION_DENIED", true},
+		{"ended early", "a\nb\nc\n", 1, status.Error(codes.InvalidArgument, "b is not allowed"), http.StatusBadRequest, "INVALID_ARGUMENT", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &fakeDataService{accept: tt.accept, err: tt.err}
+
+			s := &HttpServer{
+				dataClient:        service,
+				renderer:          render.New(render.Options{}),
+				maxUploadItemSize: 8,
+				maxUploadItems:    3,
+			}
+
+			r := httptest.NewRequest(http.MethodPut, "/data", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			s.handlePut(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantCode != "" {
+				var p problem
+
+				if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+					t.Fatal(err)
+				}
+
+				if p.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", p.Code, tt.wantCode)
+				}
+			}
+
+			// Uploads that the web service refuses are abandoned rather than finished, so that the
+			// data service doesn't keep what was sent of them
+			if service.closed != tt.wantClosed {
+				t.Errorf("stream closed = %t, want %t", service.closed, tt.wantClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucperkins/colossus/proto/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How often clients are pinged, and how long they have to answer before they're assumed gone
+	WEBSOCKET_PING_INTERVAL = 30 * time.Second
+	WEBSOCKET_PONG_TIMEOUT  = 60 * time.Second
+
+	// How long a single frame may take to write before the client is assumed stuck
+	WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+
+	// Close frame reasons may be at most this long
+	WEBSOCKET_MAX_CLOSE_REASON = 123
+)
+
+var webSocketsGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name:        "web_svc_websockets",
+		Help:        "Open WebSocket connections",
+		ConstLabels: prometheus.Labels{"service": "colossus-web"},
+	},
+)
+
+// Rejects cross-origin upgrades, since browsers don't apply the same-origin policy to WebSockets
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, r, newProblem(status, "WEBSOCKET_HANDSHAKE_FAILED", "%v", reason))
+	},
+}
+
+// The open WebSocket connections, which the HTTP server's shutdown doesn't know about once
+// they've been hijacked
+type webSockets struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+}
+
+func newWebSockets() *webSockets {
+	return &webSockets{conns: map[*websocket.Conn]struct{}{}}
+}
+
+func (ws *webSockets) add(conn *websocket.Conn) {
+	ws.mu.Lock()
+	ws.conns[conn] = struct{}{}
+	ws.mu.Unlock()
+
+	webSocketsGauge.Inc()
+}
+
+func (ws *webSockets) remove(conn *websocket.Conn) {
+	ws.mu.Lock()
+	delete(ws.conns, conn)
+	ws.mu.Unlock()
+
+	webSocketsGauge.Dec()
+}
+
+// Tells every client that the server is going away and closes its connection, which ends its
+// Exchange stream
+func (ws *webSockets) closeAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for conn := range ws.conns {
+		closeWebSocket(conn, websocket.CloseGoingAway, "server shutting down")
+		conn.Close()
+	}
+}
+
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	if len(reason) > WEBSOCKET_MAX_CLOSE_REASON {
+		reason = reason[:WEBSOCKET_MAX_CLOSE_REASON]
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+}
+
+// Bridges a WebSocket to the data service's Exchange stream: every text frame from the client is
+// sent as a request and every response is sent back as a text frame. Neither side is read from
+// faster than the other side is written to, so a slow client holds back the data service (and the
+// other way around) instead of having messages pile up in memory.
+func (s *HttpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	// The upgrader has already responded with an error
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	s.webSockets.add(conn)
+	defer s.webSockets.remove(conn)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := s.dataClient.Exchange(ctx)
+
+	if err != nil {
+		closeWebSocket(conn, closeCode(err), status.Convert(err).Message())
+		return
+	}
+
+	written := make(chan struct{})
+
+	go func() {
+		defer close(written)
+
+		s.writeResponses(conn, stream)
+	}()
+
+	go pingWebSocket(conn, written)
+
+	// Cancelling when the client goes away ends the stream, and with it the writer. When it's
+	// the data service that ends the stream instead, the writer closes the connection, which
+	// ends the reader.
+	if clientGone := s.readRequests(conn, stream); clientGone {
+		cancel()
+	}
+
+	<-written
+}
+
+// Sends the client's frames on to the data service until either side is done, and reports
+// whether it was the client that went away
+func (s *HttpServer) readRequests(conn *websocket.Conn, stream data.DataService_ExchangeClient) bool {
+	conn.SetReadLimit(int64(s.maxUploadItemSize))
+	conn.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_TIMEOUT))
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_TIMEOUT))
+	})
+
+	for {
+		kind, message, err := conn.ReadMessage()
+
+		if err != nil {
+			return true
+		}
+
+		if kind != websocket.TextMessage {
+			closeWebSocket(conn, websocket.CloseUnsupportedData, "only text frames are supported")
+			return true
+		}
+
+		conn.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_TIMEOUT))
+
+		req := &data.DataRequest{
+			Request: string(message),
+		}
+
+		// The stream has ended, and the writer will find out why from Recv
+		if err := stream.Send(req); err != nil {
+			return false
+		}
+	}
+}
+
+// Sends the data service's responses on to the client until the stream ends, then closes the
+// connection with a status that says how it ended
+func (s *HttpServer) writeResponses(conn *websocket.Conn, stream data.DataService_ExchangeClient) {
+	defer conn.Close()
+
+	for {
+		res, err := stream.Recv()
+
+		if err == io.EOF {
+			closeWebSocket(conn, websocket.CloseNormalClosure, "")
+			return
+		}
+
+		if err != nil {
+			if status.Code(err) != codes.Canceled {
+				closeWebSocket(conn, closeCode(err), status.Convert(err).Message())
+			}
+
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(res.Value)); err != nil {
+			return
+		}
+	}
+}
+
+// Pings the client until done is closed, so that dead connections are noticed and idle ones
+// aren't dropped by proxies along the way
+func pingWebSocket(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(WEBSOCKET_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WEBSOCKET_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// The WebSocket close code for a gRPC error
+func closeCode(err error) int {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return websocket.CloseTryAgainLater
+	case codes.InvalidArgument:
+		return websocket.ClosePolicyViolation
+	default:
+		return websocket.CloseInternalServerErr
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucperkins/colossus/proto/data"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How long the tests wait for something to happen on the other end of a connection
+const WEBSOCKET_TEST_TIMEOUT = 5 * time.Second
+
+// A data service whose Exchange streams are driven by the test: requests arrive on requests,
+// responses sent on responses go out, and an error sent on end finishes the stream
+type fakeExchangeService struct {
+	data.DataServiceClient
+
+	requests  chan string
+	responses chan string
+	end       chan error
+
+	// Closed when the web service cancels the stream
+	cancelled chan struct{}
+}
+
+func newFakeExchangeService() *fakeExchangeService {
+	return &fakeExchangeService{
+		requests:  make(chan string),
+		responses: make(chan string),
+		end:       make(chan error, 1),
+		cancelled: make(chan struct{}),
+	}
+}
+
+func (s *fakeExchangeService) Exchange(ctx context.Context, opts ...grpc.CallOption) (data.DataService_ExchangeClient, error) {
+	go func() {
+		<-ctx.Done()
+		close(s.cancelled)
+	}()
+
+	return &fakeExchangeStream{ctx: ctx, service: s}, nil
+}
+
+type fakeExchangeStream struct {
+	grpc.ClientStream
+
+	ctx     context.Context
+	service *fakeExchangeService
+}
+
+func (s *fakeExchangeStream) Send(req *data.DataRequest) error {
+	select {
+	case s.service.requests <- req.Request:
+		return nil
+	case <-s.ctx.Done():
+		return io.EOF
+	}
+}
+
+func (s *fakeExchangeStream) Recv() (*data.DataResponse, error) {
+	select {
+	case value := <-s.service.responses:
+		return &data.DataResponse{Value: value}, nil
+	case err := <-s.service.end:
+		return nil, err
+	case <-s.ctx.Done():
+		return nil, status.Error(codes.Canceled, s.ctx.Err().Error())
+	}
+}
+
+// Serves the WebSocket handler, with handled closed once each connection has been handled
+func newWebSocketServer(t *testing.T, service *fakeExchangeService) (*HttpServer, string, <-chan struct{}) {
+	s := &HttpServer{
+		dataClient:        service,
+		webSockets:        newWebSockets(),
+		maxUploadItemSize: 64,
+	}
+
+	handled := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(w, r)
+
+		if websocket.IsWebSocketUpgrade(r) {
+			close(handled)
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http"), handled
+}
+
+func dialWebSocket(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(WEBSOCKET_TEST_TIMEOUT))
+
+	return conn
+}
+
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	select {
+	case <-done:
+	case <-time.After(WEBSOCKET_TEST_TIMEOUT):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	service := newFakeExchangeService()
+
+	_, url, _ := newWebSocketServer(t, service)
+
+	conn := dialWebSocket(t, url)
+
+	for _, message := range []string{"hello", "world"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-service.requests:
+			if got != message {
+				t.Errorf("the data service got %q, want %q", got, message)
+			}
+		case <-time.After(WEBSOCKET_TEST_TIMEOUT):
+			t.Fatalf("%q never reached the data service", message)
+		}
+
+		service.responses <- strings.ToUpper(message)
+
+		kind, got, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if kind != websocket.TextMessage || string(got) != strings.ToUpper(message) {
+			t.Errorf("got frame %d %q, want a text frame %q", kind, got, strings.ToUpper(message))
+		}
+	}
+}
+
+// The connection is closed with a status that says how the data service ended the stream
+func TestWebSocketClosesWhenTheStreamEnds(t *testing.T) {
+	tests := []struct {
+		name       string
+		end        error
+		wantCode   int
+		wantReason string
+	}{
+		{"finished", io.EOF, websocket.CloseNormalClosure, ""},
+		{"unavailable", status.Error(codes.Unavailable, "data is down"), websocket.CloseTryAgainLater, "data is down"},
+		{"invalid", status.Error(codes.InvalidArgument, "bad request"), websocket.ClosePolicyViolation, "bad request"},
+		{"failed", status.Error(codes.Internal, strings.Repeat("x", 200)), websocket.CloseInternalServerErr, strings.Repeat("x", WEBSOCKET_MAX_CLOSE_REASON)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newFakeExchangeService()
+
+			s, url, handled := newWebSocketServer(t, service)
+
+			conn := dialWebSocket(t, url)
+
+			service.end <- tt.end
+
+			_, _, err := conn.ReadMessage()
+
+			closeErr, ok := err.(*websocket.CloseError)
+
+			if !ok {
+				t.Fatalf("ReadMessage() = %v, want a close frame", err)
+			}
+
+			if closeErr.Code != tt.wantCode || closeErr.Text != tt.wantReason {
+				t.Errorf("closed with %d %q, want %d %q", closeErr.Code, closeErr.Text, tt.wantCode, tt.wantReason)
+			}
+
+			waitFor(t, handled, "the handler to return")
+
+			if len(s.webSockets.conns) != 0 {
+				t.Errorf("%d connections still tracked after the handler returned", len(s.webSockets.conns))
+			}
+		})
+	}
+}
+
+// A client going away cancels the stream, so that the data service stops working for it
+func TestWebSocketClientGoingAwayCancelsTheStream(t *testing.T) {
+	service := newFakeExchangeService()
+
+	_, url, handled := newWebSocketServer(t, service)
+
+	conn := dialWebSocket(t, url)
+
+	conn.Close()
+
+	waitFor(t, service.cancelled, "the stream to be cancelled")
+	waitFor(t, handled, "the handler to return")
+}
+
+func TestWebSocketRejectsBinaryFrames(t *testing.T) {
+	service := newFakeExchangeService()
+
+	_, url, _ := newWebSocketServer(t, service)
+
+	conn := dialWebSocket(t, url)
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Errorf("ReadMessage() = %v, want a close frame with status %d", err, websocket.CloseUnsupportedData)
+	}
+
+	waitFor(t, service.cancelled, "the stream to be cancelled")
+}
+
+func TestWebSocketRequiresAHandshake(t *testing.T) {
+	service := newFakeExchangeService()
+
+	_, url, _ := newWebSocketServer(t, service)
+
+	res, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	var p problem
+
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Code != "WEBSOCKET_HANDSHAKE_FAILED" {
+		t.Errorf("code = %q, want WEBSOCKET_HANDSHAKE_FAILED", p.Code)
+	}
+}